@@ -23,9 +23,13 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"os"
+	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -42,14 +46,316 @@ type Template struct {
 	// PrefixSize is size of Prefix in bytes.
 	PrefixSize int64
 
+	// PrefixParts is an alternative to Prefix that composes the prefix from multiple parts.
+	//
+	// The parts are placed at the beginning of the file one after another. Only one of Prefix and PrefixParts
+	// may be set.
+	//
+	// Parts may implement ReaderAt interface from this package, in that case
+	// their ReadAtContext method will be called instead of ReadAt.
+	PrefixParts []SizedReaderAt
+
+	// ValidatePrefix makes NewArchive check that Prefix does not contain an end of central directory
+	// signature, which could confuse readers looking for the end of the archive.
+	//
+	// Only prefixes up to MaxValidatePrefixSize bytes are checked, larger prefixes are read only by the
+	// readers and the caller is responsible for their content.
+	ValidatePrefix bool
+
 	// Entries is a list of files in the archive.
 	Entries []*FileHeader
 
+	// GoCompat makes the archive match the output of archive/zip.Writer for equivalent input, for example
+	// for comparing with golden files created by archive/zip.
+	//
+	// Without GoCompat, the output already matches for entries with non-zero Modified time written using
+	// Writer.CreateHeader. With GoCompat, entries with zero Modified time also match: the extended timestamp
+	// is omitted and the MS-DOS date and time are zero. Known differences that remain:
+	//
+	//	- Content compressed with Deflate matches only if it was compressed by archive/zip with the same settings.
+	//	- Options that change the layout, like OmitDataDescriptors, Zip64LocalHeaders, ExtraOrder, EOCDAlignment
+	//	  or DirectoryChecksum, produce output that archive/zip.Writer can't produce.
+	GoCompat bool
+
+	// MSDOSTimeUTC computes the MS-DOS date and time fields of headers from the UTC components of
+	// FileHeader.Modified.
+	//
+	// By default, the MS-DOS fields use the components of Modified in its location, like archive/zip does,
+	// while the extended timestamp is always an absolute Unix time. Readers that only understand the MS-DOS fields
+	// interpret them in their own local time zone, so the two encodings may appear to differ by the zone offset.
+	// With MSDOSTimeUTC, the MS-DOS fields are consistent with the extended timestamp for readers in UTC.
+	MSDOSTimeUTC bool
+
+	// OnZip64Required, if not nil, is called by NewArchive when the archive needs zip64 end of central directory
+	// records, once for each reason: too many entries, too large central directory or too large offset of
+	// the central directory. Readers without zip64 support can't open such archives, so operators serving legacy
+	// clients may want to be alerted.
+	OnZip64Required func(reason string)
+
+	// LegacyCompat produces archives readable by very old tools like PKZIP 2.04g, at the cost of some metadata.
+	//
+	// The extended timestamp extra field is not written, so modification times are only stored in the MS-DOS
+	// date and time fields, which have two-second precision and no time zone. Names and comments are stored
+	// with the UTF-8 flag only if they can't be represented otherwise, which is also the default; old readers
+	// show such names garbled. Versions needed to extract stay at 2.0 and zip64 structures are only written if the
+	// archive is too large or has too many entries without them, as usual.
+	// LegacyCompat can't be combined with Zip64LocalHeaders.
+	LegacyCompat bool
+
+	// AllowDotDot allows entry names with ".." path components.
+	//
+	// By default, NewArchive rejects such names, since extracting them may write files outside of the target
+	// directory ("zip slip"). Both forward slashes and backslashes are treated as separators.
+	AllowDotDot bool
+
+	// RawParts are arbitrary data inserted between entries.
+	//
+	// This is a low-level feature intended for constructing archives that exercise edge cases of readers,
+	// such as gaps between entries. Offsets in the central directory account for the inserted data.
+	RawParts []RawPart
+
 	// Comment is archive comment text.
 	//
-	// It may be up to 64K long.
+	// It may be up to 64K long and must not contain the end of central directory signature ("PK\x05\x06").
 	Comment string
 
+	// CommentWithDirectoryOffset appends the offset of the central directory to the archive comment.
+	//
+	// The suffix has the format "\x00CDOFF:<offset>", where offset is the decimal offset of the central directory
+	// from the beginning of the archive (see Archive.CentralDirectoryOffset). Some custom readers use it to locate
+	// the central directory even if there is garbage appended to the archive.
+	// The comment including the suffix may be up to 64K long.
+	CommentWithDirectoryOffset bool
+
+	// DefaultDirMode, if not zero, is the mode of directory entries without explicit mode,
+	// that is with zero ExternalAttrs, for example 0755.
+	DefaultDirMode os.FileMode
+
+	// DefaultFileMode, if not zero, is the mode of file entries without explicit mode,
+	// that is with zero ExternalAttrs, for example 0644.
+	DefaultFileMode os.FileMode
+
+	// ExtraOrder specifies the order of extra fields in local and central directory headers.
+	//
+	// By default, fields from FileHeader.Extra come first, followed by the extended timestamp, the AES extra field and
+	// the zip64 extra field, in this order. Some tools expect the zip64 extra field first, for example.
+	// Kinds of fields missing in ExtraOrder follow the listed ones in the default order.
+	// Fields are classified by their header ID, so fields in FileHeader.Extra with the ID of a generated field
+	// are ordered together with the generated ones.
+	ExtraOrder []ExtraField
+
+	// DirectoryChecksum stores CRC32 of the central directory headers in the zip64 end of central directory record.
+	//
+	// The checksum is written as a block with header ID 0x737a in the zip64 extensible data sector, so it is only
+	// present if the archive needs zip64 end records. Cooperating tools can use it to detect tampering with the
+	// central directory; other readers ignore it.
+	DirectoryChecksum bool
+
+	// EOCDAlignment aligns the offset of the central directory to a multiple of EOCDAlignment bytes,
+	// by inserting zero padding after the data of the last entry.
+	//
+	// Some imaging formats expect the archive directory at a sector boundary. Zero or one means no alignment.
+	EOCDAlignment int64
+
+	// OmitDataDescriptors stores CRC32 and sizes of entries in local file headers instead of data descriptors.
+	//
+	// By default, a data descriptor is written after the content of each file, like archive/zip does.
+	// Since the sizes are known in advance, the data descriptors are not necessary and some readers handle
+	// archives without them better.
+	//
+	// Without data descriptors, the local headers are the only place in the entry data where the sizes are stored,
+	// so they must be known. This is always the case here, since entries with Content must declare
+	// CompressedSize64; entries with non-empty Content and zero CompressedSize64 are rejected.
+	OmitDataDescriptors bool
+
+	// Zip64LocalHeaders stores sizes of all files in zip64 extra fields of local file headers, even if they are small,
+	// so that all local headers have the same layout. It implies OmitDataDescriptors.
+	//
+	// This is intended for deterministic build pipelines that require uniform local headers.
+	// The central directory is not affected.
+	Zip64LocalHeaders bool
+
+	// DirDataDescriptors writes a data descriptor with zero CRC32 and sizes after each directory entry and sets
+	// the data descriptor flag (0x8) of directories.
+	//
+	// The ZIP specification doesn't require data descriptors for directories and archive/zip doesn't write them,
+	// but a few extractors expect every entry to have one. It has no effect with OmitDataDescriptors or
+	// Zip64LocalHeaders.
+	DirDataDescriptors bool
+
+	// ServeTimeout limits the time ServeHTTP spends serving a single request. Zero means no limit.
+	//
+	// Reads of the archive data are passed a context with the timeout applied. If the timeout expires before
+	// any data is sent, ServeHTTP responds with 503 Service Unavailable. If some data was already sent,
+	// the connection is aborted. The same applies to reads failing with a timeout of the backend, see ErrTimeout.
+	ServeTimeout time.Duration
+
+	// ErrorHandler, if not nil, writes the response when reading data of the archive fails while serving a request
+	// by ServeHTTP or ServeEntry, instead of the truncated response http.ServeContent would send. It can choose
+	// the status code, body and headers like Retry-After depending on err. This includes reads that failed
+	// due to Authorize or a timeout, in which case err matches ErrTimeout.
+	//
+	// ErrorHandler is only called if no part of the response body was sent yet, otherwise the connection is
+	// aborted. It is not called if the request was canceled, for example because the client went away.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+	// Authorize, if not nil, is called by ServeHTTP before content of an entry is served.
+	//
+	// It is called at most once per entry and request, with the request context and the name of the entry.
+	// If it returns a non-nil error, ServeHTTP responds with 403 Forbidden, or aborts the response if part of it
+	// was already sent. Headers and the central directory are served regardless, so all entries are still listed.
+	Authorize func(ctx context.Context, entryName string) error
+
+	// OnClientDisconnect, if not nil, is called by ServeHTTP when writing the response to the client fails,
+	// usually because the client closed the connection.
+	//
+	// bytesSent is the number of bytes of the response body successfully written before the failure.
+	// It is called at most once per request, after serving the request finished.
+	OnClientDisconnect func(r *http.Request, bytesSent int64)
+
+	// HashResponses, if not nil, creates a hash for each request served by ServeHTTP. The response body written to
+	// the client is written to the hash and its digest is passed to OnRequestComplete, so that an audit trail can
+	// record exactly what each client received, including partial responses to range requests.
+	HashResponses func() hash.Hash
+
+	// OnRequestComplete, if not nil, is called by ServeHTTP after serving a request finished.
+	//
+	// bytesSent is the number of bytes of the response body successfully written to the client.
+	// digest is the sum of the hash created by HashResponses over those bytes, or nil if HashResponses is nil.
+	// Requests rejected due to MaxConcurrentRequests are not reported.
+	OnRequestComplete func(r *http.Request, bytesSent int64, digest []byte)
+
+	// OnRequestServed, if not nil, is called at the end of each request handled by ServeHTTP, including requests
+	// rejected due to MaxConcurrentRequests, so that billing or quota systems can meter downloads.
+	OnRequestServed func(r *http.Request, stats RequestStats)
+
+	// OnEntryEnter, if not nil, is called by ServeHTTP when serving a request starts reading content of an entry.
+	// Together with OnEntryLeave, it shows which files inside the archive clients actually download.
+	OnEntryEnter func(r *http.Request, entryName string)
+
+	// OnEntryLeave, if not nil, is called by ServeHTTP when serving a request stops reading content of an entry
+	// entered before: because the read reached the end of the content, moved elsewhere, or the request ended.
+	//
+	// bytesRead is the number of bytes of the entry content read since entering it, complete is true if that was
+	// the whole content. An entry may be entered and left multiple times per request with multiple ranges.
+	OnEntryLeave func(r *http.Request, entryName string, bytesRead int64, complete bool)
+
+	// StableETag computes the Etag only from the fields that describe the data of the archive: sizes of prefix and
+	// raw parts, entry names, methods, sizes and CRC32 checksums, and the archive comment.
+	//
+	// By default, the Etag covers all headers including modification times and extra fields, so archives with the same
+	// content but different modification times have different Etags. With StableETag, caches stay valid across
+	// rebuilds that only touch modification times, even though the archive bytes change.
+	StableETag bool
+
+	// ETag, if not empty, is the Etag header sent by ServeHTTP instead of the one computed from the headers,
+	// for example a hash of the content computed offline or derived from a version identifier of the data.
+	// It should be a quoted string like "\"v42\"" or a weak tag like "W/\"v42\""; other values are quoted.
+	//
+	// At most one of ETag, ETagFunc, StableETag and DisableETag can be set.
+	ETag string
+
+	// ETagFunc, if not nil, computes the Etag header sent by ServeHTTP instead of the default. It is called once,
+	// when the Etag is needed for the first time, and its result is quoted like ETag. If it returns an empty string,
+	// no Etag header is sent.
+	ETagFunc func() string
+
+	// DisableETag disables the Etag header, so that requests are not conditional on it. Last-Modified is still sent.
+	//
+	// The default Etag is computed on first use by hashing all headers of the archive, which is wasted work for
+	// archives with many entries served only once; NewArchive also doesn't keep track of the hashed data.
+	DisableETag bool
+
+	// MaxRanges limits the number of byte ranges in a Range header served by ServeHTTP and ServeEntry.
+	// Requests with more ranges are served as if they had no Range header, with the whole content.
+	// Zero means no limit.
+	//
+	// Each range of a multi-range request is read separately, so a limit prevents clients from amplifying
+	// a single request into many scattered reads from remote backends.
+	MaxRanges int
+
+	// MaxConcurrentRequests limits the number of requests ServeHTTP serves at the same time. Zero means no limit.
+	//
+	// Requests over the limit are responded with 503 Service Unavailable and a Retry-After header.
+	MaxConcurrentRequests int
+
+	// MaxConcurrentFetches limits the number of concurrent reads from Prefix, PrefixParts, RawParts and
+	// Content of entries, across all requests. Zero means no limit.
+	//
+	// Headers and the central directory are kept in memory, so reads of them never wait for the limit.
+	// This way clients listing the archive are not queued behind large content fetches from remote storage.
+	MaxConcurrentFetches int
+
+	// MaxRequestRate limits the rate in bytes per second at which ServeHTTP and ServeEntry write the response body
+	// of a single request. Zero means no limit.
+	MaxRequestRate int64
+
+	// MaxArchiveRate limits the total rate in bytes per second at which ServeHTTP and ServeEntry write response
+	// bodies of all requests for the archive, so that serving large archives doesn't saturate the network.
+	// The rate is shared fairly between concurrent requests. Zero means no limit.
+	MaxArchiveRate int64
+
+	// Metrics, if not nil, receives measurements of reads of user-supplied data and of entries served by
+	// ServeHTTP and ServeEntry.
+	Metrics Metrics
+
+	// Logger, if not nil, receives warnings about suspicious entries when the archive is created, malformed Range
+	// headers and errors reading data while serving requests, with entry names and offsets.
+	Logger Logger
+
+	// OnError, if not nil, is called by ServeHTTP and ServeEntry when reading data of the archive fails, for example
+	// because a backend storing entry content is unavailable. http.ServeContent only reports such errors by
+	// aborting the response, so this allows alerting on specific backend failures.
+	//
+	// entryName is the name of the entry whose content failed to be read and offset the offset within its content.
+	// If the failure is outside of entry content, for example in Prefix, entryName is empty and offset is the offset
+	// within the archive. Authorize failures are not reported.
+	//
+	// err matches ErrCanceled if the read failed because the request was canceled, like when the client
+	// disconnects, and ErrTimeout if it failed because a deadline expired, see errors.Is.
+	OnError func(r *http.Request, entryName string, offset int64, err error)
+
+	// ServeEntryDecompressed makes Archive.ServeEntry serve the uncompressed content of entries
+	// instead of their raw compressed data.
+	ServeEntryDecompressed bool
+
+	// RequestContent, if not nil, is called by ServeHTTP and ServeEntry once per request to wrap the data of
+	// the archive. The returned reader is used only for that request, so it can keep per-request state without
+	// locking, like BufferedReaderAt:
+	//
+	//	tmpl.RequestContent = func(content io.ReaderAt) io.ReaderAt {
+	//		return zipserve.NewBufferedReaderAt(content, 64<<10)
+	//	}
+	//
+	// content implements ReaderAt interface from this package. The returned reader may implement it too,
+	// in that case its ReadAtContext method is called instead of ReadAt.
+	RequestContent func(content io.ReaderAt) io.ReaderAt
+
+	// DownloadName, if not empty, is the file name suggested to clients downloading the archive. ServeHTTP sends it
+	// in a Content-Disposition header of type attachment, unless the header is already set. Names that are not plain
+	// ASCII are encoded according to RFC 5987, with an ASCII approximation for older clients.
+	//
+	// DownloadName is also passed to http.ServeContent and, if ContentType is empty, the content type is determined
+	// from its extension using mime.TypeByExtension.
+	DownloadName string
+
+	// ContentType is the Content-Type sent by ServeHTTP, unless the header is already set.
+	// It allows serving formats based on ZIP, like application/epub+zip or application/vnd.android.package-archive.
+	// If empty, the type is determined from DownloadName, falling back to application/zip.
+	ContentType string
+
+	// CacheControl, if not empty, is the Cache-Control header sent by ServeHTTP and ServeEntry with the content,
+	// unless the header is already set. For example, "public, max-age=86400" lets CDNs cache the archive for a day.
+	CacheControl string
+
+	// ExpiresAfter, if positive, makes ServeHTTP and ServeEntry send an Expires header with the content, set to
+	// the time of the request plus ExpiresAfter, unless the header is already set.
+	ExpiresAfter time.Duration
+
+	// Header contains additional headers sent by ServeHTTP and ServeEntry on every response, including error
+	// responses. Headers already set in the response are not replaced.
+	Header http.Header
+
 	// CreateTime is the last modified time of the archive.
 	//
 	// It is used to populate Last-Modified HTTP header.
@@ -57,6 +363,98 @@ type Template struct {
 	CreateTime time.Time
 }
 
+// validateComment checks that comment can be used as the archive comment.
+func validateComment(comment string) error {
+	if len(comment) > uint16max {
+		return errors.New("comment too long")
+	}
+	// Readers locate the end of central directory record by searching for its signature from the end of the file,
+	// a signature in the comment would be found first.
+	var sig [4]byte
+	binary.LittleEndian.PutUint32(sig[:], directoryEndSignature)
+	if strings.Contains(comment, string(sig[:])) {
+		return errors.New("comment contains end of central directory signature")
+	}
+	return nil
+}
+
+// RawPart is data inserted into the archive as is.
+type RawPart struct {
+	// Before is the index of the entry in Template.Entries before which the data is inserted.
+	// Use len(Template.Entries) to insert the data after the last entry, before the central directory.
+	// Multiple parts with the same index are inserted in the order they appear in Template.RawParts.
+	Before int
+
+	// Data is the inserted data.
+	//
+	// Data may implement ReaderAt interface from this package, in that case
+	// Data's ReadAtContext method will be called instead of ReadAt.
+	Data io.ReaderAt
+
+	// Size is size of Data in bytes.
+	Size int64
+}
+
+// directoryPadding returns the number of bytes needed to align offset of the central directory.
+func directoryPadding(t *Template, offset int64) (int64, error) {
+	if t.EOCDAlignment < 0 {
+		return 0, errors.New("negative EOCD alignment")
+	}
+	if t.EOCDAlignment <= 1 {
+		return 0, nil
+	}
+	if rem := offset % t.EOCDAlignment; rem != 0 {
+		return t.EOCDAlignment - rem, nil
+	}
+	return 0, nil
+}
+
+// validateLegacyCompat checks that LegacyCompat is not combined with options old readers don't support.
+func validateLegacyCompat(t *Template) error {
+	if t.LegacyCompat && t.Zip64LocalHeaders {
+		return errors.New("LegacyCompat can't be combined with Zip64LocalHeaders")
+	}
+	return nil
+}
+
+// validateRawParts checks that raw parts of t can be inserted into the archive.
+func validateRawParts(t *Template) error {
+	for _, part := range t.RawParts {
+		if part.Before < 0 || part.Before > len(t.Entries) {
+			return fmt.Errorf("raw part position %d out of range", part.Before)
+		}
+		if part.Size < 0 {
+			return fmt.Errorf("raw part size %d is negative", part.Size)
+		}
+		if part.Data == nil && part.Size != 0 {
+			return errors.New("empty raw part with nonzero length")
+		}
+	}
+	return nil
+}
+
+// validateETag checks that at most one way to compute the Etag is configured.
+func validateETag(t *Template) error {
+	n := 0
+	for _, set := range []bool{t.ETag != "", t.ETagFunc != nil, t.StableETag, t.DisableETag} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of ETag, ETagFunc, StableETag and DisableETag can be set")
+	}
+	return nil
+}
+
+// quoteETag returns etag as a quoted entity tag, unless it is already quoted or empty.
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "\"") || strings.HasPrefix(etag, "W/\"") {
+		return etag
+	}
+	return "\"" + etag + "\""
+}
+
 // Archive represents the ZIP file data to be downloaded by the user.
 //
 // It is a ReaderAt, so allows concurrent access to different byte ranges of the archive.
@@ -64,6 +462,79 @@ type Archive struct {
 	parts      multiReaderAt
 	createTime time.Time
 	etag       string
+	// handlerConfig is the configuration of ServeHTTP and ServeEntry.
+	handlerConfig
+	// etagOnce guards computing etag from etagFunc or etagSources on first use.
+	etagOnce sync.Once
+	// etagFunc is Template.ETagFunc.
+	etagFunc func() string
+	// etagSources is the data covered by the default etag. It is nil if the default etag is not used.
+	etagSources []etagSource
+	// content is the data of the archive, usually pointing to parts.
+	content   sizeReaderAtContext
+	authorize func(ctx context.Context, entryName string) error
+	// requestContent wraps content for a single request, nil if content is used directly.
+	requestContent func(content io.ReaderAt) io.ReaderAt
+	// requests is a semaphore limiting concurrent requests in ServeHTTP, nil if unlimited.
+	requests chan struct{}
+	// metrics receives measurements, nil if not collected.
+	metrics Metrics
+	// onClientDisconnect is called when writing the response fails.
+	onClientDisconnect func(r *http.Request, bytesSent int64)
+	// hashResponses creates hashes of response bodies reported to onRequestComplete.
+	hashResponses func() hash.Hash
+	// onRequestComplete is called after serving a request.
+	onRequestComplete func(r *http.Request, bytesSent int64, digest []byte)
+	// onRequestServed is called after serving a request with its statistics.
+	onRequestServed func(r *http.Request, stats RequestStats)
+	// onEntryEnter and onEntryLeave are called when serving a request starts and stops reading entry content.
+	onEntryEnter func(r *http.Request, entryName string)
+	onEntryLeave func(r *http.Request, entryName string, bytesRead int64, complete bool)
+	// serveEntryDecompressed makes ServeEntry decompress entry content.
+	serveEntryDecompressed bool
+	// centralDirectoryOffset is offset of the central directory or -1 if unknown.
+	centralDirectoryOffset int64
+	// buffers contains storage reused by ArchivePool, nil if the archive is not pooled.
+	buffers *archiveBuffers
+	// dir contains headers of all entries.
+	dir []*header
+	// entryRanges contains [start, end) offsets of each entry in the archive.
+	entryRanges []entryRange
+}
+
+// RequestStats describes a request served by ServeHTTP.
+type RequestStats struct {
+	// Status is the HTTP status code of the response, zero if no response was written.
+	Status int
+	// BytesSent is the number of bytes of the response body successfully written to the client.
+	BytesSent int64
+	// Ranges are the byte ranges requested by the Range header, nil if the whole archive was requested or
+	// the header is malformed. The ranges are requested, not necessarily served, for example when If-Range
+	// doesn't match. Ranges starting beyond the end of the archive are omitted, so Ranges is empty
+	// if the response is 416 Range Not Satisfiable.
+	Ranges []ByteRange
+}
+
+// ByteRange is a range of bytes of an archive.
+type ByteRange struct {
+	// Start is the offset of the first byte.
+	Start int64
+	// End is the offset after the last byte.
+	End int64
+}
+
+// etagSource is a part of the archive covered by its default Etag.
+type etagSource struct {
+	// data is hashed if it is not nil, otherwise only size is hashed.
+	data SizedReaderAt
+	size int64
+}
+
+type entryRange struct {
+	start, end int64
+	// contentStart and contentEnd delimit the content of the entry.
+	contentStart, contentEnd int64
+	name                     string
 }
 
 // NewArchive creates a new Archive from a Template.
@@ -78,9 +549,9 @@ func NewArchive(t *Template) (*Archive, error) {
 	return newArchive(t, bufferView, nil)
 }
 
-type bufferViewFunc func(content func(w io.Writer) error) (sizeReaderAt, error)
+type bufferViewFunc func(content func(w io.Writer) error) (SizedReaderAt, error)
 
-func bufferView(content func(w io.Writer) error) (sizeReaderAt, error) {
+func bufferView(content func(w io.Writer) error) (SizedReaderAt, error) {
 	var buf bytes.Buffer
 
 	err := content(&buf)
@@ -98,80 +569,382 @@ func readerAt(r io.ReaderAt) ReaderAt {
 }
 
 func newArchive(t *Template, view bufferViewFunc, testHookCloseSizeOffset func(size, offset uint64)) (*Archive, error) {
-	if len(t.Comment) > uint16max {
-		return nil, errors.New("comment too long")
+	return buildArchive(t, view, testHookCloseSizeOffset, nil)
+}
+
+// buildArchive creates a new Archive from a Template.
+//
+// If bufs is not nil, the archive uses it for storing its structures instead of allocating new ones.
+func buildArchive(t *Template, view bufferViewFunc, testHookCloseSizeOffset func(size, offset uint64),
+	bufs *archiveBuffers) (*Archive, error) {
+	if err := validateComment(t.Comment); err != nil {
+		return nil, err
+	}
+	prefix, err := templatePrefix(t)
+	if err != nil {
+		return nil, err
+	}
+	if t.ValidatePrefix {
+		if err := validatePrefixParts(prefix); err != nil {
+			return nil, err
+		}
 	}
 
-	ar := new(Archive)
-	dir := make([]*header, 0, len(t.Entries))
-	etagHash := md5.New()
+	if err := validateRawParts(t); err != nil {
+		return nil, err
+	}
+	if err := validateLegacyCompat(t); err != nil {
+		return nil, err
+	}
+	if err := validateETag(t); err != nil {
+		return nil, err
+	}
 
-	if t.Prefix != nil {
-		ar.parts.add(readerAt(t.Prefix), t.PrefixSize)
+	ar := new(Archive)
+	// the sources of the default etag are only kept if it may be needed
+	collectETag := t.ETag == "" && t.ETagFunc == nil && !t.StableETag && !t.DisableETag
+	var dir []*header
+	if bufs != nil {
+		bufs.grow(len(t.Entries))
+		view = bufs.view
+		ar.buffers = bufs
+		ar.parts.parts = bufs.parts[:0]
+		ar.entryRanges = bufs.entryRanges[:0]
+		if collectETag {
+			ar.etagSources = bufs.etagSources[:0]
+		}
+		dir = bufs.dir[:0]
+	} else {
+		ar.entryRanges = make([]entryRange, 0, len(t.Entries))
+		if collectETag {
+			ar.etagSources = make([]etagSource, 0, 2*len(t.Entries)+1)
+		}
+		dir = make([]*header, 0, len(t.Entries))
+	}
+	addETagSource := func(src etagSource) {
+		if collectETag {
+			ar.etagSources = append(ar.etagSources, src)
+		}
+	}
+	headerOpts := headerOptions{
+		extraOrder:   t.ExtraOrder,
+		zip64:        t.Zip64LocalHeaders,
+		goCompat:     t.GoCompat,
+		msdosTimeUTC: t.MSDOSTimeUTC,
+	}
+	limit := func(r ReaderAt) ReaderAt { return r }
+	if t.MaxConcurrentFetches > 0 {
+		fetches := make(chan struct{}, t.MaxConcurrentFetches)
+		limit = func(r ReaderAt) ReaderAt {
+			return fetchLimitReaderAt{r: r, fetches: fetches}
+		}
+	}
+	meter := func(r ReaderAt, kind PartKind, entry string) ReaderAt { return r }
+	if t.Metrics != nil {
+		meter = func(r ReaderAt, kind PartKind, entry string) ReaderAt {
+			return meteredReaderAt{r: r, metrics: t.Metrics, kind: kind, entry: entry}
+		}
+	}
 
-		var buf [8]byte
-		binary.LittleEndian.PutUint64(buf[:], uint64(t.PrefixSize))
-		etagHash.Write(buf[:])
+	for _, part := range prefix {
+		ar.parts.add(limit(meter(part.data, PartPrefix, "")), part.size)
+		addETagSource(etagSource{size: part.size})
 	}
 
 	var maxTime time.Time
 
-	for _, entry := range t.Entries {
-		prepareEntry(entry)
-		dir = append(dir, &header{FileHeader: entry, offset: uint64(ar.parts.size)})
+	addRawParts := func(before int) {
+		for _, part := range t.RawParts {
+			if part.Before != before || part.Size == 0 {
+				continue
+			}
+			ar.parts.add(limit(meter(readerAt(part.Data), PartRaw, "")), part.Size)
+			addETagSource(etagSource{size: part.Size})
+		}
+	}
+
+	for i, entry := range t.Entries {
+		if err := validateEntry(entry); err != nil {
+			return nil, err
+		}
+		if err := validateName(t, entry.Name); err != nil {
+			return nil, err
+		}
+		addRawParts(i)
+		applyDefaultMode(t, entry)
+		if p, ok := entry.Content.(CRC32Provider); ok && entry.CRC32 == 0 {
+			entry.CRC32 = p.CRC32()
+		}
+		descriptors := !t.OmitDataDescriptors && !t.Zip64LocalHeaders
+		prepareEntry(entry, descriptors, extendedTimestamp(t, entry))
+		if descriptors && t.DirDataDescriptors && strings.HasSuffix(entry.Name, "/") {
+			entry.Flags |= 0x8
+		}
+		if t.Zip64LocalHeaders && !strings.HasSuffix(entry.Name, "/") && entry.ReaderVersion < zipVersion45 {
+			entry.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		}
+		entryStart := ar.parts.size
+		dir = append(dir, bufs.newHeader(entry, uint64(ar.parts.size)))
 		header, err := view(func(w io.Writer) error {
-			return writeHeader(w, entry)
+			return writeHeader(w, entry, headerOpts)
 		})
 		if err != nil {
 			return nil, err
 		}
 		ar.parts.addSizeReaderAt(header)
-		io.Copy(etagHash, io.NewSectionReader(header, 0, header.Size()))
-		if strings.HasSuffix(entry.Name, "/") {
-			if entry.Content != nil {
-				return nil, errors.New("directory entry non-nil content")
-			}
-		} else {
+		addETagSource(etagSource{data: header})
+		contentStart, contentEnd := ar.parts.size, ar.parts.size
+		if !strings.HasSuffix(entry.Name, "/") {
 			if entry.Content != nil {
-				ar.parts.add(readerAt(entry.Content), int64(entry.CompressedSize64))
-			} else if entry.CompressedSize64 != 0 {
-				return nil, errors.New("empty entry with nonzero length")
+				content := limit(entryContentReaderAt{
+					r:    meter(readerAt(entry.Content), PartEntry, entry.Name),
+					name: entry.Name,
+					size: int64(entry.CompressedSize64),
+				})
+				if entry.ContentTransform != nil {
+					content = transformReaderAt{r: content, transform: entry.ContentTransform}
+				}
+				ar.parts.add(content, int64(entry.CompressedSize64))
 			}
+			contentEnd = ar.parts.size
+		}
+		if entry.Flags&0x8 != 0 {
 			// data descriptor
-			dataDescriptor := makeDataDescriptor(entry)
-			ar.parts.addSizeReaderAt(bytes.NewReader(dataDescriptor))
-			etagHash.Write(dataDescriptor)
+			dataDescriptor := bytes.NewReader(makeDataDescriptor(entry))
+			ar.parts.addSizeReaderAt(dataDescriptor)
+			addETagSource(etagSource{data: dataDescriptor})
 		}
+		ar.entryRanges = append(ar.entryRanges, entryRange{
+			start:        entryStart,
+			end:          ar.parts.size,
+			contentStart: contentStart,
+			contentEnd:   contentEnd,
+			name:         entry.Name,
+		})
 		if entry.Modified.After(maxTime) {
 			maxTime = entry.Modified
 		}
 	}
 
+	addRawParts(len(t.Entries))
+
+	padding, err := directoryPadding(t, ar.parts.size)
+	if err != nil {
+		return nil, err
+	}
+	if padding > 0 {
+		ar.parts.add(zeroReaderAt{size: padding}, padding)
+		addETagSource(etagSource{size: padding})
+	}
+
 	// capture central directory offset and comment so that content func for central directory
 	// may be called multiple times and we don't store reference to t in the closure
 	centralDirectoryOffset := ar.parts.size
 	comment := t.Comment
+	if t.CommentWithDirectoryOffset {
+		comment += fmt.Sprintf("\x00CDOFF:%d", centralDirectoryOffset)
+		if len(comment) > uint16max {
+			return nil, errors.New("comment with directory offset too long")
+		}
+	}
+	ar.centralDirectoryOffset = centralDirectoryOffset
+	dirOpts := directoryOptions{
+		checksum:        t.DirectoryChecksum,
+		extraOrder:      t.ExtraOrder,
+		goCompat:        t.GoCompat,
+		msdosTimeUTC:    t.MSDOSTimeUTC,
+		onZip64Required: t.OnZip64Required,
+	}
 	centralDirectory, err := view(func(w io.Writer) error {
-		return writeCentralDirectory(centralDirectoryOffset, dir, w, comment, testHookCloseSizeOffset)
+		return writeCentralDirectory(centralDirectoryOffset, dir, w, comment, dirOpts, testHookCloseSizeOffset)
 	})
 	if err != nil {
 		return nil, err
 	}
 	ar.parts.addSizeReaderAt(centralDirectory)
-	io.Copy(etagHash, io.NewSectionReader(centralDirectory, 0, centralDirectory.Size()))
+	addETagSource(etagSource{data: centralDirectory})
 
 	ar.createTime = t.CreateTime
+	ar.setDownloadName(t.DownloadName)
+	ar.typeOverride = t.ContentType
+	ar.resolveContentType()
+	ar.cacheControl = t.CacheControl
+	ar.expiresAfter = t.ExpiresAfter
+	ar.header = t.Header.Clone()
+	ar.serveTimeout = t.ServeTimeout
+	ar.errorHandler = t.ErrorHandler
+	ar.authorize = t.Authorize
+	ar.requestContent = t.RequestContent
+	ar.onClientDisconnect = t.OnClientDisconnect
+	ar.hashResponses = t.HashResponses
+	ar.onRequestComplete = t.OnRequestComplete
+	ar.onRequestServed = t.OnRequestServed
+	if t.OnEntryEnter != nil || t.OnEntryLeave != nil {
+		ar.onEntryEnter = t.OnEntryEnter
+		if ar.onEntryEnter == nil {
+			ar.onEntryEnter = func(*http.Request, string) {}
+		}
+		ar.onEntryLeave = t.OnEntryLeave
+		if ar.onEntryLeave == nil {
+			ar.onEntryLeave = func(*http.Request, string, int64, bool) {}
+		}
+	}
+	ar.serveEntryDecompressed = t.ServeEntryDecompressed
+	ar.maxRanges = t.MaxRanges
+	if t.MaxConcurrentRequests > 0 {
+		ar.requests = make(chan struct{}, t.MaxConcurrentRequests)
+	}
+	ar.maxRequestRate = t.MaxRequestRate
+	ar.metrics = t.Metrics
+	ar.logger = t.Logger
+	ar.onError = t.OnError
+	if t.Logger != nil {
+		logTemplateWarnings(t.Logger, t)
+	}
+	if t.MaxArchiveRate > 0 {
+		ar.archiveLimiter = newRateLimiter(t.MaxArchiveRate)
+	}
 	if ar.createTime.IsZero() {
 		ar.createTime = maxTime
 	}
 
-	ar.etag = fmt.Sprintf("\"%s\"", hex.EncodeToString(etagHash.Sum(nil)))
+	ar.dir = dir
+	switch {
+	case t.ETag != "":
+		ar.etag = quoteETag(t.ETag)
+	case t.ETagFunc != nil:
+		ar.etagFunc = t.ETagFunc
+	case t.StableETag:
+		ar.etag = stableETag(prefix, t, comment)
+	}
+	ar.content = &ar.parts
 
 	return ar, nil
 }
 
+// applyDefaultMode sets the mode of an entry without explicit mode to the default from the template.
+func applyDefaultMode(t *Template, entry *FileHeader) {
+	if entry.ExternalAttrs != 0 {
+		return
+	}
+	if strings.HasSuffix(entry.Name, "/") {
+		if t.DefaultDirMode != 0 {
+			entry.SetMode(t.DefaultDirMode | os.ModeDir)
+		}
+	} else if t.DefaultFileMode != 0 {
+		entry.SetMode(t.DefaultFileMode)
+	}
+}
+
+// NewArchiveFromBytes creates an Archive serving already materialized archive data.
+//
+// It is a fast path for small archives that were rendered to memory in full, for example to be cached.
+// The data is served as is, it is not parsed or validated.
+//
+// The createTime is used to populate Last-Modified HTTP header. The etag is used as Etag HTTP header,
+// so it should be a quoted string; no Etag header is sent if etag is empty.
+//
+// EntryRange and CentralDirectoryOffset are not available for archives created by NewArchiveFromBytes.
+func NewArchiveFromBytes(data []byte, createTime time.Time, etag string) *Archive {
+	return &Archive{
+		content:                bytesReaderAt{r: bytes.NewReader(data)},
+		createTime:             createTime,
+		etag:                   etag,
+		handlerConfig:          handlerConfig{contentType: "application/zip"},
+		centralDirectoryOffset: -1,
+	}
+}
+
+// ETag returns the Etag header sent by ServeHTTP, a quoted string. It is empty if no Etag header is sent.
+//
+// By default, the Etag is a hash of all headers in the archive, so it is computed when it is needed for the first
+// time, not by NewArchive. The same applies to calling Template.ETagFunc.
+func (ar *Archive) ETag() string {
+	ar.etagOnce.Do(func() {
+		switch {
+		case ar.etag != "":
+		case ar.etagFunc != nil:
+			ar.etag = quoteETag(ar.etagFunc())
+		case ar.etagSources != nil:
+			ar.etag = computeETag(ar.etagSources)
+		}
+	})
+	return ar.etag
+}
+
+// LastModified returns the modification time of the archive sent in the Last-Modified header by ServeHTTP.
+// It is Template.CreateTime, or the latest modification time of the entries if CreateTime is zero.
+func (ar *Archive) LastModified() time.Time { return ar.createTime }
+
+// ContentType returns the Content-Type header sent by ServeHTTP, see Template.ContentType.
+func (ar *Archive) ContentType() string { return ar.contentType }
+
+// computeETag computes the default Etag of an archive.
+func computeETag(sources []etagSource) string {
+	h := md5.New()
+	copyBuf := make([]byte, 4096)
+	for _, src := range sources {
+		if src.data == nil {
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], uint64(src.size))
+			h.Write(buf[:])
+			continue
+		}
+		io.CopyBuffer(h, io.NewSectionReader(src.data, 0, src.data.Size()), copyBuf)
+	}
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(h.Sum(nil)))
+}
+
+// stableETag computes Etag for Template.StableETag.
+func stableETag(prefix []prefixPart, t *Template, comment string) string {
+	h := md5.New()
+	var buf [8]byte
+	writeUint64 := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf[:], v)
+		h.Write(buf[:])
+	}
+	writeString := func(s string) {
+		writeUint64(uint64(len(s)))
+		io.WriteString(h, s)
+	}
+	for _, part := range prefix {
+		writeUint64(uint64(part.size))
+	}
+	for _, part := range t.RawParts {
+		writeUint64(uint64(part.Before))
+		writeUint64(uint64(part.Size))
+	}
+	for _, entry := range t.Entries {
+		writeString(entry.Name)
+		writeUint64(uint64(entry.Method))
+		writeUint64(entry.CompressedSize64)
+		writeUint64(entry.UncompressedSize64)
+		writeUint64(uint64(entry.CRC32))
+	}
+	writeUint64(uint64(t.EOCDAlignment))
+	writeString(comment)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(h.Sum(nil)))
+}
+
 // Size returns the size of the archive in bytes.
-func (ar *Archive) Size() int64 { return ar.parts.Size() }
+func (ar *Archive) Size() int64 { return ar.content.Size() }
+
+// EntryRange returns the byte range occupied by the entry with the given index in Template.Entries.
+//
+// The range starts at the local file header of the entry and ends (exclusive) after the entry data and its data
+// descriptor, if any. This allows a handler in front of the archive to detect which entries a range request targets,
+// for example to redirect requests for large entries elsewhere.
+//
+// EntryRange panics if index is out of range.
+func (ar *Archive) EntryRange(index int) (start, end int64) {
+	r := ar.entryRanges[index]
+	return r.start, r.end
+}
+
+// CentralDirectoryOffset returns the offset of the central directory from the beginning of the archive.
+//
+// It returns -1 if the offset is unknown.
+func (ar *Archive) CentralDirectoryOffset() int64 { return ar.centralDirectoryOffset }
 
 // ReadAt provides the data of the file.
 //
@@ -179,7 +952,7 @@ func (ar *Archive) Size() int64 { return ar.parts.Size() }
 //
 // See io.ReaderAt for the interface.
 func (ar *Archive) ReadAt(p []byte, off int64) (int, error) {
-	return ar.parts.ReadAtContext(context.TODO(), p, off)
+	return ar.content.ReadAtContext(context.TODO(), p, off)
 }
 
 // ReadAtContext provides the data of the file.
@@ -189,7 +962,67 @@ func (ar *Archive) ReadAt(p []byte, off int64) (int, error) {
 // The context is passed to ReadAtContext of individual entries, if they implement it. The context is ignored if an
 // entry implements just io.ReaderAt.
 func (ar *Archive) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
-	return ar.parts.ReadAtContext(ctx, p, off)
+	return ar.content.ReadAtContext(ctx, p, off)
+}
+
+// Reader returns a reader that reads the whole archive sequentially from the beginning.
+//
+// The context is passed to ReadAtContext of individual entries, if they implement it.
+// Once the context is done, Read returns the context error.
+func (ar *Archive) Reader(ctx context.Context) io.Reader {
+	return contextReader{
+		ctx: ctx,
+		r:   io.NewSectionReader(withContext{r: ar.content, ctx: ctx}, 0, ar.content.Size()),
+	}
+}
+
+// writeToBufferSize is size of chunks in which WriteToContext copies the archive.
+const writeToBufferSize = 32 * 1024
+
+// WriteTo writes the whole archive to w.
+//
+// This is same as calling WriteToContext with context.TODO() and no progress callback.
+//
+// See io.WriterTo for the interface.
+func (ar *Archive) WriteTo(w io.Writer) (int64, error) {
+	return ar.WriteToContext(context.TODO(), w, nil)
+}
+
+// WriteToContext writes the whole archive to w.
+//
+// If progress is not nil, it is called after each chunk of data is written with the number of bytes written so far
+// and the total size of the archive.
+//
+// The context is passed to ReadAtContext of individual entries, if they implement it.
+func (ar *Archive) WriteToContext(ctx context.Context, w io.Writer, progress func(written, total int64)) (int64, error) {
+	total := ar.Size()
+	buf := make([]byte, writeToBufferSize)
+	var written int64
+	for written < total {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		chunk := buf
+		if remaining := total - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := ar.content.ReadAtContext(ctx, chunk, written)
+		if n < len(chunk) {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+		n, err = w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if progress != nil {
+			progress(written, total)
+		}
+	}
+	return written, nil
 }
 
 // ServeHTTP serves the archive over HTTP.
@@ -198,17 +1031,248 @@ func (ar *Archive) ReadAtContext(ctx context.Context, p []byte, off int64) (int,
 //
 // Content-Type and Etag headers are added automatically if they are not already present
 // in the ResponseWriter.
+//
+// See Template.ServeTimeout for limiting the duration of the response and Template.Authorize for
+// controlling access to individual entries. Use Handler to serve the archive with a different configuration.
 func (ar *Archive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ar.serveHTTP(w, r, &ar.handlerConfig)
+}
+
+// serveHTTP serves the archive with configuration cfg, see ServeHTTP.
+func (ar *Archive) serveHTTP(w http.ResponseWriter, r *http.Request, cfg *handlerConfig) {
+	cfg.addHeader(w.Header())
+	r = cfg.limitRanges(r)
+	if ar.onRequestServed != nil {
+		aw := &accountingResponseWriter{ResponseWriter: w}
+		defer func() {
+			ar.onRequestServed(r, RequestStats{
+				Status:    aw.status,
+				BytesSent: aw.written,
+				Ranges:    requestedByteRanges(r, ar.Size()),
+			})
+		}()
+		w = aw
+	}
+	if !ar.acquireRequest(w) {
+		return
+	}
+	defer ar.releaseRequest()
+
+	if ar.onRequestComplete != nil {
+		cw := &completionResponseWriter{ResponseWriter: w}
+		if ar.hashResponses != nil {
+			cw.hash = ar.hashResponses()
+		}
+		defer func() {
+			var digest []byte
+			if cw.hash != nil {
+				digest = cw.hash.Sum(nil)
+			}
+			ar.onRequestComplete(r, cw.written, digest)
+		}()
+		w = cw
+	}
+
+	content := ar.contentForRequest()
+	if cfg.logger != nil || cfg.onError != nil {
+		content = readErrorReporter{r: content, ar: ar, cfg: cfg, req: r}
+	}
+	if ar.authorize != nil {
+		auth := newEntryAuthorizer(ar)
+		if r.Method != http.MethodHead {
+			for _, rng := range requestedRanges(r, ar.Size()) {
+				if err := auth.check(r.Context(), rng.start, rng.end); err != nil {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		content = authorizingReaderAt{r: content, auth: auth}
+	}
+	if ar.metrics != nil {
+		content = &entryServeRecorder{r: content, ar: ar, served: make(map[int]bool)}
+	}
+	if ar.onEntryEnter != nil {
+		tracker := &entryVisitTracker{r: content, ar: ar, req: r, current: -1}
+		defer tracker.leave()
+		content = tracker
+	}
+	if cfg.logger != nil {
+		if header := r.Header.Get("Range"); header != "" {
+			if _, ok := parseRanges(header, ar.Size()); !ok {
+				cfg.logger.WarnContext(r.Context(), "zipserve: malformed Range header", "range", header)
+			}
+		}
+	}
+
+	if ar.onClientDisconnect != nil {
+		dw := &disconnectResponseWriter{ResponseWriter: w}
+		defer func() {
+			if dw.err != nil {
+				ar.onClientDisconnect(r, dw.written)
+			}
+		}()
+		w = dw
+	}
+	w = cfg.throttle(w, r)
+
 	_, haveType := w.Header()["Content-Type"]
 	if !haveType {
-		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Type", cfg.contentType)
+	}
+
+	cfg.addCacheHeaders(w.Header())
+
+	_, haveDisposition := w.Header()["Content-Disposition"]
+	if !haveDisposition && cfg.contentDisposition != "" {
+		w.Header().Set("Content-Disposition", cfg.contentDisposition)
 	}
 
 	_, haveEtag := w.Header()["Etag"]
-	if !haveEtag {
-		w.Header().Set("Etag", ar.etag)
+	if etag := ar.ETag(); !haveEtag && etag != "" {
+		w.Header().Set("Etag", etag)
+	}
+
+	if cfg.serveTimeout > 0 || cfg.errorHandler != nil {
+		ctx := r.Context()
+		if cfg.serveTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.serveTimeout)
+			defer cancel()
+		}
+		tw := &timeoutResponseWriter{ResponseWriter: w}
+		recorder := &recordErrorReaderAt{r: content}
+		ar.serveContent(tw, r.WithContext(ctx), recorder, cfg.name)
+		tw.finish(cfg.failure(r, recorder.err))
+		return
+	}
+
+	ar.serveContent(w, r, content, cfg.name)
+}
+
+// failure returns the function writing the response to r if serving it failed with err, or nil if the response
+// should be completed as is.
+//
+// Nothing is written for canceled requests since the client is gone. Timeouts get 503 Service Unavailable unless
+// ErrorHandler is set.
+func (c *handlerConfig) failure(r *http.Request, err error) func(w http.ResponseWriter) {
+	switch {
+	case err == nil || errors.Is(err, ErrCanceled) || r.Context().Err() != nil:
+		return nil
+	case c.errorHandler != nil:
+		return func(w http.ResponseWriter) { c.errorHandler(w, r, err) }
+	case errors.Is(err, ErrTimeout):
+		return respondTimeout
+	default:
+		return nil
+	}
+}
+
+// acquireRequest reserves a slot for serving a request.
+// If the limit of concurrent requests is reached, it responds with 503 Service Unavailable and returns false.
+func (ar *Archive) acquireRequest(w http.ResponseWriter) bool {
+	if ar.requests == nil {
+		return true
+	}
+	select {
+	case ar.requests <- struct{}{}:
+		return true
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+		return false
+	}
+}
+
+// releaseRequest frees the slot reserved by acquireRequest.
+func (ar *Archive) releaseRequest() {
+	if ar.requests != nil {
+		<-ar.requests
 	}
+}
+
+// ServeEntry serves the content of a single entry with the given index in Template.Entries,
+// without the zip structures around it.
+//
+// By default, the raw compressed data of the entry is served. If Template.ServeEntryDecompressed is set,
+// the uncompressed content is served instead; only Store and Deflate methods of entries that are not encrypted
+// can be decompressed.
+// Range requests are supported in both cases. The Etag is derived from the CRC32 of the entry.
+//
+// ServeEntry honors Template.Authorize, Template.MaxConcurrentRequests, Template.MaxRequestRate,
+// Template.MaxArchiveRate, Template.Metrics, Template.Logger and Template.OnError.
+// It panics if index is out of range.
+func (ar *Archive) ServeEntry(w http.ResponseWriter, r *http.Request, index int) {
+	cfg := &ar.handlerConfig
+	cfg.addHeader(w.Header())
+	r = cfg.limitRanges(r)
+	rng := ar.entryRanges[index]
+	entry := ar.dir[index].FileHeader
+	if !ar.acquireRequest(w) {
+		return
+	}
+	defer ar.releaseRequest()
+
+	if ar.authorize != nil {
+		if err := ar.authorize(r.Context(), rng.name); err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	w = cfg.throttle(w, r)
+	if ar.metrics != nil && r.Method != http.MethodHead {
+		ar.metrics.EntryServed(rng.name)
+	}
+
+	entryContent := ar.contentForRequest()
+	if cfg.logger != nil || cfg.onError != nil {
+		entryContent = readErrorReporter{r: entryContent, ar: ar, cfg: cfg, req: r}
+	}
+	var recorder *recordErrorReaderAt
+	if cfg.errorHandler != nil {
+		recorder = &recordErrorReaderAt{r: entryContent}
+		entryContent = recorder
+		tw := &timeoutResponseWriter{ResponseWriter: w}
+		defer func() {
+			tw.finish(cfg.failure(r, recorder.err))
+		}()
+		w = tw
+	}
+	raw := io.NewSectionReader(withContext{r: entryContent, ctx: r.Context()}, rng.contentStart,
+		rng.contentEnd-rng.contentStart)
+	var content io.ReadSeeker
+	var name, etag string
+	switch {
+	case !ar.serveEntryDecompressed:
+		content = raw
+		etag = fmt.Sprintf("\"%08x-%d-%d\"", entry.CRC32, entry.Method, entry.CompressedSize64)
+		if _, haveType := w.Header()["Content-Type"]; !haveType {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+	case entry.Encrypted:
+		http.Error(w, "cannot decompress encrypted entry", http.StatusNotImplemented)
+		return
+	case entry.Method == Store || entry.Method == Deflate:
+		content = raw
+		if entry.Method == Deflate {
+			content = &inflateReadSeeker{src: raw, size: int64(entry.UncompressedSize64)}
+		}
+		// let http.ServeContent detect the content type from the name
+		name = path.Base(entry.Name)
+		etag = fmt.Sprintf("\"%08x-%d\"", entry.CRC32, entry.UncompressedSize64)
+	default:
+		http.Error(w, "unsupported compression method", http.StatusNotImplemented)
+		return
+	}
+
+	if _, haveEtag := w.Header()["Etag"]; !haveEtag {
+		w.Header().Set("Etag", etag)
+	}
+	cfg.addCacheHeaders(w.Header())
+	http.ServeContent(w, r, name, entry.Modified, content)
+}
 
-	readseeker := io.NewSectionReader(withContext{r: &ar.parts, ctx: r.Context()}, 0, ar.parts.Size())
-	http.ServeContent(w, r, "", ar.createTime, readseeker)
+func (ar *Archive) serveContent(w http.ResponseWriter, r *http.Request, content ReaderAt, name string) {
+	readseeker := io.NewSectionReader(withContext{r: content, ctx: r.Context()}, 0, ar.content.Size())
+	http.ServeContent(w, r, name, ar.createTime, readseeker)
 }
@@ -0,0 +1,851 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestArchiveEntryRange(t *testing.T) {
+	prefix := []byte("prefix")
+	tmpl := &Template{
+		Prefix:     bytes.NewReader(prefix),
+		PrefixSize: int64(len(prefix)),
+	}
+	for _, wt := range writeTests {
+		if wt.Data == nil {
+			continue
+		}
+		tmpl.Entries = append(tmpl.Entries, testCreate(t, &wt))
+	}
+	tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: "dir/"})
+
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantStart := int64(len(prefix))
+	for i, f := range r.File {
+		start, end := ar.EntryRange(i)
+		if start != wantStart {
+			t.Errorf("%s: start %d, want %d", f.Name, start, wantStart)
+		}
+		var sig [4]byte
+		if _, err := ar.ReadAt(sig[:], start); err != nil {
+			t.Fatalf("%s: ReadAt: %v", f.Name, err)
+		}
+		if got := binary.LittleEndian.Uint32(sig[:]); got != fileHeaderSignature {
+			t.Errorf("%s: signature at start %#x, want %#x", f.Name, got, fileHeaderSignature)
+		}
+		dataOffset, err := f.DataOffset()
+		if err != nil {
+			t.Fatalf("%s: DataOffset: %v", f.Name, err)
+		}
+		wantEnd := dataOffset + int64(f.CompressedSize64)
+		if f.Flags&0x8 != 0 {
+			wantEnd += dataDescriptorLen
+		}
+		if end != wantEnd {
+			t.Errorf("%s: end %d, want %d", f.Name, end, wantEnd)
+		}
+		wantStart = end
+	}
+}
+
+func TestNewArchiveFromBytes(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ar := NewArchiveFromBytes(data, modified, `"etag"`)
+
+	if ar.Size() != int64(len(data)) {
+		t.Errorf("Size %d, want %d", ar.Size(), len(data))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=4-9")
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if got, want := rec.Body.String(), "456789"; got != want {
+		t.Errorf("body %q, want %q", got, want)
+	}
+	if got, want := rec.Header().Get("Content-Range"), "bytes 4-9/16"; got != want {
+		t.Errorf("Content-Range %q, want %q", got, want)
+	}
+	if got, want := rec.Header().Get("Etag"), `"etag"`; got != want {
+		t.Errorf("Etag %q, want %q", got, want)
+	}
+	if got, want := rec.Header().Get("Last-Modified"), modified.Format(http.TimeFormat); got != want {
+		t.Errorf("Last-Modified %q, want %q", got, want)
+	}
+	if got, want := rec.Header().Get("Content-Type"), "application/zip"; got != want {
+		t.Errorf("Content-Type %q, want %q", got, want)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+	NewArchiveFromBytes(data, time.Time{}, "").ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Body.String(); got != string(data) {
+		t.Errorf("body %q, want %q", got, data)
+	}
+	if _, ok := rec.Header()["Etag"]; ok {
+		t.Errorf("unexpected Etag header %q", rec.Header().Get("Etag"))
+	}
+}
+
+func TestArchiveCommentWithDirectoryOffset(t *testing.T) {
+	prefix := []byte("prefix")
+	tmpl := &Template{
+		Prefix:                     bytes.NewReader(prefix),
+		PrefixSize:                 int64(len(prefix)),
+		Comment:                    "hello",
+		CommentWithDirectoryOffset: true,
+		Entries: []*FileHeader{
+			testCreate(t, &writeTests[0]),
+		},
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.SplitN(r.Comment, "\x00CDOFF:", 2)
+	if len(parts) != 2 {
+		t.Fatalf("comment %q does not contain directory offset", r.Comment)
+	}
+	if parts[0] != "hello" {
+		t.Errorf("comment %q, want %q", parts[0], "hello")
+	}
+	offset, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		t.Fatalf("parsing offset: %v", err)
+	}
+	if offset != ar.CentralDirectoryOffset() {
+		t.Errorf("offset in comment %d, CentralDirectoryOffset %d", offset, ar.CentralDirectoryOffset())
+	}
+	var sig [4]byte
+	if _, err := ar.ReadAt(sig[:], offset); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(sig[:]); got != directoryHeaderSignature {
+		t.Errorf("signature at offset %#x, want %#x", got, directoryHeaderSignature)
+	}
+
+	tmpl = &Template{
+		Comment:                    strings.Repeat("a", uint16max-5),
+		CommentWithDirectoryOffset: true,
+	}
+	if _, err := NewArchive(tmpl); err == nil {
+		t.Error("expected error for too long comment, got nil")
+	}
+}
+
+func TestArchiveContentTransform(t *testing.T) {
+	plain := []byte("The quick brown fox jumps over the lazy dog.")
+	key := func(off int64) byte { return byte(off*7 + 3) }
+	xor := func(_ context.Context, p []byte, off int64) error {
+		for i := range p {
+			p[i] ^= key(off + int64(i))
+		}
+		return nil
+	}
+	encrypted := make([]byte, len(plain))
+	copy(encrypted, plain)
+	xor(context.Background(), encrypted, 0)
+
+	tmpl := &Template{
+		Entries: []*FileHeader{{
+			Name:               "file.txt",
+			Method:             Store,
+			CRC32:              crc(plain),
+			CompressedSize64:   uint64(len(plain)),
+			UncompressedSize64: uint64(len(plain)),
+			Content:            bytes.NewReader(encrypted),
+			ContentTransform:   xor,
+		}},
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataOffset, err := r.File[0].DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rng := range [][2]int{{0, len(plain)}, {0, 1}, {5, 9}, {13, 40}, {len(plain) - 1, len(plain)}} {
+		p := make([]byte, rng[1]-rng[0])
+		if _, err := ar.ReadAt(p, dataOffset+int64(rng[0])); err != nil {
+			t.Fatalf("ReadAt(%v): %v", rng, err)
+		}
+		if want := plain[rng[0]:rng[1]]; !bytes.Equal(p, want) {
+			t.Errorf("range %v: got %q, want %q", rng, p, want)
+		}
+	}
+
+	rc, err := r.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("content %q, want %q", got, plain)
+	}
+}
+
+// slowWriter is an io.Writer that sleeps before each write.
+type slowWriter struct {
+	w     io.Writer
+	delay time.Duration
+}
+
+func (s slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.w.Write(p)
+}
+
+func TestArchiveWriteToContextProgress(t *testing.T) {
+	largeData := make([]byte, 1<<17)
+	tmpl := &Template{}
+	tmpl.Entries = append(tmpl.Entries, testCreate(t, &WriteTest{Name: "large", Data: largeData, Method: Store}))
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	var last int64
+	calls := 0
+	progress := func(written, total int64) {
+		calls++
+		if total != ar.Size() {
+			t.Errorf("total %d, want %d", total, ar.Size())
+		}
+		if written <= last {
+			t.Errorf("progress %d not increasing from %d", written, last)
+		}
+		last = written
+	}
+	n, err := ar.WriteToContext(context.Background(), slowWriter{w: &buf, delay: time.Millisecond}, progress)
+	if err != nil {
+		t.Fatalf("WriteToContext: %v", err)
+	}
+	if n != ar.Size() || last != ar.Size() {
+		t.Errorf("written %d, last progress %d, want %d", n, last, ar.Size())
+	}
+	if calls < 2 {
+		t.Errorf("progress called %d times, want multiple", calls)
+	}
+
+	want, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Error("written data differ from archive data")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ar.WriteToContext(ctx, ioutil.Discard, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestArchiveReader(t *testing.T) {
+	tmpl := &Template{}
+	tmpl.Entries = append(tmpl.Entries, testCreate(t, &WriteTest{Name: "large", Data: make([]byte, 1<<17), Method: Store}))
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(ar.Reader(context.Background()))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	want := make([]byte, ar.Size())
+	if _, err := ar.ReadAt(want, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data read from Reader differ from archive data")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := ar.Reader(ctx)
+	p := make([]byte, 1024)
+	if _, err := io.ReadFull(r, p); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	cancel()
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestArchiveRawParts(t *testing.T) {
+	garbage := []byte("garbage between entries")
+	template := func() *Template {
+		tmpl := &Template{
+			RawParts: []RawPart{
+				{Before: 1, Data: bytes.NewReader(garbage), Size: int64(len(garbage))},
+				{Before: 1, Data: bytes.NewReader(garbage[:7]), Size: 7},
+				{Before: 2, Data: bytes.NewReader(garbage), Size: int64(len(garbage))},
+			},
+		}
+		for _, wt := range writeTests[2:4] {
+			tmpl.Entries = append(tmpl.Entries, testCreate(t, &wt))
+		}
+		return tmpl
+	}
+
+	ar, err := NewArchive(template())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, wt := range writeTests[2:4] {
+		testReadFile(t, r.File[i], &wt)
+	}
+
+	_, firstEnd := ar.EntryRange(0)
+	secondStart, secondEnd := ar.EntryRange(1)
+	if gap := secondStart - firstEnd; gap != int64(len(garbage))+7 {
+		t.Errorf("gap between entries %d, want %d", gap, len(garbage)+7)
+	}
+	p := make([]byte, len(garbage)+7)
+	if _, err := ar.ReadAt(p, firstEnd); err != nil {
+		t.Fatal(err)
+	}
+	if want := string(garbage) + string(garbage[:7]); string(p) != want {
+		t.Errorf("gap data %q, want %q", p, want)
+	}
+	if gap := ar.CentralDirectoryOffset() - secondEnd; gap != int64(len(garbage)) {
+		t.Errorf("gap before central directory %d, want %d", gap, len(garbage))
+	}
+
+	breakdown, err := CalculateSize(template())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breakdown.Total() != ar.Size() {
+		t.Errorf("CalculateSize %d, want %d", breakdown.Total(), ar.Size())
+	}
+
+	tmpl := template()
+	tmpl.RawParts = append(tmpl.RawParts, RawPart{Before: 3})
+	if _, err := NewArchive(tmpl); err == nil {
+		t.Error("expected error for raw part out of range, got nil")
+	}
+}
+
+func TestArchiveStableETag(t *testing.T) {
+	build := func(stable bool, modified time.Time, data string) *Archive {
+		h := testCreate(t, &WriteTest{Name: "file.txt", Data: []byte(data), Method: Store})
+		h.Modified = modified
+		ar, err := NewArchive(&Template{Entries: []*FileHeader{h}, StableETag: stable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ar
+	}
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	if build(false, t1, "data").ETag() == build(false, t2, "data").ETag() {
+		t.Error("default etags equal for different modification times")
+	}
+	if a, b := build(true, t1, "data").ETag(), build(true, t2, "data").ETag(); a != b {
+		t.Errorf("stable etags %s and %s differ for different modification times", a, b)
+	}
+	if build(true, t1, "data").ETag() == build(true, t1, "tada").ETag() {
+		t.Error("stable etags equal for different content")
+	}
+}
+
+func TestArchiveCustomETag(t *testing.T) {
+	h := testCreate(t, &WriteTest{Name: "file.txt", Data: []byte("data"), Method: Store})
+	for _, test := range []struct{ etag, want string }{
+		{etag: `"v42"`, want: `"v42"`},
+		{etag: `W/"v42"`, want: `W/"v42"`},
+		{etag: "v42", want: `"v42"`},
+	} {
+		ar, err := NewArchive(&Template{Entries: []*FileHeader{h}, ETag: test.etag})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		ar.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+		if got := rec.Header().Get("Etag"); got != test.want {
+			t.Errorf("ETag %s: Etag header %s, want %s", test.etag, got, test.want)
+		}
+	}
+
+	calls := 0
+	ar, err := NewArchive(&Template{Entries: []*FileHeader{h}, ETagFunc: func() string {
+		calls++
+		return "sha256-abc"
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Errorf("ETagFunc called %d times by NewArchive", calls)
+	}
+	for i := 0; i < 2; i++ {
+		if got, want := ar.ETag(), `"sha256-abc"`; got != want {
+			t.Errorf("ETag %s, want %s", got, want)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("ETagFunc called %d times, want 1", calls)
+	}
+
+	ar, err = NewArchive(&Template{Entries: []*FileHeader{h}, ETagFunc: func() string { return "" }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+	if _, ok := rec.Header()["Etag"]; ok {
+		t.Errorf("unexpected Etag header %q", rec.Header().Get("Etag"))
+	}
+
+	if _, err := NewArchive(&Template{Entries: []*FileHeader{h}, ETag: "v1", StableETag: true}); err == nil {
+		t.Error("expected error for ETag combined with StableETag, got nil")
+	}
+}
+
+func TestArchiveDisableETag(t *testing.T) {
+	template := func() *Template {
+		h := testCreate(t, &WriteTest{Name: "file.txt", Data: []byte("data"), Method: Store})
+		h.Modified = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		return &Template{Entries: []*FileHeader{h}}
+	}
+	tmpl := template()
+	tmpl.DisableETag = true
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.etagSources != nil {
+		t.Errorf("%d etag sources kept with DisableETag", len(ar.etagSources))
+	}
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+	if _, ok := rec.Header()["Etag"]; ok {
+		t.Errorf("unexpected Etag header %q", rec.Header().Get("Etag"))
+	}
+	if rec.Header().Get("Last-Modified") == "" {
+		t.Error("missing Last-Modified header")
+	}
+
+	tmpl = template()
+	tmpl.ETag = "v1"
+	ar, err = NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.etagSources != nil {
+		t.Errorf("%d etag sources kept with a custom ETag", len(ar.etagSources))
+	}
+
+	ar, err = NewArchive(template())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ar.ETag()
+	var pool ArchivePool
+	for _, disable := range []bool{false, true, false} {
+		tmpl := template()
+		tmpl.DisableETag = disable
+		ar, err := pool.Get(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ar.ETag(); (got == "") != disable || (!disable && got != want) {
+			t.Errorf("pooled archive with DisableETag %v: etag %q, want %q", disable, got, want)
+		}
+		pool.Put(ar)
+	}
+}
+
+func TestArchiveMetadataAccessors(t *testing.T) {
+	h := testCreate(t, &WriteTest{Name: "file.txt", Data: []byte("data"), Method: Store})
+	h.Modified = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ar, err := NewArchive(&Template{Entries: []*FileHeader{h}, ContentType: "application/epub+zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBytes := NewArchiveFromBytes([]byte("PK\x05\x06"), h.Modified, `"bytes"`)
+	for name, ar := range map[string]*Archive{"NewArchive": ar, "NewArchiveFromBytes": fromBytes} {
+		rec := httptest.NewRecorder()
+		ar.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+		hdr := rec.Header()
+		if got := ar.ETag(); got != hdr.Get("Etag") {
+			t.Errorf("%s: ETag %q, header %q", name, got, hdr.Get("Etag"))
+		}
+		if got := ar.LastModified(); !got.Equal(h.Modified) || got.UTC().Format(http.TimeFormat) != hdr.Get("Last-Modified") {
+			t.Errorf("%s: LastModified %v, header %q", name, got, hdr.Get("Last-Modified"))
+		}
+		if got := ar.ContentType(); got != hdr.Get("Content-Type") {
+			t.Errorf("%s: ContentType %q, header %q", name, got, hdr.Get("Content-Type"))
+		}
+		if got := strconv.FormatInt(ar.Size(), 10); got != hdr.Get("Content-Length") {
+			t.Errorf("%s: Size %s, Content-Length %q", name, got, hdr.Get("Content-Length"))
+		}
+	}
+}
+
+func TestArchiveEOCDAlignment(t *testing.T) {
+	for _, alignment := range []int64{0, 1, 512, 4096} {
+		t.Run(strconv.FormatInt(alignment, 10), func(t *testing.T) {
+			tmpl := &Template{EOCDAlignment: alignment}
+			for i := range writeTests {
+				tmpl.Entries = append(tmpl.Entries, testCreate(t, &writeTests[i]))
+			}
+			ar, err := NewArchive(tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset := ar.CentralDirectoryOffset()
+			if alignment > 0 && offset%alignment != 0 {
+				t.Errorf("central directory offset %d is not a multiple of %d", offset, alignment)
+			}
+			var sig [4]byte
+			if _, err := ar.ReadAt(sig[:], offset); err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.LittleEndian.Uint32(sig[:]); got != directoryHeaderSignature {
+				t.Errorf("signature at offset %#x, want %#x", got, directoryHeaderSignature)
+			}
+			r, err := zip.NewReader(ar, ar.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.File) != len(writeTests) {
+				t.Fatalf("got %d files, want %d", len(r.File), len(writeTests))
+			}
+			for i, wt := range writeTests {
+				testReadFile(t, r.File[i], &wt)
+			}
+		})
+	}
+
+	if _, err := NewArchive(&Template{EOCDAlignment: -1}); err == nil {
+		t.Error("expected error for negative alignment, got nil")
+	}
+}
+
+func TestArchiveMaxConcurrentFetches(t *testing.T) {
+	gated := gatedReaderAt{entered: make(chan struct{}), once: new(sync.Once), gate: make(chan struct{})}
+	tmpl := &Template{
+		MaxConcurrentFetches: 1,
+		Entries: []*FileHeader{
+			{Name: "gated.txt", CompressedSize64: 10, UncompressedSize64: 10, Content: gated},
+			{Name: "other.txt", CompressedSize64: 5, UncompressedSize64: 5, Content: bytes.NewReader([]byte("other"))},
+		},
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatedStart, _ := ar.EntryRange(0)
+	otherStart, otherEnd := ar.EntryRange(1)
+
+	done := make(chan error)
+	go func() {
+		_, err := ar.ReadAt(make([]byte, 100), gatedStart)
+		done <- err
+	}()
+	<-gated.entered
+
+	// headers and the central directory are in memory and don't need a fetch token
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dirSize := ar.Size() - ar.CentralDirectoryOffset()
+	if _, err := ar.ReadAtContext(ctx, make([]byte, dirSize), ar.CentralDirectoryOffset()); err != nil {
+		t.Errorf("reading central directory: %v", err)
+	}
+	if _, err := ar.ReadAtContext(ctx, make([]byte, fileHeaderLen), otherStart); err != nil {
+		t.Errorf("reading local header: %v", err)
+	}
+
+	// content waits for the token
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+	_, err = ar.ReadAtContext(shortCtx, make([]byte, otherEnd-otherStart), otherStart)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("reading content over the limit: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(gated.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("reading gated content: %v", err)
+	}
+	if _, err := ar.ReadAtContext(ctx, make([]byte, otherEnd-otherStart), otherStart); err != nil {
+		t.Errorf("reading content after the limit was released: %v", err)
+	}
+}
+
+func TestArchiveTruncatedContent(t *testing.T) {
+	ar, err := NewArchive(&Template{
+		Entries: []*FileHeader{
+			{
+				Name:               "truncated.txt",
+				CRC32:              crc([]byte("0123456789")),
+				CompressedSize64:   10,
+				UncompressedSize64: 10,
+				Content:            bytes.NewReader([]byte("01234")),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	var partErr *PartReadError
+	if !errors.As(err, &partErr) {
+		t.Fatalf("got error %v, want PartReadError", err)
+	}
+	if partErr.Entry != "truncated.txt" || partErr.Offset != 5 {
+		t.Errorf("error for entry %q at offset %d, want %q at offset 5", partErr.Entry, partErr.Offset, "truncated.txt")
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("error %v does not wrap io.ErrUnexpectedEOF", err)
+	}
+
+	// reads within the available data succeed
+	start, _ := ar.EntryRange(0)
+	buf := make([]byte, fileHeaderLen+len("truncated.txt")+extTimeExtraLen+5)
+	if _, err := ar.ReadAt(buf, start); err != nil {
+		t.Errorf("reading available data: %v", err)
+	}
+}
+
+func TestArchiveDefaultModes(t *testing.T) {
+	explicit := &FileHeader{Name: "explicit.txt"}
+	explicit.SetMode(0600)
+	explicitDir := &FileHeader{Name: "explicit/"}
+	explicitDir.SetMode(os.ModeDir | 0700)
+
+	tests := []struct {
+		name      string
+		dirMode   os.FileMode
+		fileMode  os.FileMode
+		wantModes []os.FileMode
+	}{
+		{
+			name:      "no defaults",
+			wantModes: []os.FileMode{os.ModeDir | 0666, 0666, 0600, os.ModeDir | 0700},
+		},
+		{
+			name:      "defaults",
+			dirMode:   0755,
+			fileMode:  0644,
+			wantModes: []os.FileMode{os.ModeDir | 0755, 0644, 0600, os.ModeDir | 0700},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			explicitCopy, explicitDirCopy := *explicit, *explicitDir
+			ar, err := NewArchive(&Template{
+				DefaultDirMode:  test.dirMode,
+				DefaultFileMode: test.fileMode,
+				Entries: []*FileHeader{
+					{Name: "dir/"},
+					{Name: "dir/file.txt"},
+					&explicitCopy,
+					&explicitDirCopy,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := zip.NewReader(ar, ar.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range test.wantModes {
+				if got := r.File[i].Mode(); got != want {
+					t.Errorf("%s: mode %v, want %v", r.File[i].Name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestArchivePrefixBoundary(t *testing.T) {
+	prefix := []byte("#!/bin/sh\necho self-extracting archive\nexit 0\n")
+	data := []byte("first entry data")
+	tmpl := &Template{
+		Prefix:     bytes.NewReader(prefix),
+		PrefixSize: int64(len(prefix)),
+		Entries: []*FileHeader{{
+			Name:               "first.txt",
+			CRC32:              crc(data),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(data)),
+			Content:            bytes.NewReader(data),
+		}},
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(all[:len(prefix)], prefix) {
+		t.Fatal("archive does not start with the prefix")
+	}
+	if start, _ := ar.EntryRange(0); start != int64(len(prefix)) {
+		t.Fatalf("first entry starts at %d, want %d", start, len(prefix))
+	}
+	if sig := binary.LittleEndian.Uint32(all[len(prefix):]); sig != fileHeaderSignature {
+		t.Fatalf("signature after prefix %#x, want %#x", sig, fileHeaderSignature)
+	}
+
+	for _, rng := range [][2]int{
+		{len(prefix) - 1, len(prefix) + 1},
+		{len(prefix) - 10, len(prefix) + 4},
+		{0, len(prefix) + fileHeaderLen},
+		{len(prefix) - 1, len(all)},
+	} {
+		p := make([]byte, rng[1]-rng[0])
+		if _, err := ar.ReadAtContext(context.Background(), p, int64(rng[0])); err != nil {
+			t.Fatalf("ReadAtContext %v: %v", rng, err)
+		}
+		if !bytes.Equal(p, all[rng[0]:rng[1]]) {
+			t.Errorf("ReadAtContext %v: got %q, want %q", rng, p, all[rng[0]:rng[1]])
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rng[0], rng[1]-1))
+		rec := httptest.NewRecorder()
+		ar.ServeHTTP(rec, req)
+		if rec.Code != http.StatusPartialContent {
+			t.Fatalf("range %v: status %d, want %d", rng, rec.Code, http.StatusPartialContent)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), all[rng[0]:rng[1]]) {
+			t.Errorf("range %v: got %q, want %q", rng, rec.Body.Bytes(), all[rng[0]:rng[1]])
+		}
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(all), int64(len(all)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := r.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if got, err := ioutil.ReadAll(rc); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("entry content %q, %v, want %q", got, err, data)
+	}
+}
+
+func TestArchiveLazyETag(t *testing.T) {
+	template := func() *Template {
+		data := []byte("lazy etag content")
+		modified := time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)
+		return &Template{
+			Prefix:        strings.NewReader("prefix"),
+			PrefixSize:    6,
+			RawParts:      []RawPart{{Before: 1, Data: strings.NewReader("raw"), Size: 3}},
+			EOCDAlignment: 512,
+			Comment:       "comment",
+			Entries: []*FileHeader{
+				{
+					Name:               "file.txt",
+					Modified:           modified,
+					CRC32:              crc(data),
+					CompressedSize64:   uint64(len(data)),
+					UncompressedSize64: uint64(len(data)),
+					Content:            bytes.NewReader(data),
+				},
+				{Name: "dir/", Modified: modified},
+			},
+		}
+	}
+	// computed by NewArchive before the etag was computed lazily
+	const want = `"e1f2aa09b9d22218521273d90cb1f723"`
+
+	ar, err := NewArchive(template())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.etag != "" {
+		t.Errorf("etag %s computed by NewArchive", ar.etag)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			ar.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+			if got := rec.Header().Get("Etag"); got != want {
+				t.Errorf("Etag header %s, want %s", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := ar.ETag(); got != want {
+		t.Errorf("ETag %s, want %s", got, want)
+	}
+
+	var pool ArchivePool
+	pooled, err := pool.Get(template())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pooled.ETag(); got != want {
+		t.Errorf("pooled ETag %s, want %s", got, want)
+	}
+	pool.Put(pooled)
+
+	if got := NewArchiveFromBytes([]byte("data"), time.Time{}, "").ETag(); got != "" {
+		t.Errorf("ETag of archive from bytes %s, want empty", got)
+	}
+}
@@ -0,0 +1,266 @@
+// Package azblob reads content of zipserve archive entries directly from Azure Blob Storage.
+//
+// Blobs are read using Get Blob requests with ranges, so archives can be assembled from blobs without buffering
+// their content. Requests are authorized with a shared access signature (SAS) or the account key (Shared Key).
+// The package only depends on the standard library.
+package azblob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPartSize is the maximum number of bytes fetched by a single request if Client.PartSize is zero.
+const DefaultPartSize = 8 << 20
+
+// apiVersion is the version of the Blob service REST API used.
+const apiVersion = "2020-10-02"
+
+// maxDrain is the maximum number of unread bytes of a response body read before closing it, so that
+// the connection can be reused.
+const maxDrain = 64 << 10
+
+// Client reads blobs of a storage account.
+//
+// A Client is safe for concurrent use. Connections are reused across requests as long as HTTPClient's transport
+// keeps them alive, which is the case for http.DefaultTransport.
+type Client struct {
+	// HTTPClient is used to send the requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// AccountName is the name of the storage account.
+	AccountName string
+
+	// Endpoint is the base URL of the Blob service. If empty, "https://<AccountName>.blob.core.windows.net" is used.
+	Endpoint string
+
+	// AccountKey is the base64 encoded key of the storage account used to sign requests with Shared Key
+	// authorization. It is not used if SAS is set.
+	AccountKey string
+
+	// SAS is a shared access signature, the query string of a SAS URL without the leading question mark.
+	// If both SAS and AccountKey are empty, requests are anonymous, which is enough for public containers.
+	SAS string
+
+	// PartSize is the maximum number of bytes fetched by a single request. Larger reads are split into
+	// multiple requests. Zero means DefaultPartSize.
+	PartSize int64
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// Blob is the content of a blob.
+//
+// It implements the ReaderAt interface of zipserve, so it can be used as FileHeader.Content.
+type Blob struct {
+	client *Client
+	url    *url.URL
+	size   int64
+	etag   string
+}
+
+// Open returns the blob with the given name in container.
+//
+// It requests the blob properties to determine its size. Reads of the blob are conditional on its ETag,
+// so they fail if the blob is modified.
+func (c *Client) Open(ctx context.Context, container, name string) (*Blob, error) {
+	u, err := c.blobURL(container, name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HEAD %s: unexpected status %s", u.Path, resp.Status)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("HEAD %s: invalid Content-Length: %w", u.Path, err)
+	}
+	return &Blob{client: c, url: u, size: size, etag: resp.Header.Get("Etag")}, nil
+}
+
+// blobURL returns the URL of the blob, without SAS.
+func (c *Client) blobURL(container, name string) (*url.URL, error) {
+	if container == "" {
+		return nil, errors.New("empty container name")
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + c.AccountName + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + container + "/" + name
+	return u, nil
+}
+
+// do sends a request for the blob at u with additional headers.
+func (c *Client) do(ctx context.Context, method string, u *url.URL, header http.Header) (*http.Response, error) {
+	reqURL := *u
+	if c.SAS != "" {
+		reqURL.RawQuery = c.SAS
+	}
+	req, err := http.NewRequest(method, reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	req.Header.Set("X-Ms-Date", now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", apiVersion)
+	if c.SAS == "" && c.AccountKey != "" {
+		if err := signSharedKey(req, c.AccountName, c.AccountKey); err != nil {
+			return nil, err
+		}
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+// signSharedKey adds Shared Key authorization to a request without a body.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key.
+func signSharedKey(req *http.Request, account, accountKey string) error {
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return fmt.Errorf("invalid account key: %w", err)
+	}
+	var msHeaders []string
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name)
+		}
+	}
+	sort.Strings(msHeaders)
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	for _, name := range []string{"Content-Encoding", "Content-Language", "Content-Length", "Content-Md5",
+		"Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		b.WriteString(req.Header.Get(name) + "\n")
+	}
+	for _, name := range msHeaders {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	b.WriteString("/" + account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(b.String()))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
+// Size returns the size of the blob in bytes.
+func (b *Blob) Size() int64 { return b.size }
+
+// ReadAt reads data of the blob.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (b *Blob) ReadAt(p []byte, off int64) (n int, err error) {
+	return b.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data of the blob using one or more range requests.
+//
+// This methods implements ReaderAt interface of zipserve.
+func (b *Blob) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	eof := false
+	if max := b.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = true
+	}
+	partSize := b.client.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	for len(p) > 0 {
+		part := p
+		if int64(len(part)) > partSize {
+			part = part[:partSize]
+		}
+		n2, err := b.readPart(ctx, part, off)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+		p = p[n2:]
+		off += int64(n2)
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readPart reads len(p) bytes at off using a single request.
+func (b *Blob) readPart(ctx context.Context, p []byte, off int64) (int, error) {
+	header := http.Header{}
+	header.Set("X-Ms-Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	if b.etag != "" {
+		header.Set("If-Match", b.etag)
+	}
+	resp, err := b.client.do(ctx, http.MethodGet, b.url, header)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// drain the rest of a short body so that the connection can be reused
+		io.CopyN(ioutil.Discard, resp.Body, maxDrain)
+		resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusPreconditionFailed:
+		return 0, fmt.Errorf("GET %s: blob changed", b.url.Path)
+	default:
+		return 0, fmt.Errorf("GET %s: unexpected status %s", b.url.Path, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err != nil {
+		return n, fmt.Errorf("GET %s: %w", b.url.Path, err)
+	}
+	return n, nil
+}
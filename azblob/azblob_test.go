@@ -0,0 +1,217 @@
+package azblob
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martin-sucha/zipserve"
+)
+
+var testKey = base64.StdEncoding.EncodeToString([]byte("account key"))
+
+// fakeService serves blobs like Azure Blob Storage.
+type fakeService struct {
+	blobs map[string][]byte
+	sas   string
+
+	mu     sync.Mutex
+	ranges []string
+	etag   string
+}
+
+func (f *fakeService) authorized(r *http.Request) bool {
+	if f.sas != "" {
+		return r.URL.RawQuery == f.sas && r.Header.Get("Authorization") == ""
+	}
+	got := r.Header.Get("Authorization")
+	if !strings.HasPrefix(got, "SharedKey account:") {
+		return false
+	}
+	clone := r.Clone(r.Context())
+	if err := signSharedKey(clone, "account", testKey); err != nil {
+		return false
+	}
+	return clone.Header.Get("Authorization") == got
+}
+
+func (f *fakeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) || r.Header.Get("X-Ms-Version") != apiVersion {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	data, ok := f.blobs[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	etag := f.etag
+	rng := r.Header.Get("X-Ms-Range")
+	if rng != "" {
+		f.ranges = append(f.ranges, rng)
+	}
+	f.mu.Unlock()
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("Etag", etag)
+	r.Header.Set("Range", rng)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func TestBlob(t *testing.T) {
+	first := bytes.Repeat([]byte("0123456789"), 25)
+	second := []byte("small blob")
+	for _, sas := range []string{"", "sv=2020-10-02&sig=abc"} {
+		t.Run(fmt.Sprintf("sas=%q", sas), func(t *testing.T) {
+			service := &fakeService{
+				blobs: map[string][]byte{
+					"/container/dir/first.txt": first,
+					"/container/second.txt":    second,
+				},
+				sas:  sas,
+				etag: `"0x1"`,
+			}
+			srv := httptest.NewServer(service)
+			defer srv.Close()
+			client := &Client{
+				AccountName: "account",
+				Endpoint:    srv.URL,
+				AccountKey:  testKey,
+				SAS:         sas,
+				PartSize:    100,
+			}
+
+			ctx := context.Background()
+			tmpl := &zipserve.Template{}
+			for _, name := range []string{"dir/first.txt", "second.txt"} {
+				blob, err := client.Open(ctx, "container", name)
+				if err != nil {
+					t.Fatalf("Open %s: %v", name, err)
+				}
+				data := service.blobs["/container/"+name]
+				if blob.Size() != int64(len(data)) {
+					t.Errorf("%s: size %d, want %d", name, blob.Size(), len(data))
+				}
+				tmpl.Entries = append(tmpl.Entries, &zipserve.FileHeader{
+					Name:               name,
+					CRC32:              crc32.ChecksumIEEE(data),
+					CompressedSize64:   uint64(blob.Size()),
+					UncompressedSize64: uint64(blob.Size()),
+					Content:            blob,
+				})
+			}
+			ar, err := zipserve.NewArchive(tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := zip.NewReader(ar, ar.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range r.File {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatalf("%s: %v", f.Name, err)
+				}
+				if want := service.blobs["/container/"+f.Name]; !bytes.Equal(got, want) {
+					t.Errorf("%s: got %q, want %q", f.Name, got, want)
+				}
+			}
+			service.mu.Lock()
+			ranges := service.ranges
+			service.mu.Unlock()
+			for _, rng := range ranges {
+				var start, end int
+				if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+					t.Fatalf("range %q: %v", rng, err)
+				}
+				if end-start+1 > 100 {
+					t.Errorf("range %q larger than part size", rng)
+				}
+			}
+
+			blob, err := client.Open(ctx, "container", "second.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := make([]byte, 100)
+			n, err := blob.ReadAt(p, 6)
+			if n != len(second)-6 || err != io.EOF || !bytes.Equal(p[:n], second[6:]) {
+				t.Errorf("reading over the end: %q, %v", p[:n], err)
+			}
+			service.mu.Lock()
+			service.etag = `"0x2"`
+			service.mu.Unlock()
+			if _, err := blob.ReadAt(p[:1], 0); err == nil || !strings.Contains(err.Error(), "changed") {
+				t.Errorf("reading changed blob: %v, want an error", err)
+			}
+			if _, err := client.Open(ctx, "container", "missing"); err == nil {
+				t.Error("expected an error for missing blob, got nil")
+			}
+		})
+	}
+}
+
+func TestBlobURL(t *testing.T) {
+	c := &Client{AccountName: "account"}
+	u, err := c.blobURL("container", "dir/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := u.String(), "https://account.blob.core.windows.net/container/dir/a%20b.txt"; got != want {
+		t.Errorf("URL %s, want %s", got, want)
+	}
+	if _, err := c.blobURL("", "name"); err == nil {
+		t.Error("expected an error for empty container, got nil")
+	}
+}
+
+func TestSignSharedKey(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://account.blob.core.windows.net/container/blob?comp=metadata", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Ms-Date", "Fri, 26 Jun 2015 23:39:12 GMT")
+	req.Header.Set("X-Ms-Version", "2015-02-21")
+	if err := signSharedKey(req, "account", testKey); err != nil {
+		t.Fatal(err)
+	}
+	stringToSign := "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+		"x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\nx-ms-version:2015-02-21\n" +
+		"/account/container/blob\ncomp:metadata"
+	key, _ := base64.StdEncoding.DecodeString(testKey)
+	want := "SharedKey account:" + base64.StdEncoding.EncodeToString(hmacSHA256(key, stringToSign))
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization %q, want %q", got, want)
+	}
+	if err := signSharedKey(req, "account", "not base64!"); err == nil {
+		t.Error("expected an error for invalid key, got nil")
+	}
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,92 @@
+package zipserve
+
+import (
+	"context"
+	"io"
+)
+
+// BufferedReaderAt serves small sequential reads from a buffer filled by larger reads of an upstream reader.
+//
+// It keeps a single buffer aligned to its size. A read that misses the buffer refills it with the aligned block
+// containing the read offset, reads larger than the buffer go to the upstream reader directly. This suits backends
+// where each read is expensive, like object stores, and readers that consume data in small chunks. Unlike
+// CachingReaderAt, it doesn't help random access.
+//
+// BufferedReaderAt is not safe for concurrent use, it is meant to be scoped to a single request. Use
+// Template.RequestContent to create one for each request served by an Archive. The upstream data must not change.
+type BufferedReaderAt struct {
+	r   ReaderAt
+	buf []byte
+	// start is the offset of buf in the upstream data, -1 if buf is not valid.
+	start int64
+	// eof is set if buf ends at the end of the upstream data.
+	eof bool
+}
+
+// NewBufferedReaderAt creates a new BufferedReaderAt reading from r in blocks of bufSize bytes.
+//
+// r may implement ReaderAt interface from this package, in that case r's ReadAtContext method will be called
+// instead of ReadAt.
+func NewBufferedReaderAt(r io.ReaderAt, bufSize int) *BufferedReaderAt {
+	if bufSize <= 0 {
+		bufSize = cacheBlockSize
+	}
+	return &BufferedReaderAt{
+		r:     readerAt(r),
+		buf:   make([]byte, 0, bufSize),
+		start: -1,
+	}
+}
+
+// ReadAt reads data through the buffer.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (b *BufferedReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return b.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data through the buffer.
+//
+// This methods implements ReaderAt interface.
+func (b *BufferedReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	for len(p) > 0 {
+		if b.start < 0 || off < b.start || off >= b.start+int64(len(b.buf)) {
+			if b.start >= 0 && b.eof && off >= b.start+int64(len(b.buf)) {
+				return n, io.EOF
+			}
+			if len(p) >= cap(b.buf) {
+				n2, err := b.r.ReadAtContext(ctx, p, off)
+				return n + n2, err
+			}
+			if err := b.fill(ctx, off); err != nil {
+				return n, err
+			}
+			continue
+		}
+		n2 := copy(p, b.buf[off-b.start:])
+		n += n2
+		off += int64(n2)
+		p = p[n2:]
+	}
+	return n, nil
+}
+
+// fill reads the aligned block containing off into the buffer.
+func (b *BufferedReaderAt) fill(ctx context.Context, off int64) error {
+	size := int64(cap(b.buf))
+	start := off - off%size
+	n, err := b.r.ReadAtContext(ctx, b.buf[:size], start)
+	if err != nil && err != io.EOF {
+		b.start = -1
+		return err
+	}
+	b.buf = b.buf[:n]
+	b.start = start
+	b.eof = n < int(size)
+	if off >= start+int64(n) {
+		return io.EOF
+	}
+	return nil
+}
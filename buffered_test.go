@@ -0,0 +1,133 @@
+package zipserve
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// countingReaderAt records the sizes of reads from the underlying reader.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads []int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads = append(c.reads, len(p))
+	return c.r.ReadAt(p, off)
+}
+
+func TestBufferedReaderAtSequential(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	upstream := &countingReaderAt{r: bytes.NewReader(data)}
+	b := NewBufferedReaderAt(upstream, 4096)
+
+	var got []byte
+	p := make([]byte, 100)
+	var off int64
+	for {
+		n, err := b.ReadAt(p, off)
+		got = append(got, p[:n]...)
+		off += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+	// 101 small reads are served by 3 upstream reads of the whole buffer
+	if len(upstream.reads) != 3 {
+		t.Errorf("upstream reads %v, want 3 reads", upstream.reads)
+	}
+	for _, size := range upstream.reads {
+		if size != 4096 {
+			t.Errorf("upstream read of %d bytes, want 4096", size)
+		}
+	}
+}
+
+func TestBufferedReaderAtRandom(t *testing.T) {
+	data := make([]byte, 10000)
+	rnd := rand.New(rand.NewSource(2))
+	rnd.Read(data)
+	upstream := &countingReaderAt{r: bytes.NewReader(data)}
+	b := NewBufferedReaderAt(upstream, 1000)
+
+	for i := 0; i < 1000; i++ {
+		off := rnd.Int63n(int64(len(data)) + 10)
+		p := make([]byte, rnd.Intn(3000))
+		n, err := b.ReadAt(p, off)
+		want := int64(len(p))
+		if off+want > int64(len(data)) {
+			want = int64(len(data)) - off
+			if want < 0 {
+				want = 0
+			}
+		}
+		if int64(n) != want {
+			t.Fatalf("ReadAt(%d bytes, %d): read %d bytes, want %d", len(p), off, n, want)
+		}
+		if want < int64(len(p)) && err != io.EOF {
+			t.Fatalf("ReadAt(%d bytes, %d): error %v, want EOF", len(p), off, err)
+		}
+		if want == int64(len(p)) && err != nil && err != io.EOF {
+			t.Fatalf("ReadAt(%d bytes, %d): %v", len(p), off, err)
+		}
+		if !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+			t.Fatalf("ReadAt(%d bytes, %d): data mismatch", len(p), off)
+		}
+	}
+}
+
+func TestArchiveRequestContent(t *testing.T) {
+	tmpl := metricsTestTemplate(nil, nil)
+	var mu sync.Mutex
+	var created int
+	tmpl.RequestContent = func(content io.ReaderAt) io.ReaderAt {
+		mu.Lock()
+		created++
+		mu.Unlock()
+		return NewBufferedReaderAt(content, 512)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 8
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if !bytes.Equal(rec.Body.Bytes(), want) {
+				t.Error("response body does not match the archive")
+			}
+		}()
+	}
+	wg.Wait()
+	rec := httptest.NewRecorder()
+	ar.ServeEntry(rec, httptest.NewRequest(http.MethodGet, "/", nil), 1)
+	if rec.Body.Len() != 2000 {
+		t.Errorf("ServeEntry: %d bytes, want 2000", rec.Body.Len())
+	}
+	if created != requests+1 {
+		t.Errorf("RequestContent called %d times, want %d", created, requests+1)
+	}
+}
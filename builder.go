@@ -0,0 +1,73 @@
+package zipserve
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Builder creates an Archive incrementally, validating each entry as it is added.
+//
+// The zero value is ready to use and creates an archive with default options.
+type Builder struct {
+	// Options, if not nil, configures the archive like the Template passed to NewArchive.
+	// Entries of Options must be empty, entries are added using AddFile and AddDir.
+	Options *Template
+
+	entries []*FileHeader
+	names   map[string]struct{}
+}
+
+// AddFile adds an entry to the archive.
+//
+// It returns an error if the entry is not valid or an entry with the same name was already added.
+// The entry is not added in that case.
+func (b *Builder) AddFile(h *FileHeader) error {
+	if err := validateEntry(h); err != nil {
+		return fmt.Errorf("entry %q: %w", h.Name, err)
+	}
+	options := b.Options
+	if options == nil {
+		options = &Template{}
+	}
+	if err := validateName(options, h.Name); err != nil {
+		return fmt.Errorf("entry %q: %w", h.Name, err)
+	}
+	if _, ok := b.names[h.Name]; ok {
+		return fmt.Errorf("entry %q: duplicate name", h.Name)
+	}
+	if b.names == nil {
+		b.names = make(map[string]struct{})
+	}
+	b.names[h.Name] = struct{}{}
+	b.entries = append(b.entries, h)
+	return nil
+}
+
+// AddDir adds a directory entry with the given mode to the archive.
+//
+// A trailing slash is appended to name if missing. If mode is zero, the default mode is used.
+func (b *Builder) AddDir(name string, mode os.FileMode) error {
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	h := &FileHeader{Name: name}
+	if mode != 0 {
+		h.SetMode(mode | os.ModeDir)
+	}
+	return b.AddFile(h)
+}
+
+// Build creates the Archive from the added entries.
+func (b *Builder) Build() (*Archive, error) {
+	var t Template
+	if b.Options != nil {
+		if len(b.Options.Entries) != 0 {
+			return nil, errors.New("builder options must not contain entries")
+		}
+		t = *b.Options
+	}
+	t.Entries = b.entries
+	return NewArchive(&t)
+}
@@ -0,0 +1,92 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	b := Builder{Options: &Template{Comment: "built"}}
+	if err := b.AddDir("dir", 0755); err != nil {
+		t.Fatalf("AddDir: %v", err)
+	}
+	data := []byte("hello")
+	file := &FileHeader{
+		Name:               "dir/hello.txt",
+		CRC32:              crc(data),
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(data)),
+		Content:            bytes.NewReader(data),
+	}
+	if err := b.AddFile(file); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+
+	invalid := []struct {
+		name   string
+		header *FileHeader
+		err    error
+	}{
+		{name: "duplicate", header: &FileHeader{Name: "dir/hello.txt"}},
+		{name: "duplicate dir", header: &FileHeader{Name: "dir/"}},
+		{name: "long name", header: &FileHeader{Name: strings.Repeat("a", uint16max+1)}, err: errLongName},
+		{name: "missing content", header: &FileHeader{Name: "a.txt", CompressedSize64: 5}, err: errMissingContent},
+		{
+			name:   "zero size",
+			header: &FileHeader{Name: "b.txt", Content: bytes.NewReader(data)},
+			err:    errContentZeroSize,
+		},
+		{
+			name:   "dir with content",
+			header: &FileHeader{Name: "c/", CompressedSize64: 5, Content: bytes.NewReader(data)},
+			err:    errDirContent,
+		},
+		{
+			name: "preset dictionary",
+			header: &FileHeader{Name: "d.txt", PresetDictionary: true, CompressedSize64: 5,
+				Content: bytes.NewReader(data)},
+			err: errPresetDictionary,
+		},
+	}
+	for _, test := range invalid {
+		err := b.AddFile(test.header)
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", test.name)
+			continue
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	ar, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Comment != "built" {
+		t.Errorf("comment %q, want %q", r.Comment, "built")
+	}
+	if len(r.File) != 2 {
+		t.Fatalf("got %d entries, want 2", len(r.File))
+	}
+	if r.File[0].Name != "dir/" || r.File[0].Mode() != os.ModeDir|0755 {
+		t.Errorf("first entry %q with mode %v, want %q with mode %v", r.File[0].Name, r.File[0].Mode(), "dir/",
+			os.ModeDir|0755)
+	}
+	if r.File[1].Name != "dir/hello.txt" {
+		t.Errorf("second entry %q, want %q", r.File[1].Name, "dir/hello.txt")
+	}
+
+	b = Builder{Options: &Template{Entries: []*FileHeader{{Name: "x/"}}}}
+	if _, err := b.Build(); err == nil {
+		t.Error("expected error for options with entries, got nil")
+	}
+}
@@ -0,0 +1,169 @@
+package zipserve
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// cacheBlockSize is the default size of blocks CachingReaderAt reads from the upstream reader and caches.
+const cacheBlockSize = 32 * 1024
+
+// CachingReaderAt caches data read from an upstream reader in memory.
+//
+// Data is read and cached in blocks of 32 KiB unless configured otherwise, least recently used blocks are evicted
+// once the cache exceeds its capacity. It is useful as Content of entries stored remotely that are requested repeatedly, for example by clients
+// resuming downloads. The upstream data must not change.
+//
+// CachingReaderAt is safe for concurrent use as long as the upstream reader is.
+type CachingReaderAt struct {
+	// counters are accessed atomically, keep them first for alignment on 32-bit platforms
+	hits          int64
+	misses        int64
+	cacheBytes    int64
+	upstreamBytes int64
+
+	r         ReaderAt
+	maxBytes  int64
+	blockSize int64
+
+	mu     sync.Mutex
+	blocks map[int64]*list.Element
+	lru    list.List // of *cacheBlock, most recently used first
+	size   int64     // total size of cached blocks
+}
+
+type cacheBlock struct {
+	index int64
+	data  []byte
+}
+
+// CacheStats are statistics of a CachingReaderAt.
+type CacheStats struct {
+	// Hits is the number of blocks found in the cache.
+	Hits int64
+	// Misses is the number of blocks read from the upstream reader.
+	Misses int64
+	// CacheBytes is the number of bytes returned to callers from the cache.
+	CacheBytes int64
+	// UpstreamBytes is the number of bytes returned to callers that were read from the upstream reader.
+	UpstreamBytes int64
+}
+
+// NewCachingReaderAt creates a new CachingReaderAt caching up to maxBytes bytes of data read from r.
+//
+// r may implement ReaderAt interface from this package, in that case r's ReadAtContext method will be called
+// instead of ReadAt.
+func NewCachingReaderAt(r io.ReaderAt, maxBytes int64) *CachingReaderAt {
+	return NewCachingReaderAtBlockSize(r, maxBytes, cacheBlockSize)
+}
+
+// NewCachingReaderAtBlockSize creates a new CachingReaderAt caching up to maxBytes bytes of data read from r
+// in blocks of blockSize bytes.
+//
+// Larger blocks mean fewer requests to slow upstream readers, smaller blocks waste less memory on data that is not
+// requested again. If blockSize is not positive, the default of 32 KiB is used.
+func NewCachingReaderAtBlockSize(r io.ReaderAt, maxBytes int64, blockSize int) *CachingReaderAt {
+	if blockSize <= 0 {
+		blockSize = cacheBlockSize
+	}
+	return &CachingReaderAt{
+		r:         readerAt(r),
+		maxBytes:  maxBytes,
+		blockSize: int64(blockSize),
+		blocks:    make(map[int64]*list.Element),
+	}
+}
+
+// Stats returns the statistics of cache usage, so that the capacity can be tuned.
+func (c *CachingReaderAt) Stats() CacheStats {
+	return CacheStats{
+		Hits:          atomic.LoadInt64(&c.hits),
+		Misses:        atomic.LoadInt64(&c.misses),
+		CacheBytes:    atomic.LoadInt64(&c.cacheBytes),
+		UpstreamBytes: atomic.LoadInt64(&c.upstreamBytes),
+	}
+}
+
+// ReadAt reads data through the cache.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (c *CachingReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return c.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data through the cache.
+//
+// This methods implements ReaderAt interface.
+func (c *CachingReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	for len(p) > 0 {
+		index := off / c.blockSize
+		data, hit := c.get(index)
+		if !hit {
+			data, err = c.fetch(ctx, index)
+			if err != nil {
+				return n, err
+			}
+		}
+		blockOff := off - index*c.blockSize
+		if blockOff >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n2 := copy(p, data[blockOff:])
+		if hit {
+			atomic.AddInt64(&c.cacheBytes, int64(n2))
+		} else {
+			atomic.AddInt64(&c.upstreamBytes, int64(n2))
+		}
+		n += n2
+		off += int64(n2)
+		p = p[n2:]
+		if len(p) > 0 && int64(len(data)) < c.blockSize {
+			// short block is the end of the data
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// get returns the cached block with the given index.
+func (c *CachingReaderAt) get(index int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[index]
+	if !ok {
+		return nil, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheBlock).data, true
+}
+
+// fetch reads the block with the given index from the upstream reader and stores it in the cache.
+func (c *CachingReaderAt) fetch(ctx context.Context, index int64) ([]byte, error) {
+	atomic.AddInt64(&c.misses, 1)
+	buf := make([]byte, c.blockSize)
+	n, err := c.r.ReadAtContext(ctx, buf, index*c.blockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data := buf[:n]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[index]; ok || int64(len(data)) > c.maxBytes {
+		return data, nil
+	}
+	c.blocks[index] = c.lru.PushFront(&cacheBlock{index: index, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		oldest := c.lru.Remove(c.lru.Back()).(*cacheBlock)
+		delete(c.blocks, oldest.index)
+		c.size -= int64(len(oldest.data))
+	}
+	return data, nil
+}
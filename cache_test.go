@@ -0,0 +1,122 @@
+package zipserve
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestCachingReaderAtStats(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+	c := NewCachingReaderAt(bytes.NewReader(data), 2*cacheBlockSize)
+
+	steps := []struct {
+		off, size int64
+		want      CacheStats
+	}{
+		// block 0 is fetched
+		{off: 0, size: 100, want: CacheStats{Misses: 1, UpstreamBytes: 100}},
+		// block 0 is cached
+		{off: 50, size: 100, want: CacheStats{Hits: 1, Misses: 1, CacheBytes: 100, UpstreamBytes: 100}},
+		// spans cached block 0 and block 1 that is fetched
+		{off: cacheBlockSize - 500, size: 1000, want: CacheStats{Hits: 2, Misses: 2, CacheBytes: 600, UpstreamBytes: 600}},
+		// block 2 is fetched, evicting block 0 as least recently used
+		{off: 2 * cacheBlockSize, size: 10, want: CacheStats{Hits: 2, Misses: 3, CacheBytes: 600, UpstreamBytes: 610}},
+		// block 1 is still cached
+		{off: cacheBlockSize, size: 10, want: CacheStats{Hits: 3, Misses: 3, CacheBytes: 610, UpstreamBytes: 610}},
+		// block 0 must be fetched again
+		{off: 0, size: 10, want: CacheStats{Hits: 3, Misses: 4, CacheBytes: 610, UpstreamBytes: 620}},
+	}
+	for i, step := range steps {
+		p := make([]byte, step.size)
+		n, err := c.ReadAt(p, step.off)
+		if err != nil {
+			t.Fatalf("step %d: ReadAt: %v", i, err)
+		}
+		if !bytes.Equal(p[:n], data[step.off:step.off+step.size]) {
+			t.Errorf("step %d: data mismatch", i)
+		}
+		if got := c.Stats(); got != step.want {
+			t.Errorf("step %d: stats %+v, want %+v", i, got, step.want)
+		}
+	}
+
+	// reading over the end of the data
+	p := make([]byte, 1000)
+	n, err := c.ReadAt(p, int64(len(data))-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("reading over the end: got %d, %v, want 10, EOF", n, err)
+	}
+	if !bytes.Equal(p[:n], data[len(data)-10:]) {
+		t.Error("reading over the end: data mismatch")
+	}
+}
+
+func TestCachingReaderAtConcurrent(t *testing.T) {
+	data := make([]byte, 10*cacheBlockSize+123)
+	rand.New(rand.NewSource(2)).Read(data)
+	c := NewCachingReaderAt(bytes.NewReader(data), 3*cacheBlockSize)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 100; i++ {
+				off := rnd.Int63n(int64(len(data)))
+				size := rnd.Int63n(2 * cacheBlockSize)
+				if off+size > int64(len(data)) {
+					size = int64(len(data)) - off
+				}
+				p := make([]byte, size)
+				if _, err := c.ReadAt(p, off); err != nil {
+					t.Errorf("ReadAt(%d, %d): %v", off, size, err)
+					return
+				}
+				if !bytes.Equal(p, data[off:off+size]) {
+					t.Errorf("ReadAt(%d, %d): data mismatch", off, size)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	if stats.CacheBytes+stats.UpstreamBytes == 0 || stats.Hits == 0 || stats.Misses == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCachingReaderAtBlockSize(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(3)).Read(data)
+	upstream := &countingReaderAt{r: bytes.NewReader(data)}
+	c := NewCachingReaderAtBlockSize(upstream, 3000, 1000)
+
+	p := make([]byte, 1500)
+	for i := 0; i < 2; i++ {
+		n, err := c.ReadAt(p, 500)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], data[500:2000]) {
+			t.Fatal("data mismatch")
+		}
+	}
+	if len(upstream.reads) != 2 || upstream.reads[0] != 1000 || upstream.reads[1] != 1000 {
+		t.Errorf("upstream reads %v, want [1000 1000]", upstream.reads)
+	}
+	if got, want := c.Stats(), (CacheStats{Hits: 2, Misses: 2, CacheBytes: 1500, UpstreamBytes: 1500}); got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+
+	n, err := c.ReadAt(p, 9500)
+	if n != 500 || err != io.EOF || !bytes.Equal(p[:n], data[9500:]) {
+		t.Errorf("reading over the end: got %d, %v, want 500, EOF", n, err)
+	}
+}
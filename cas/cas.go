@@ -0,0 +1,204 @@
+// Package cas reads content of zipserve archive entries from content-addressed storage.
+//
+// Blobs are identified by a digest of their content, like "sha256:2cf24dba...". The digest of the data is verified
+// when a blob is read sequentially from the start to the end, which is the case when a whole archive is downloaded.
+// A mismatch is reported as a *DigestError by the read of the last byte of the blob.
+package cas
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Digest identifies content by its hash.
+type Digest struct {
+	// Algorithm is the hash algorithm, one of "sha256", "sha384" or "sha512".
+	Algorithm string
+	// Hex is the lowercase hex encoded hash.
+	Hex string
+}
+
+// ParseDigest parses a digest in the form "algorithm:hex".
+func ParseDigest(s string) (Digest, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return Digest{}, fmt.Errorf("cas: invalid digest %q: missing algorithm", s)
+	}
+	d := Digest{Algorithm: s[:i], Hex: s[i+1:]}
+	if err := d.Validate(); err != nil {
+		return Digest{}, err
+	}
+	return d, nil
+}
+
+// String returns the digest in the form "algorithm:hex".
+func (d Digest) String() string {
+	return d.Algorithm + ":" + d.Hex
+}
+
+// Validate checks that the algorithm is supported and the hash has the correct length.
+func (d Digest) Validate() error {
+	h, err := newHash(d.Algorithm)
+	if err != nil {
+		return err
+	}
+	if len(d.Hex) != 2*h.Size() || strings.ToLower(d.Hex) != d.Hex {
+		return fmt.Errorf("cas: invalid %s digest %q", d.Algorithm, d.Hex)
+	}
+	if _, err := hex.DecodeString(d.Hex); err != nil {
+		return fmt.Errorf("cas: invalid %s digest %q", d.Algorithm, d.Hex)
+	}
+	return nil
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("cas: unsupported digest algorithm %q", algorithm)
+	}
+}
+
+// DigestError is returned when the data read from a store doesn't match the expected digest.
+type DigestError struct {
+	Expected Digest
+	Actual   Digest
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("cas: digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// Store reads blobs by digest.
+type Store interface {
+	// ReadAt reads len(p) bytes of the blob with the given digest starting at offset off.
+	// It has the same semantics as io.ReaderAt.
+	ReadAt(ctx context.Context, d Digest, p []byte, off int64) (n int, err error)
+}
+
+// Dir is a Store reading blobs from files named "<algorithm>/<hex>" in a directory, which is the layout used
+// by the blobs directory of OCI image layouts.
+type Dir string
+
+// ReadAt reads data of the blob from its file.
+func (dir Dir) ReadAt(ctx context.Context, d Digest, p []byte, off int64) (n int, err error) {
+	if err := d.Validate(); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(filepath.Join(string(dir), d.Algorithm, d.Hex))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, off)
+}
+
+// Blob is the content of a blob in a Store.
+//
+// It implements the ReaderAt interface of zipserve, so it can be used as FileHeader.Content.
+type Blob struct {
+	store  Store
+	digest Digest
+	size   int64
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// hash of data from the start of the blob up to offset next.
+	hash hash.Hash
+	next int64
+}
+
+// NewBlob returns the blob with the given digest and size stored in store.
+func NewBlob(store Store, d Digest, size int64) (*Blob, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	h, _ := newHash(d.Algorithm)
+	return &Blob{store: store, digest: d, size: size, hash: h}, nil
+}
+
+// Digest returns the digest of the blob.
+func (b *Blob) Digest() Digest { return b.digest }
+
+// Size returns the size of the blob in bytes.
+func (b *Blob) Size() int64 { return b.size }
+
+// ReadAt reads data of the blob.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (b *Blob) ReadAt(p []byte, off int64) (n int, err error) {
+	return b.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data of the blob from the store.
+//
+// Reads continuing where the previous read ended are hashed; a read starting at offset 0 starts the hash over.
+// When the last byte of the blob is hashed, the digest is verified and *DigestError returned on mismatch.
+//
+// This methods implements ReaderAt interface of zipserve.
+func (b *Blob) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	eof := false
+	if max := b.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = true
+	}
+	n, err = b.store.ReadAt(ctx, b.digest, p, off)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := b.verify(p[:n], off); err != nil {
+		return n, err
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// verify hashes data read at off if it continues the sequence of hashed data, and checks the digest once
+// the whole blob was hashed.
+func (b *Blob) verify(data []byte, off int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if off == 0 {
+		b.hash.Reset()
+		b.next = 0
+	}
+	if off != b.next {
+		return nil
+	}
+	b.hash.Write(data)
+	b.next += int64(len(data))
+	if b.next < b.size {
+		return nil
+	}
+	actual := Digest{Algorithm: b.digest.Algorithm, Hex: hex.EncodeToString(b.hash.Sum(nil))}
+	b.hash.Reset()
+	b.next = 0
+	if actual != b.digest {
+		return &DigestError{Expected: b.digest, Actual: actual}
+	}
+	return nil
+}
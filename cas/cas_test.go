@@ -0,0 +1,129 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type memStore map[Digest][]byte
+
+func (m memStore) ReadAt(ctx context.Context, d Digest, p []byte, off int64) (int, error) {
+	data, ok := m[d]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return bytes.NewReader(data).ReadAt(p, off)
+}
+
+func sha256Digest(data []byte) Digest {
+	sum := sha256.Sum256(data)
+	return Digest{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}
+}
+
+func TestParseDigest(t *testing.T) {
+	s := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	d, err := ParseDigest(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Algorithm != "sha256" || d.String() != s {
+		t.Errorf("parsed %#v", d)
+	}
+	for _, invalid := range []string{
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"md5:5d41402abc4b2a76b9719d911017c592",
+		"sha256:2cf24dba",
+		"sha256:2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824",
+		"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b98zz",
+	} {
+		if _, err := ParseDigest(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestBlobVerify(t *testing.T) {
+	data := bytes.Repeat([]byte("content addressed "), 100)
+	d := sha256Digest(data)
+	blob, err := NewBlob(memStore{d: data}, d, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(io.NewSectionReader(blob, 0, blob.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)/2] ^= 1
+	blob, err = NewBlob(memStore{d: corrupted}, d, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads that don't continue from the start are not verified
+	p := make([]byte, 100)
+	if _, err := blob.ReadAt(p, int64(len(data))-100); err != nil {
+		t.Fatalf("unexpected error for partial read: %v", err)
+	}
+	_, err = ioutil.ReadAll(io.NewSectionReader(blob, 0, blob.Size()))
+	var digestErr *DigestError
+	if !errors.As(err, &digestErr) {
+		t.Fatalf("expected *DigestError, got %v", err)
+	}
+	if digestErr.Expected != d || digestErr.Actual != sha256Digest(corrupted) {
+		t.Errorf("unexpected digests in %v", digestErr)
+	}
+
+	// a download restarted from the beginning is verified again
+	r := io.NewSectionReader(blob, 0, blob.Size())
+	if _, err := r.Read(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(io.NewSectionReader(blob, 0, blob.Size())); !errors.As(err, &digestErr) {
+		t.Fatalf("expected *DigestError for restarted read, got %v", err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	data := []byte("hello")
+	d := sha256Digest(data)
+	if err := os.MkdirAll(filepath.Join(root, "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sha256", d.Hex), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := NewBlob(Dir(root), d, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	n, err := blob.ReadAt(p, 0)
+	if err != io.EOF || string(p[:n]) != "hello" {
+		t.Fatalf("got %q, %v", p[:n], err)
+	}
+
+	missing, err := NewBlob(Dir(root), sha256Digest([]byte("missing")), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := missing.ReadAt(p, 0); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+}
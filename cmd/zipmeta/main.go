@@ -0,0 +1,79 @@
+// Command zipmeta computes metadata of files in a directory and writes it as a manifest.
+//
+// The manifest contains names, modes, modification times, sizes and CRC32 checksums of the files, so that
+// an archive can be created from it by manifest.Unmarshal without reading the files again. Usage:
+//
+//	zipmeta [flags] dir
+//
+// Locators in the manifest are slash-separated paths of the files relative to dir, as expected by
+// zipserve -manifest.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/martin-sucha/zipserve"
+	"github.com/martin-sucha/zipserve/manifest"
+)
+
+// patterns is a flag.Value collecting repeated pattern flags.
+type patterns []string
+
+func (p *patterns) String() string { return strings.Join(*p, ",") }
+
+func (p *patterns) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func main() {
+	var opts zipserve.FSOptions
+	output := flag.String("o", "", "write the manifest to a file instead of standard output")
+	comment := flag.String("comment", "", "archive comment stored in the manifest")
+	flag.Var((*patterns)(&opts.Include), "include", "include only files matching the pattern, may be repeated")
+	flag.Var((*patterns)(&opts.Exclude), "exclude", "exclude files matching the pattern, may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] dir\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	data, err := dirManifest(flag.Arg(0), *comment, &opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *output != "" {
+		err = ioutil.WriteFile(*output, data, 0644)
+	} else {
+		_, err = os.Stdout.Write(data)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dirManifest creates the manifest of regular files and directories in dir.
+//
+// Symbolic links are skipped, since their locators would resolve to the targets instead of the links.
+func dirManifest(dir, comment string, opts *zipserve.FSOptions) ([]byte, error) {
+	opts.Filter = func(path string, info os.FileInfo) bool {
+		return info.Mode()&os.ModeSymlink == 0
+	}
+	tmpl, err := zipserve.TemplateFromDir(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Comment = comment
+	return manifest.Marshal(tmpl, func(fh *zipserve.FileHeader) (string, error) {
+		return fh.Name, nil
+	})
+}
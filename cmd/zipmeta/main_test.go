@@ -0,0 +1,92 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/martin-sucha/zipserve"
+	"github.com/martin-sucha/zipserve/manifest"
+)
+
+func TestDirManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipmeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.txt":     "first",
+		"sub/b.txt": "second",
+		"sub/c.log": "skipped",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link")); err != nil {
+		t.Logf("symbolic links not supported: %v", err)
+	}
+
+	data, err := dirManifest(dir, "comment", &zipserve.FSOptions{Exclude: []string{"*.log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolved []string
+	tmpl, err := manifest.Unmarshal(data, func(locator string) (io.ReaderAt, error) {
+		resolved = append(resolved, locator)
+		return os.Open(filepath.Join(dir, filepath.FromSlash(locator)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fh := range tmpl.Entries {
+		if f, ok := fh.Content.(*os.File); ok {
+			defer f.Close()
+		}
+	}
+	if len(resolved) != 2 {
+		t.Errorf("resolved locators %q, want 2 files", resolved)
+	}
+	ar, err := zipserve.NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Comment != "comment" {
+		t.Errorf("comment %q, want %q", r.Comment, "comment")
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+		if f.Mode().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		if string(got) != files[f.Name] {
+			t.Errorf("%s: got %q, want %q", f.Name, got, files[f.Name])
+		}
+	}
+	if len(names) != 3 {
+		t.Errorf("entries %q, want a.txt, sub/ and sub/b.txt", names)
+	}
+}
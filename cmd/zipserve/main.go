@@ -0,0 +1,162 @@
+// Command zipserve serves a local directory as a ZIP archive download.
+//
+// The archive is not stored anywhere, it is assembled from the files on the fly. Range requests are supported,
+// so clients can resume interrupted downloads. Usage:
+//
+//	zipserve [flags] [dir]
+//
+// Instead of walking dir, the entries can be loaded from a manifest created by the manifest package, with
+// -manifest. Locators in the manifest are then paths of the files relative to dir.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/martin-sucha/zipserve"
+	"github.com/martin-sucha/zipserve/manifest"
+)
+
+// config holds values of command line flags.
+type config struct {
+	dir      string
+	manifest string
+	prefix   string
+	comment  string
+	compress bool
+	level    int
+}
+
+func main() {
+	var cfg config
+	addr := flag.String("addr", ":8080", "address to listen on")
+	name := flag.String("name", "archive.zip", "file name of the archive suggested to clients")
+	flag.StringVar(&cfg.manifest, "manifest", "", "load entries from a manifest file instead of walking dir")
+	flag.StringVar(&cfg.prefix, "prefix", "", "file to prepend to the archive, for example a self-extractor stub")
+	flag.StringVar(&cfg.comment, "comment", "", "archive comment")
+	flag.BoolVar(&cfg.compress, "compress", false, "compress stored files with Deflate at startup")
+	flag.IntVar(&cfg.level, "level", 0, "Deflate compression level used with -compress, 0 means default")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [dir]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	switch flag.NArg() {
+	case 0:
+		cfg.dir = "."
+	case 1:
+		cfg.dir = flag.Arg(0)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	tmpl, cleanup, err := buildTemplate(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cleanup()
+	tmpl.DownloadName = *name
+	ar, err := zipserve.NewArchive(tmpl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: ar}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Print(err)
+		}
+	}()
+	log.Printf("serving %d entries (%d bytes) on %s", len(tmpl.Entries), ar.Size(), *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		// log.Fatal skips deferred calls
+		cleanup()
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// buildTemplate creates the template to serve. cleanup releases resources used by the template.
+func buildTemplate(cfg config) (tmpl *zipserve.Template, cleanup func(), err error) {
+	var closers []io.Closer
+	cleanup = func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
+
+	if cfg.manifest != "" {
+		data, err := ioutil.ReadFile(cfg.manifest)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		tmpl, err = manifest.Unmarshal(data, func(locator string) (io.ReaderAt, error) {
+			f, err := os.Open(filepath.Join(cfg.dir, filepath.FromSlash(locator)))
+			if err != nil {
+				return nil, err
+			}
+			closers = append(closers, f)
+			return f, nil
+		})
+		if err != nil {
+			return nil, cleanup, err
+		}
+	} else {
+		tmpl, err = zipserve.TemplateFromDir(cfg.dir, nil)
+		if err != nil {
+			return nil, cleanup, err
+		}
+	}
+
+	if cfg.prefix != "" {
+		f, err := os.Open(cfg.prefix)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		closers = append(closers, f)
+		info, err := f.Stat()
+		if err != nil {
+			return nil, cleanup, err
+		}
+		tmpl.Prefix = f
+		tmpl.PrefixSize = info.Size()
+	}
+	if cfg.comment != "" {
+		tmpl.Comment = cfg.comment
+	}
+
+	if cfg.compress {
+		opts := zipserve.CompressOptions{Level: cfg.level, SpillThreshold: 1 << 20}
+		for _, fh := range tmpl.Entries {
+			if fh.Method != zipserve.Store || fh.Content == nil || fh.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+			compressed, err := zipserve.Compress(io.NewSectionReader(fh.Content, 0, int64(fh.CompressedSize64)), opts)
+			if err != nil {
+				return nil, cleanup, fmt.Errorf("compressing %s: %w", fh.Name, err)
+			}
+			closers = append(closers, compressed)
+			compressed.Apply(fh)
+		}
+	}
+	return tmpl, cleanup, nil
+}
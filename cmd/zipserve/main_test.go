@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/martin-sucha/zipserve"
+	"github.com/martin-sucha/zipserve/manifest"
+)
+
+func TestBuildTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipserve-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("compressible "), 100)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	prefix := filepath.Join(dir, "..", filepath.Base(dir)+".prefix")
+	if err := ioutil.WriteFile(prefix, []byte("#!stub\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(prefix)
+
+	tmpl, err := zipserve.TemplateFromDir(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestData, err := manifest.Marshal(tmpl, func(fh *zipserve.FileHeader) (string, error) {
+		return fh.Name, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestFile := filepath.Join(dir, "..", filepath.Base(dir)+".json")
+	if err := ioutil.WriteFile(manifestFile, manifestData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(manifestFile)
+
+	for _, cfg := range []config{
+		{dir: dir},
+		{dir: dir, compress: true, prefix: prefix, comment: "hello"},
+		{dir: dir, manifest: manifestFile, compress: true},
+	} {
+		tmpl, cleanup, err := buildTemplate(cfg)
+		if err != nil {
+			t.Fatalf("%+v: %v", cfg, err)
+		}
+		ar, err := zipserve.NewArchive(tmpl)
+		if err != nil {
+			t.Fatalf("%+v: %v", cfg, err)
+		}
+		archive, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup()
+		if cfg.prefix != "" && !bytes.HasPrefix(archive, []byte("#!stub\n")) {
+			t.Errorf("%+v: archive does not start with the prefix", cfg)
+		}
+		r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatalf("%+v: %v", cfg, err)
+		}
+		if r.Comment != cfg.comment {
+			t.Errorf("%+v: comment %q, want %q", cfg, r.Comment, cfg.comment)
+		}
+		if len(r.File) != 1 {
+			t.Fatalf("%+v: got %d files, want 1", cfg, len(r.File))
+		}
+		f := r.File[0]
+		wantMethod := zip.Store
+		if cfg.compress {
+			wantMethod = zip.Deflate
+		}
+		if f.Method != wantMethod {
+			t.Errorf("%+v: method %d, want %d", cfg, f.Method, wantMethod)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%+v: content differs, error %v", cfg, err)
+		}
+	}
+}
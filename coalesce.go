@@ -0,0 +1,157 @@
+package zipserve
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// CoalescingReaderAt shares reads from an upstream reader between concurrent callers.
+//
+// Data is read from the upstream reader in aligned blocks. If a block is requested while it is already being read
+// for another caller, the caller waits for that read instead of reading the block again. This reduces the load on
+// the backend when many clients download the same archive at the same time. Unlike CachingReaderAt, blocks are not
+// kept once the read completes.
+//
+// If the context of the caller that started a read is canceled, callers waiting for the read retry it on their own.
+//
+// CoalescingReaderAt is safe for concurrent use as long as the upstream reader is.
+type CoalescingReaderAt struct {
+	// counters are accessed atomically, keep them first for alignment on 32-bit platforms
+	fetches int64
+	shared  int64
+
+	r         ReaderAt
+	blockSize int64
+
+	mu       sync.Mutex
+	inflight map[int64]*coalescedRead
+
+	// testHookWait is called before waiting for a read started by another caller.
+	testHookWait func()
+}
+
+// coalescedRead is a read of a block from the upstream reader.
+type coalescedRead struct {
+	done chan struct{}
+	// data and err are set before done is closed.
+	data []byte
+	err  error
+	// canceled is true if the read failed because the context of the caller that started it was done,
+	// or because it panicked.
+	canceled bool
+}
+
+// NewCoalescingReaderAt creates a new CoalescingReaderAt reading r in blocks of blockSize bytes.
+// If blockSize is not positive, the default of 32 KiB is used.
+//
+// r may implement ReaderAt interface from this package, in that case r's ReadAtContext method will be called
+// instead of ReadAt.
+func NewCoalescingReaderAt(r io.ReaderAt, blockSize int) *CoalescingReaderAt {
+	if blockSize <= 0 {
+		blockSize = cacheBlockSize
+	}
+	return &CoalescingReaderAt{
+		r:         readerAt(r),
+		blockSize: int64(blockSize),
+		inflight:  make(map[int64]*coalescedRead),
+	}
+}
+
+// Fetches returns the number of blocks read from the upstream reader.
+func (c *CoalescingReaderAt) Fetches() int64 {
+	return atomic.LoadInt64(&c.fetches)
+}
+
+// Shared returns the number of times a caller used a block read for another caller.
+func (c *CoalescingReaderAt) Shared() int64 {
+	return atomic.LoadInt64(&c.shared)
+}
+
+// ReadAt reads data, sharing upstream reads with concurrent callers.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (c *CoalescingReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return c.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data, sharing upstream reads with concurrent callers.
+//
+// This methods implements ReaderAt interface.
+func (c *CoalescingReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	for len(p) > 0 {
+		index := off / c.blockSize
+		data, err := c.block(ctx, index)
+		if err != nil {
+			return n, err
+		}
+		blockOff := off - index*c.blockSize
+		if blockOff >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n2 := copy(p, data[blockOff:])
+		n += n2
+		off += int64(n2)
+		p = p[n2:]
+		if len(p) > 0 && int64(len(data)) < c.blockSize {
+			// short block is the end of the data
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// block returns the data of the block with the given index, waiting for a read in progress if there is one.
+// The returned slice must not be modified.
+func (c *CoalescingReaderAt) block(ctx context.Context, index int64) ([]byte, error) {
+	for {
+		c.mu.Lock()
+		read, ok := c.inflight[index]
+		if !ok {
+			read = &coalescedRead{done: make(chan struct{})}
+			c.inflight[index] = read
+			c.mu.Unlock()
+			c.fetch(ctx, index, read)
+			return read.data, read.err
+		}
+		c.mu.Unlock()
+		if c.testHookWait != nil {
+			c.testHookWait()
+		}
+		select {
+		case <-read.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if read.canceled {
+			continue
+		}
+		atomic.AddInt64(&c.shared, 1)
+		return read.data, read.err
+	}
+}
+
+// fetch reads the block with the given index from the upstream reader and completes read.
+func (c *CoalescingReaderAt) fetch(ctx context.Context, index int64, read *coalescedRead) {
+	// if the upstream read panics, waiters retry the block as if the read was canceled
+	read.canceled = true
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, index)
+		c.mu.Unlock()
+		close(read.done)
+	}()
+
+	atomic.AddInt64(&c.fetches, 1)
+	buf := make([]byte, c.blockSize)
+	n, err := c.r.ReadAtContext(ctx, buf, index*c.blockSize)
+	if err == io.EOF {
+		err = nil
+	}
+	read.data = buf[:n]
+	read.err = err
+	read.canceled = err != nil && ctx.Err() != nil
+}
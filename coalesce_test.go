@@ -0,0 +1,166 @@
+package zipserve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamGate signals started on each read and blocks it until release is closed.
+type upstreamGate struct {
+	r       io.ReaderAt
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *upstreamGate) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	return b.r.ReadAt(p, off)
+}
+
+func (b *upstreamGate) ReadAt(p []byte, off int64) (int, error) {
+	return b.ReadAtContext(context.TODO(), p, off)
+}
+
+func TestCoalescingReaderAtShared(t *testing.T) {
+	data := make([]byte, 3000)
+	rand.New(rand.NewSource(6)).Read(data)
+	upstream := &upstreamGate{
+		r:       bytes.NewReader(data),
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	c := NewCoalescingReaderAt(upstream, 4096)
+	const readers = 5
+	var waiting sync.WaitGroup
+	waiting.Add(readers - 1)
+	c.testHookWait = waiting.Done
+
+	var wg sync.WaitGroup
+	read := func(off, size int64) {
+		defer wg.Done()
+		p := make([]byte, size)
+		n, err := c.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Errorf("ReadAt(%d, %d): %v", off, size, err)
+			return
+		}
+		if !bytes.Equal(p[:n], data[off:off+size]) {
+			t.Errorf("ReadAt(%d, %d): data mismatch", off, size)
+		}
+	}
+	wg.Add(1)
+	go read(0, 1000)
+	<-upstream.started
+	for i := int64(1); i < readers; i++ {
+		wg.Add(1)
+		go read(i*100, 500)
+	}
+	waiting.Wait()
+	close(upstream.release)
+	wg.Wait()
+
+	if c.Fetches() != 1 || c.Shared() != readers-1 {
+		t.Errorf("%d fetches and %d shared, want 1 and %d", c.Fetches(), c.Shared(), readers-1)
+	}
+
+	n, err := c.ReadAt(make([]byte, 100), 2950)
+	if n != 50 || err != io.EOF {
+		t.Errorf("reading over the end: got %d, %v, want 50, EOF", n, err)
+	}
+}
+
+func TestCoalescingReaderAtCanceled(t *testing.T) {
+	data := []byte("coalesced data")
+	upstream := &upstreamGate{
+		r:       bytes.NewReader(data),
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	c := NewCoalescingReaderAt(upstream, 0)
+	waiting := make(chan struct{})
+	c.testHookWait = func() { close(waiting) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := c.ReadAtContext(ctx, make([]byte, 5), 0)
+		leaderErr <- err
+	}()
+	<-upstream.started
+
+	followerErr := make(chan error)
+	p := make([]byte, len(data))
+	go func() {
+		_, err := c.ReadAt(p, 0)
+		followerErr <- err
+	}()
+	<-waiting
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader error %v, want %v", err, context.Canceled)
+	}
+	// the follower retries the read on its own
+	<-upstream.started
+	close(upstream.release)
+	if err := <-followerErr; err != nil && err != io.EOF {
+		t.Fatalf("follower error %v", err)
+	}
+	if !bytes.Equal(p, data) {
+		t.Errorf("follower got %q", p)
+	}
+}
+
+// panickingReaderAt panics on the first read and reads from r afterwards.
+type panickingReaderAt struct {
+	r        io.ReaderAt
+	panicked bool
+}
+
+func (p *panickingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if !p.panicked {
+		p.panicked = true
+		panic("upstream failure")
+	}
+	return p.r.ReadAt(b, off)
+}
+
+func TestCoalescingReaderAtPanic(t *testing.T) {
+	data := []byte("coalesced data")
+	c := NewCoalescingReaderAt(&panickingReaderAt{r: bytes.NewReader(data)}, 0)
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected the upstream panic to propagate")
+			}
+		}()
+		c.ReadAt(make([]byte, 5), 0)
+	}()
+
+	done := make(chan struct{})
+	p := make([]byte, len(data))
+	go func() {
+		defer close(done)
+		if _, err := c.ReadAt(p, 0); err != nil && err != io.EOF {
+			t.Errorf("read after panic: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read after panic blocked")
+	}
+	if !bytes.Equal(p, data) {
+		t.Errorf("read after panic got %q", p)
+	}
+}
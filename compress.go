@@ -0,0 +1,163 @@
+package zipserve
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// CompressOptions configures Compress.
+type CompressOptions struct {
+	// Level is the flate compression level. Zero means flate.DefaultCompression.
+	Level int
+
+	// SpillThreshold is the maximum number of compressed bytes kept in memory.
+	// When the compressed data grows larger, it is moved to a temporary file.
+	// Zero means the data is always kept in memory.
+	SpillThreshold int64
+
+	// TempDir is the directory for temporary files. If empty, the default directory for temporary files is used.
+	TempDir string
+}
+
+// CompressedContent is entry content compressed by Compress.
+//
+// Close must be called once the content is no longer used to remove the temporary file, if any.
+type CompressedContent struct {
+	// Content is the compressed data.
+	Content SizedReaderAt
+
+	// CRC32 is a checksum of the uncompressed data.
+	CRC32 uint32
+
+	// UncompressedSize64 is the size of the uncompressed data.
+	UncompressedSize64 uint64
+
+	file *os.File
+}
+
+// Compress reads r until EOF and compresses the data using Deflate.
+//
+// The compressed data is buffered in memory up to opts.SpillThreshold bytes, larger data is stored in a temporary
+// file, so that memory usage stays bounded for large inputs.
+func Compress(r io.Reader, opts CompressOptions) (*CompressedContent, error) {
+	level := opts.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	sw := &spillWriter{threshold: opts.SpillThreshold, dir: opts.TempDir}
+	fw, err := flate.NewWriter(sw, level)
+	if err != nil {
+		return nil, err
+	}
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(fw, hash), r)
+	if err == nil {
+		err = fw.Close()
+	}
+	if err != nil {
+		sw.close()
+		return nil, err
+	}
+	return &CompressedContent{
+		Content:            sw.reader(),
+		CRC32:              hash.Sum32(),
+		UncompressedSize64: uint64(n),
+		file:               sw.file,
+	}, nil
+}
+
+// Generate creates content of an entry from a stream produced by generate.
+//
+// Since serving the archive requires random access to the content, generate is called only once and the produced
+// stream is read to the end, compressed and stored as described in Compress. If the stream implements io.Closer,
+// it is closed afterwards.
+func Generate(ctx context.Context, generate func(ctx context.Context) (io.Reader, error),
+	opts CompressOptions) (*CompressedContent, error) {
+	r, err := generate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	return Compress(contextReader{ctx: ctx, r: r}, opts)
+}
+
+// Spilled reports whether the compressed data is stored in a temporary file.
+func (c *CompressedContent) Spilled() bool {
+	return c.file != nil
+}
+
+// Apply sets Method, CRC32, sizes and Content of fh to describe the compressed content.
+func (c *CompressedContent) Apply(fh *FileHeader) {
+	fh.Method = Deflate
+	fh.CRC32 = c.CRC32
+	fh.UncompressedSize64 = c.UncompressedSize64
+	fh.CompressedSize64 = uint64(c.Content.Size())
+	fh.Content = c.Content
+}
+
+// Close removes the temporary file, if any.
+func (c *CompressedContent) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	if rerr := os.Remove(c.file.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// spillWriter buffers data in memory until threshold is exceeded, then it moves the data to a temporary file.
+type spillWriter struct {
+	threshold int64
+	dir       string
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+}
+
+func (s *spillWriter) Write(p []byte) (int, error) {
+	if s.file == nil && s.threshold > 0 && int64(s.buf.Len()+len(p)) > s.threshold {
+		f, err := ioutil.TempFile(s.dir, "zipserve-")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := f.Write(s.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// reader returns the written data.
+func (s *spillWriter) reader() SizedReaderAt {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes())
+	}
+	return io.NewSectionReader(s.file, 0, s.size)
+}
+
+// close removes the temporary file, if any.
+func (s *spillWriter) close() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
@@ -0,0 +1,133 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	// text-like data that compresses, but not too well
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"zip", "serve", "range", "archive", "deflate", "entry", "header", " ", "\n"}
+	var data bytes.Buffer
+	for data.Len() < 1<<20 {
+		data.WriteString(words[rnd.Intn(len(words))])
+	}
+
+	tests := []struct {
+		name        string
+		threshold   int64
+		wantSpilled bool
+	}{
+		{name: "memory", threshold: 0, wantSpilled: false},
+		{name: "below threshold", threshold: 1 << 30, wantSpilled: false},
+		{name: "spilled", threshold: 4096, wantSpilled: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := Compress(bytes.NewReader(data.Bytes()), CompressOptions{SpillThreshold: test.threshold})
+			if err != nil {
+				t.Fatalf("Compress: %v", err)
+			}
+			defer c.Close()
+			if c.Spilled() != test.wantSpilled {
+				t.Errorf("spilled %v, want %v", c.Spilled(), test.wantSpilled)
+			}
+			if c.CRC32 != crc(data.Bytes()) {
+				t.Errorf("crc32 %#x, want %#x", c.CRC32, crc(data.Bytes()))
+			}
+
+			fh := &FileHeader{Name: "data.txt"}
+			c.Apply(fh)
+			if fh.CompressedSize64 >= fh.UncompressedSize64 {
+				t.Errorf("compressed size %d not smaller than %d", fh.CompressedSize64, fh.UncompressedSize64)
+			}
+			ar, err := NewArchive(&Template{Entries: []*FileHeader{fh}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := zip.NewReader(ar, ar.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			testReadFile(t, r.File[0], &WriteTest{Name: "data.txt", Data: data.Bytes(), Mode: 0666})
+
+			if c.Spilled() {
+				name := c.file.Name()
+				if err := c.Close(); err != nil {
+					t.Fatalf("Close: %v", err)
+				}
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("temporary file %s not removed: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressEmpty(t *testing.T) {
+	c, err := Compress(bytes.NewReader(nil), CompressOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fh := &FileHeader{Name: "empty.txt"}
+	c.Apply(fh)
+	if err := VerifyCRC(context.Background(), fh); err != nil {
+		t.Errorf("VerifyCRC: %v", err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	var want bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&want, "report line %d\n", i)
+	}
+	calls := 0
+	generate := func(ctx context.Context) (io.Reader, error) {
+		calls++
+		pr, pw := io.Pipe()
+		go func() {
+			for i := 0; i < 10000; i++ {
+				fmt.Fprintf(pw, "report line %d\n", i)
+			}
+			pw.Close()
+		}()
+		return pr, nil
+	}
+
+	c, err := Generate(context.Background(), generate, CompressOptions{SpillThreshold: 1024})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	defer c.Close()
+	if calls != 1 {
+		t.Errorf("generate called %d times, want 1", calls)
+	}
+
+	fh := &FileHeader{Name: "report.txt"}
+	c.Apply(fh)
+	ar, err := NewArchive(&Template{Entries: []*FileHeader{fh}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReadFile(t, r.File[0], &WriteTest{Name: "report.txt", Data: want.Bytes(), Mode: 0666})
+
+	_, err = Generate(context.Background(), func(ctx context.Context) (io.Reader, error) {
+		return nil, errors.New("generator failed")
+	}, CompressOptions{})
+	if err == nil {
+		t.Error("expected error from failing generator, got nil")
+	}
+}
@@ -0,0 +1,30 @@
+package zipserve
+
+import "context"
+
+// entryCredentialsKey is the context key of credentials for a single entry.
+type entryCredentialsKey struct {
+	name string
+}
+
+// WithEntryCredentials returns a copy of ctx carrying credentials for the entry with the given name.
+//
+// The context of a request served by Archive.ServeHTTP is passed to ReadAtContext of each entry's Content,
+// so a handler in front of the archive can attach request-scoped credentials, for example tokens of a storage
+// backend:
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		ctx := zipserve.WithEntryCredentials(r.Context(), "report.pdf", tokenFor(r, "report.pdf"))
+//		archive.ServeHTTP(w, r.WithContext(ctx))
+//	}
+//
+// The Content of the entry then retrieves them in ReadAtContext using EntryCredentials.
+func WithEntryCredentials(ctx context.Context, name string, creds interface{}) context.Context {
+	return context.WithValue(ctx, entryCredentialsKey{name: name}, creds)
+}
+
+// EntryCredentials returns the credentials attached to ctx for the entry with the given name
+// by WithEntryCredentials, or nil if there are none.
+func EntryCredentials(ctx context.Context, name string) interface{} {
+	return ctx.Value(entryCredentialsKey{name: name})
+}
@@ -0,0 +1,77 @@
+package zipserve
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// credentialsReaderAt records credentials found in the context of reads.
+type credentialsReaderAt struct {
+	name string
+	data []byte
+
+	mu    sync.Mutex
+	creds []interface{}
+}
+
+func (c *credentialsReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	c.mu.Lock()
+	c.creds = append(c.creds, EntryCredentials(ctx, c.name))
+	c.mu.Unlock()
+	return bytes.NewReader(c.data).ReadAt(p, off)
+}
+
+func (c *credentialsReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return c.ReadAtContext(context.Background(), p, off)
+}
+
+func TestEntryCredentials(t *testing.T) {
+	var backends []*credentialsReaderAt
+	tmpl := &Template{}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		data := []byte("content of " + name)
+		backend := &credentialsReaderAt{name: name, data: data}
+		backends = append(backends, backend)
+		tmpl.Entries = append(tmpl.Entries, &FileHeader{
+			Name:               name,
+			CRC32:              crc(data),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(data)),
+			Content:            backend,
+		})
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithEntryCredentials(r.Context(), "a.txt", "token-a")
+		ctx = WithEntryCredentials(ctx, "b.txt", "token-b")
+		ar.ServeHTTP(w, r.WithContext(ctx))
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	for i, want := range []string{"token-a", "token-b"} {
+		if len(backends[i].creds) == 0 {
+			t.Fatalf("%s: content was not read", backends[i].name)
+		}
+		for _, got := range backends[i].creds {
+			if got != want {
+				t.Errorf("%s: credentials %v, want %v", backends[i].name, got, want)
+			}
+		}
+	}
+
+	if got := EntryCredentials(context.Background(), "a.txt"); got != nil {
+		t.Errorf("credentials without WithEntryCredentials: %v", got)
+	}
+}
@@ -0,0 +1,209 @@
+package zipserve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FSOptions configures TemplateFromFS and TemplateFromDir.
+type FSOptions struct {
+	// CRC32, if not nil, is called for each regular file with its slash-separated path relative to the root.
+	// If it returns ok, the returned checksum is used, otherwise the checksum is computed by reading the file.
+	// Services that store checksums of their files can use it to avoid reading all the data up front.
+	CRC32 func(path string) (crc uint32, ok bool, err error)
+
+	// Include, if not empty, limits files in the template to those matching at least one of the patterns.
+	// Directories are included only if they contain an included file.
+	//
+	// Patterns have the syntax of path.Match. A pattern containing a slash is matched against the slash-separated
+	// path relative to the root, other patterns are matched against the last element of the path, so that "*.go"
+	// matches Go files in all directories.
+	Include []string
+
+	// Exclude lists patterns of files and directories to skip, with the same syntax as Include.
+	// Contents of excluded directories are skipped too. Exclude takes precedence over Include.
+	// For example, ".*" skips hidden files and directories including .git.
+	Exclude []string
+
+	// Filter, if not nil, is called for each file and directory not excluded by the patterns, with its
+	// slash-separated path relative to the root. If it returns false, the file is skipped; for directories,
+	// their contents are skipped too. It can be used to skip large files, for example.
+	Filter func(path string, info os.FileInfo) bool
+
+	// Files, if not nil, is used by TemplateFromDir to read files, so that open files are reused between reads
+	// and their number is limited. By default, a file is opened for each read. TemplateFromFS ignores Files.
+	Files *FilePool
+}
+
+// validatePatterns checks that Include and Exclude patterns are well-formed.
+func (o *FSOptions) validatePatterns() error {
+	for _, patterns := range [][]string{o.Include, o.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// skip reports whether the file with the given slash-separated path should not be added to the template
+// due to Exclude or Filter.
+func (o *FSOptions) skip(name string, info os.FileInfo) bool {
+	if matchAny(o.Exclude, name) {
+		return true
+	}
+	return o.Filter != nil && !o.Filter(name, info)
+}
+
+// matchAny reports whether name matches any of the patterns, see FSOptions.Include.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		subject := name
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneDirs removes directory entries that don't contain any file entries.
+func pruneDirs(entries []*FileHeader) []*FileHeader {
+	keep := make(map[string]bool)
+	for _, fh := range entries {
+		if strings.HasSuffix(fh.Name, "/") {
+			continue
+		}
+		for dir := path.Dir(fh.Name); dir != "."; dir = path.Dir(dir) {
+			keep[dir+"/"] = true
+		}
+	}
+	kept := entries[:0]
+	for _, fh := range entries {
+		if !strings.HasSuffix(fh.Name, "/") || keep[fh.Name] {
+			kept = append(kept, fh)
+		}
+	}
+	return kept
+}
+
+// TemplateFromDir creates a Template with entries for the contents of the directory root.
+//
+// Entries are named by their slash-separated paths relative to root and get the mode and modification time of
+// the files. Regular files are stored uncompressed; their content is read when the archive is served, opening the
+// file for each read unless opts.Files is set. Symbolic links are stored as links, with the link target as content, and are not followed.
+// Other kinds of files, like sockets or devices, are skipped. opts may be nil.
+func TemplateFromDir(root string, opts *FSOptions) (*Template, error) {
+	if opts == nil {
+		opts = &FSOptions{}
+	}
+	if err := opts.validatePatterns(); err != nil {
+		return nil, err
+	}
+	t := &Template{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		if path == root || !(mode.IsRegular() || mode.IsDir() || mode&os.ModeSymlink != 0) {
+			return nil
+		}
+		relpath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relpath)
+		if opts.skip(name, info) {
+			if mode.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !mode.IsDir() && len(opts.Include) > 0 && !matchAny(opts.Include, name) {
+			return nil
+		}
+		fh, err := FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		fh.Name = name
+		fh.Method = Store
+
+		switch {
+		case mode.IsDir():
+			fh.Name += "/"
+			fh.CompressedSize64 = 0
+			fh.UncompressedSize64 = 0
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			data := []byte(filepath.ToSlash(target))
+			fh.CRC32 = crc32.ChecksumIEEE(data)
+			fh.CompressedSize64 = uint64(len(data))
+			fh.UncompressedSize64 = uint64(len(data))
+			if len(data) > 0 {
+				fh.Content = bytes.NewReader(data)
+			}
+		default:
+			var content io.ReaderAt = dirFileReaderAt(path)
+			if opts.Files != nil {
+				content = opts.Files.File(path)
+			}
+			var ok bool
+			if opts.CRC32 != nil {
+				fh.CRC32, ok, err = opts.CRC32(fh.Name)
+				if err != nil {
+					return fmt.Errorf("file %q: %w", fh.Name, err)
+				}
+			}
+			if !ok {
+				hash := crc32.NewIEEE()
+				if _, err := io.Copy(hash, io.NewSectionReader(content, 0, info.Size())); err != nil {
+					return fmt.Errorf("file %q: %w", fh.Name, err)
+				}
+				fh.CRC32 = hash.Sum32()
+			}
+			if info.Size() > 0 {
+				fh.Content = content
+			}
+		}
+		t.Entries = append(t.Entries, fh)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Include) > 0 {
+		t.Entries = pruneDirs(t.Entries)
+	}
+	return t, nil
+}
+
+// dirFileReaderAt reads data of the file with the given path, opening the file for each read.
+type dirFileReaderAt string
+
+func (f dirFileReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return f.ReadAtContext(context.TODO(), p, off)
+}
+
+func (f dirFileReaderAt) ReadAtContext(_ context.Context, p []byte, off int64) (n int, err error) {
+	file, err := os.Open(string(f))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(p, off)
+}
@@ -0,0 +1,166 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTemplateFromDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "zipserve-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	modified := time.Date(2021, 5, 6, 7, 8, 10, 0, time.UTC)
+	files := map[string]string{
+		"README":         "read me\n",
+		"bin/run.sh":     "#!/bin/sh\necho hi\n",
+		"docs/guide.txt": "guide",
+		"docs/empty":     "",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(root, "bin", "run.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("run.sh", filepath.Join(root, "bin", "link")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	for _, name := range []string{"README", "bin/run.sh", "docs/guide.txt", "docs/empty", "bin", "docs"} {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var crcCalls []string
+	tmpl, err := TemplateFromDir(root, &FSOptions{
+		CRC32: func(path string) (uint32, bool, error) {
+			crcCalls = append(crcCalls, path)
+			return 0, false, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("TemplateFromDir: %v", err)
+	}
+	if len(crcCalls) != 4 {
+		t.Errorf("CRC32 called for %v, want 4 regular files", crcCalls)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatalf("NewArchive: %v", err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{name: "README", mode: 0644, data: files["README"]},
+		{name: "bin/", mode: os.ModeDir | 0755},
+		{name: "bin/link", mode: os.ModeSymlink | 0777, data: "run.sh"},
+		{name: "bin/run.sh", mode: 0755, data: files["bin/run.sh"]},
+		{name: "docs/", mode: os.ModeDir | 0755},
+		{name: "docs/empty", mode: 0644},
+		{name: "docs/guide.txt", mode: 0644, data: files["docs/guide.txt"]},
+	}
+	if len(r.File) != len(want) {
+		t.Fatalf("got %d files, want %d", len(r.File), len(want))
+	}
+	for i, w := range want {
+		f := r.File[i]
+		if f.Name != w.name {
+			t.Errorf("file %d: name %q, want %q", i, f.Name, w.name)
+			continue
+		}
+		if f.Mode() != w.mode {
+			t.Errorf("%s: mode %v, want %v", f.Name, f.Mode(), w.mode)
+		}
+		if f.Mode()&os.ModeSymlink == 0 && !f.Modified.Equal(modified) {
+			t.Errorf("%s: modified %v, want %v", f.Name, f.Modified, modified)
+		}
+		if w.mode.IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		if string(got) != w.data {
+			t.Errorf("%s: got %q, want %q", f.Name, got, w.data)
+		}
+	}
+
+	tmpl, err = TemplateFromDir(root, &FSOptions{Include: []string{"*.txt", "*.sh"}, Exclude: []string{"bin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fh := range tmpl.Entries {
+		names = append(names, fh.Name)
+	}
+	if wantNames := []string{"docs/", "docs/guide.txt"}; !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("filtered entries %q, want %q", names, wantNames)
+	}
+
+	pool := NewFilePool(1, time.Hour)
+	tmpl, err = TemplateFromDir(root, &FSOptions{Files: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.OpenFiles() != 1 {
+		t.Errorf("%d open files after computing checksums, want 1", pool.OpenFiles())
+	}
+	ar, err = NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zip.NewReader(ar, ar.Size()); err != nil {
+		t.Fatal(err)
+	}
+	pooled, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpooled, err := TemplateFromDir(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpooledAr, err := NewArchive(unpooled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := ioutil.ReadAll(io.NewSectionReader(unpooledAr, 0, unpooledAr.Size())); !bytes.Equal(pooled, want) {
+		t.Error("archive with pooled files differs")
+	}
+
+	errCRC := errors.New("no checksum")
+	_, err = TemplateFromDir(root, &FSOptions{
+		CRC32: func(path string) (uint32, bool, error) { return 0, false, errCRC },
+	})
+	if !errors.Is(err, errCRC) {
+		t.Errorf("error %v, want %v", err, errCRC)
+	}
+}
@@ -0,0 +1,182 @@
+package zipserve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// diskCacheBlockSize is the default size of blocks DiskCachingReaderAt reads from the upstream reader and caches.
+const diskCacheBlockSize = 1 << 20
+
+// DiskCachingReaderAt caches data read from an upstream reader in a local file.
+//
+// Data is read in blocks of 1 MiB unless configured otherwise. Each block read from the upstream reader is written
+// to the cache file at the same offset, so the file is sparse on file systems that support it. Subsequent reads of
+// the block are served from the file. Unlike CachingReaderAt, the cache is not limited in size and nothing is
+// evicted, so it is suitable for data that is downloaded repeatedly and fits on the local disk.
+//
+// Which blocks are cached is only tracked in memory; the cache file is not reused when the process restarts.
+// The upstream data must not change.
+//
+// DiskCachingReaderAt is safe for concurrent use as long as the upstream reader is.
+type DiskCachingReaderAt struct {
+	// counters are accessed atomically, keep them first for alignment on 32-bit platforms
+	hits          int64
+	misses        int64
+	cacheBytes    int64
+	upstreamBytes int64
+
+	r         ReaderAt
+	size      int64
+	blockSize int64
+	file      *os.File
+
+	mu     sync.Mutex
+	cached []bool // indexed by block
+}
+
+// NewDiskCachingReaderAt creates a new DiskCachingReaderAt caching the first size bytes of r in a file created
+// at path, in blocks of blockSize bytes. If blockSize is not positive, the default of 1 MiB is used.
+//
+// An existing file at path is truncated. Close removes the file.
+//
+// r may implement ReaderAt interface from this package, in that case r's ReadAtContext method will be called
+// instead of ReadAt.
+func NewDiskCachingReaderAt(r io.ReaderAt, size int64, path string, blockSize int) (*DiskCachingReaderAt, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("negative size %d", size)
+	}
+	if blockSize <= 0 {
+		blockSize = diskCacheBlockSize
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	blocks := (size + int64(blockSize) - 1) / int64(blockSize)
+	return &DiskCachingReaderAt{
+		r:         readerAt(r),
+		size:      size,
+		blockSize: int64(blockSize),
+		file:      f,
+		cached:    make([]bool, blocks),
+	}, nil
+}
+
+// Size returns the size of the cached data.
+func (c *DiskCachingReaderAt) Size() int64 { return c.size }
+
+// Stats returns the statistics of cache usage.
+func (c *DiskCachingReaderAt) Stats() CacheStats {
+	return CacheStats{
+		Hits:          atomic.LoadInt64(&c.hits),
+		Misses:        atomic.LoadInt64(&c.misses),
+		CacheBytes:    atomic.LoadInt64(&c.cacheBytes),
+		UpstreamBytes: atomic.LoadInt64(&c.upstreamBytes),
+	}
+}
+
+// Close closes and removes the cache file.
+func (c *DiskCachingReaderAt) Close() error {
+	err := c.file.Close()
+	if err2 := os.Remove(c.file.Name()); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// ReadAt reads data through the cache.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (c *DiskCachingReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return c.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data through the cache.
+//
+// This methods implements ReaderAt interface.
+func (c *DiskCachingReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	eof := false
+	if max := c.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = true
+	}
+	for len(p) > 0 {
+		index := off / c.blockSize
+		blockEnd := (index + 1) * c.blockSize
+		if blockEnd > c.size {
+			blockEnd = c.size
+		}
+		part := p
+		if max := blockEnd - off; int64(len(part)) > max {
+			part = part[:max]
+		}
+		var n2 int
+		if c.isCached(index) {
+			atomic.AddInt64(&c.hits, 1)
+			n2, err = c.file.ReadAt(part, off)
+			atomic.AddInt64(&c.cacheBytes, int64(n2))
+		} else {
+			n2, err = c.fetch(ctx, index, part, off)
+		}
+		n += n2
+		if err != nil {
+			return n, err
+		}
+		p = p[n2:]
+		off += int64(n2)
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *DiskCachingReaderAt) isCached(index int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cached[index]
+}
+
+// fetch reads the block with the given index from the upstream reader, writes it to the cache file and copies
+// the part of it at off to p.
+func (c *DiskCachingReaderAt) fetch(ctx context.Context, index int64, p []byte, off int64) (int, error) {
+	atomic.AddInt64(&c.misses, 1)
+	start := index * c.blockSize
+	end := start + c.blockSize
+	if end > c.size {
+		end = c.size
+	}
+	buf := make([]byte, end-start)
+	// the upstream reader may report io.EOF together with the last block, so only a short read is an error
+	n, err := c.r.ReadAtContext(ctx, buf, start)
+	if n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	// if the block can't be written to the cache file, it is read from upstream again next time
+	if _, err := c.file.WriteAt(buf, start); err == nil {
+		c.mu.Lock()
+		c.cached[index] = true
+		c.mu.Unlock()
+	}
+	n = copy(p, buf[off-start:])
+	atomic.AddInt64(&c.upstreamBytes, int64(n))
+	return n, nil
+}
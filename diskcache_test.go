@@ -0,0 +1,107 @@
+package zipserve
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDiskCachingReaderAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(4)).Read(data)
+	upstream := &countingReaderAt{r: bytes.NewReader(data)}
+	c, err := NewDiskCachingReaderAt(upstream, int64(len(data)), path, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 5000)
+	for i := 0; i < 2; i++ {
+		n, err := c.ReadAt(p, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], data[1000:6000]) {
+			t.Fatal("data mismatch")
+		}
+	}
+	if len(upstream.reads) != 2 || upstream.reads[0] != 4096 || upstream.reads[1] != 4096 {
+		t.Errorf("upstream reads %v, want [4096 4096]", upstream.reads)
+	}
+	if got, want := c.Stats(), (CacheStats{Hits: 2, Misses: 2, CacheBytes: 5000, UpstreamBytes: 5000}); got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+
+	n, err := c.ReadAt(p, 9000)
+	if n != 1000 || err != io.EOF || !bytes.Equal(p[:n], data[9000:]) {
+		t.Errorf("reading over the end: got %d, %v, want 1000, EOF", n, err)
+	}
+	n, err = c.ReadAt(p[:1000], 9000)
+	if n != 1000 || err != nil || !bytes.Equal(p[:n], data[9000:]) {
+		t.Errorf("reading cached last block: got %d, %v, want 1000, nil", n, err)
+	}
+	if len(upstream.reads) != 3 || upstream.reads[2] != 10000-2*4096 {
+		t.Errorf("upstream reads %v, want last block read once", upstream.reads)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cache file not removed: %v", err)
+	}
+}
+
+func TestDiskCachingReaderAtConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(5)).Read(data)
+	c, err := NewDiskCachingReaderAt(bytes.NewReader(data), int64(len(data)), filepath.Join(dir, "cache"), 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 100; i++ {
+				off := rnd.Int63n(int64(len(data)))
+				size := rnd.Int63n(10000)
+				if off+size > int64(len(data)) {
+					size = int64(len(data)) - off
+				}
+				p := make([]byte, size)
+				if _, err := c.ReadAt(p, off); err != nil {
+					t.Errorf("ReadAt(%d, %d): %v", off, size, err)
+					return
+				}
+				if !bytes.Equal(p, data[off:off+size]) {
+					t.Errorf("ReadAt(%d, %d): data mismatch", off, size)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+}
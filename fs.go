@@ -0,0 +1,125 @@
+//go:build go1.16
+// +build go1.16
+
+package zipserve
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"io/ioutil"
+)
+
+// TemplateFromFS creates a Template with entries for regular files and directories in fsys.
+//
+// Entries are named by their slash-separated paths in fsys and get the mode and modification time of the files.
+// Files are stored uncompressed; their content is read from fsys when the archive is served, opening the file for
+// each read. Other kinds of files, like symbolic links, are skipped. opts may be nil.
+func TemplateFromFS(fsys fs.FS, opts *FSOptions) (*Template, error) {
+	if opts == nil {
+		opts = &FSOptions{}
+	}
+	if err := opts.validatePatterns(); err != nil {
+		return nil, err
+	}
+	t := &Template{}
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." || !(d.Type().IsRegular() || d.IsDir()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if opts.skip(path, info) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && len(opts.Include) > 0 && !matchAny(opts.Include, path) {
+			return nil
+		}
+		fh, err := FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		fh.Name = path
+		fh.Method = Store
+		if d.IsDir() {
+			fh.Name += "/"
+			fh.CompressedSize64 = 0
+			fh.UncompressedSize64 = 0
+			t.Entries = append(t.Entries, fh)
+			return nil
+		}
+
+		content := fsFileReaderAt{fsys: fsys, name: path}
+		var ok bool
+		if opts.CRC32 != nil {
+			fh.CRC32, ok, err = opts.CRC32(path)
+			if err != nil {
+				return fmt.Errorf("file %q: %w", path, err)
+			}
+		}
+		if !ok {
+			hash := crc32.NewIEEE()
+			if _, err := io.Copy(hash, io.NewSectionReader(content, 0, info.Size())); err != nil {
+				return fmt.Errorf("file %q: %w", path, err)
+			}
+			fh.CRC32 = hash.Sum32()
+		}
+		if info.Size() > 0 {
+			fh.Content = content
+		}
+		t.Entries = append(t.Entries, fh)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Include) > 0 {
+		t.Entries = pruneDirs(t.Entries)
+	}
+	return t, nil
+}
+
+// fsFileReaderAt reads data of a file in fs.FS, opening the file for each read.
+type fsFileReaderAt struct {
+	fsys fs.FS
+	name string
+}
+
+func (f fsFileReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return f.ReadAtContext(context.TODO(), p, off)
+}
+
+func (f fsFileReaderAt) ReadAtContext(_ context.Context, p []byte, off int64) (n int, err error) {
+	file, err := f.fsys.Open(f.name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	switch r := file.(type) {
+	case io.ReaderAt:
+		return r.ReadAt(p, off)
+	case io.Seeker:
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+	default:
+		if _, err := io.CopyN(ioutil.Discard, file, off); err != nil {
+			return 0, err
+		}
+	}
+	n, err = io.ReadFull(file, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
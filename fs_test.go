@@ -0,0 +1,222 @@
+//go:build go1.16
+// +build go1.16
+
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// readOnlyFS hides io.ReaderAt and io.Seeker implementations of files.
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+func (r readOnlyFS) Open(name string) (fs.File, error) {
+	f, err := r.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyFile{f}, nil
+}
+
+type readOnlyFile struct {
+	fs.File
+}
+
+func (f readOnlyFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	return f.File.(fs.ReadDirFile).ReadDir(n)
+}
+
+func TestTemplateFromFS(t *testing.T) {
+	modified := time.Date(2021, 5, 6, 7, 8, 10, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"README":          {Data: []byte("read me\n"), Mode: 0644, ModTime: modified},
+		"bin":             {Mode: fs.ModeDir | 0755, ModTime: modified},
+		"bin/run.sh":      {Data: []byte("#!/bin/sh\necho hi\n"), Mode: 0755, ModTime: modified},
+		"bin/link":        {Data: []byte("run.sh"), Mode: fs.ModeSymlink | 0777, ModTime: modified},
+		"empty/.keep":     {Mode: 0600, ModTime: modified},
+		"empty":           {Mode: fs.ModeDir | 0700, ModTime: modified},
+		"docs/guide.txt":  {Data: []byte("guide"), Mode: 0644, ModTime: modified},
+		"docs":            {Mode: fs.ModeDir | 0755, ModTime: modified},
+		"docs/large.data": {Data: make([]byte, 100000), Mode: 0644, ModTime: modified},
+	}
+	want := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{name: "README", mode: 0644},
+		{name: "bin/", mode: os.ModeDir | 0755},
+		{name: "bin/run.sh", mode: 0755},
+		{name: "docs/", mode: os.ModeDir | 0755},
+		{name: "docs/guide.txt", mode: 0644},
+		{name: "docs/large.data", mode: 0644},
+		{name: "empty/", mode: os.ModeDir | 0700},
+		{name: "empty/.keep", mode: 0600},
+	}
+
+	for name, fsys := range map[string]fs.FS{"MapFS": fsys, "read only": readOnlyFS{fsys}} {
+		t.Run(name, func(t *testing.T) {
+			var crcCalls []string
+			tmpl, err := TemplateFromFS(fsys, &FSOptions{
+				CRC32: func(path string) (uint32, bool, error) {
+					crcCalls = append(crcCalls, path)
+					if path == "README" {
+						return crc([]byte("read me\n")), true, nil
+					}
+					return 0, false, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("TemplateFromFS: %v", err)
+			}
+			if len(crcCalls) != 5 {
+				t.Errorf("CRC32 called for %v, want 5 regular files", crcCalls)
+			}
+			ar, err := NewArchive(tmpl)
+			if err != nil {
+				t.Fatalf("NewArchive: %v", err)
+			}
+			r, err := zip.NewReader(ar, ar.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.File) != len(want) {
+				t.Fatalf("got %d files, want %d", len(r.File), len(want))
+			}
+			for i, w := range want {
+				f := r.File[i]
+				if f.Name != w.name {
+					t.Errorf("file %d: name %q, want %q", i, f.Name, w.name)
+					continue
+				}
+				if f.Mode() != w.mode {
+					t.Errorf("%s: mode %v, want %v", f.Name, f.Mode(), w.mode)
+				}
+				if !f.Modified.Equal(modified) {
+					t.Errorf("%s: modified %v, want %v", f.Name, f.Modified, modified)
+				}
+				if w.mode.IsDir() {
+					continue
+				}
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatalf("%s: %v", f.Name, err)
+				}
+				wantData, err := fs.ReadFile(fsys, w.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, wantData) {
+					t.Errorf("%s: content differs", f.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplateFromFSErrors(t *testing.T) {
+	fsys := fstest.MapFS{"file.txt": {Data: []byte("data")}}
+	errCRC := errors.New("no checksum")
+	_, err := TemplateFromFS(fsys, &FSOptions{
+		CRC32: func(path string) (uint32, bool, error) { return 0, false, errCRC },
+	})
+	if !errors.Is(err, errCRC) {
+		t.Errorf("error %v, want %v", err, errCRC)
+	}
+
+	tmpl, err := TemplateFromFS(fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(fsys, "file.txt")
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size())); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("reading removed file: %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestTemplateFromFSFilters(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.go":            {Data: []byte("package main")},
+		"main_test.go":       {Data: []byte("package main")},
+		".hidden":            {Data: []byte("secret")},
+		".git/config":        {Data: []byte("[core]")},
+		"cmd/tool/tool.go":   {Data: []byte("package main")},
+		"docs/readme.txt":    {Data: []byte("docs")},
+		"docs/large.bin":     {Data: make([]byte, 1000)},
+		"vendor/lib/lib.go":  {Data: []byte("package lib")},
+		"vendor/lib/LICENSE": {Data: []byte("license")},
+	}
+	tests := []struct {
+		name  string
+		opts  FSOptions
+		names []string
+	}{
+		{
+			name: "exclude",
+			opts: FSOptions{Exclude: []string{".*", "vendor"}},
+			names: []string{"cmd/", "cmd/tool/", "cmd/tool/tool.go", "docs/", "docs/large.bin", "docs/readme.txt",
+				"main.go", "main_test.go"},
+		},
+		{
+			name:  "include",
+			opts:  FSOptions{Include: []string{"*.go"}, Exclude: []string{"*_test.go", "vendor/*"}},
+			names: []string{"cmd/", "cmd/tool/", "cmd/tool/tool.go", "main.go"},
+		},
+		{
+			name:  "include path",
+			opts:  FSOptions{Include: []string{"docs/*"}},
+			names: []string{"docs/", "docs/large.bin", "docs/readme.txt"},
+		},
+		{
+			name: "filter",
+			opts: FSOptions{
+				Exclude: []string{".git"},
+				Filter: func(path string, info fs.FileInfo) bool {
+					return info.Size() < 100 && path != "vendor"
+				},
+			},
+			names: []string{".hidden", "cmd/", "cmd/tool/", "cmd/tool/tool.go", "docs/", "docs/readme.txt",
+				"main.go", "main_test.go"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := TemplateFromFS(fsys, &test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, fh := range tmpl.Entries {
+				names = append(names, fh.Name)
+			}
+			if !reflect.DeepEqual(names, test.names) {
+				t.Errorf("entries %q, want %q", names, test.names)
+			}
+		})
+	}
+
+	if _, err := TemplateFromFS(fsys, &FSOptions{Include: []string{"["}}); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("error %v, want %v", err, path.ErrBadPattern)
+	}
+}
@@ -0,0 +1,102 @@
+package zipserve
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// Git object modes as stored in tree objects.
+const (
+	GitModeDir        = 0040000
+	GitModeFile       = 0100644
+	GitModeExecutable = 0100755
+	GitModeSymlink    = 0120000
+	GitModeSubmodule  = 0160000
+)
+
+// GitTreeEntry is an entry of a recursive git tree listing, as printed by git ls-tree -r -t.
+type GitTreeEntry struct {
+	// Path is the slash-separated path of the entry relative to the root of the tree.
+	Path string
+	// Mode is the git mode of the entry, one of GitMode* constants.
+	Mode uint32
+	// OID is the object id of the entry.
+	OID string
+}
+
+// GitBlob is the content of a git blob.
+type GitBlob struct {
+	// Content is the data of the blob.
+	Content io.ReaderAt
+	// Size is the size of the blob in bytes.
+	Size int64
+	// CRC32 is a checksum of the blob data. It is used only if HasCRC32 is true,
+	// otherwise the checksum is computed by reading Content.
+	CRC32    uint32
+	HasCRC32 bool
+}
+
+// GitBlobResolver returns the blob with the given object id.
+type GitBlobResolver func(oid string) (GitBlob, error)
+
+// TemplateFromGitTree creates a Template with entries from a git tree listing.
+//
+// Regular files, executables and symbolic links are stored uncompressed with content of the blobs returned by
+// resolve. Directories and submodules are stored as directory entries. All entries have modification time set to
+// modified, which is usually the commit time.
+func TemplateFromGitTree(entries []GitTreeEntry, modified time.Time, resolve GitBlobResolver) (*Template, error) {
+	t := &Template{
+		Entries:    make([]*FileHeader, 0, len(entries)),
+		CreateTime: modified,
+	}
+	for _, entry := range entries {
+		var mode os.FileMode
+		switch entry.Mode {
+		case GitModeDir, GitModeSubmodule:
+			mode = os.ModeDir | 0755
+		case GitModeFile:
+			mode = 0644
+		case GitModeExecutable:
+			mode = 0755
+		case GitModeSymlink:
+			mode = os.ModeSymlink | 0777
+		default:
+			return nil, fmt.Errorf("git entry %q: unsupported mode %o", entry.Path, entry.Mode)
+		}
+		fh := &FileHeader{
+			Name:     entry.Path,
+			Method:   Store,
+			Modified: modified,
+		}
+		fh.SetMode(mode)
+		if mode.IsDir() {
+			fh.Name += "/"
+			t.Entries = append(t.Entries, fh)
+			continue
+		}
+
+		blob, err := resolve(entry.OID)
+		if err != nil {
+			return nil, fmt.Errorf("git entry %q: %w", entry.Path, err)
+		}
+		if !blob.HasCRC32 {
+			hash := crc32.NewIEEE()
+			_, err := io.Copy(hash, io.NewSectionReader(blob.Content, 0, blob.Size))
+			if err != nil {
+				return nil, fmt.Errorf("git entry %q: %w", entry.Path, err)
+			}
+			blob.CRC32 = hash.Sum32()
+		}
+		if blob.Size > 0 {
+			fh.Content = blob.Content
+		}
+		fh.CRC32 = blob.CRC32
+		fh.CompressedSize64 = uint64(blob.Size)
+		fh.UncompressedSize64 = uint64(blob.Size)
+		t.Entries = append(t.Entries, fh)
+	}
+	return t, nil
+}
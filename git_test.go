@@ -0,0 +1,93 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTemplateFromGitTree(t *testing.T) {
+	blobs := map[string]string{
+		"1111": "package main\n",
+		"2222": "#!/bin/sh\necho hi\n",
+		"3333": "../main.go",
+	}
+	tree := []GitTreeEntry{
+		{Path: "main.go", Mode: GitModeFile, OID: "1111"},
+		{Path: "scripts", Mode: GitModeDir, OID: "aaaa"},
+		{Path: "scripts/run.sh", Mode: GitModeExecutable, OID: "2222"},
+		{Path: "scripts/main.go", Mode: GitModeSymlink, OID: "3333"},
+		{Path: "vendor/lib", Mode: GitModeSubmodule, OID: "bbbb"},
+	}
+	want := []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{name: "main.go", mode: 0644, data: blobs["1111"]},
+		{name: "scripts/", mode: os.ModeDir | 0755},
+		{name: "scripts/run.sh", mode: 0755, data: blobs["2222"]},
+		{name: "scripts/main.go", mode: os.ModeSymlink | 0777, data: blobs["3333"]},
+		{name: "vendor/lib/", mode: os.ModeDir | 0755},
+	}
+	resolve := func(oid string) (GitBlob, error) {
+		data, ok := blobs[oid]
+		if !ok {
+			return GitBlob{}, errors.New("unknown blob")
+		}
+		blob := GitBlob{Content: bytes.NewReader([]byte(data)), Size: int64(len(data))}
+		if oid == "1111" {
+			blob.CRC32 = crc([]byte(data))
+			blob.HasCRC32 = true
+		}
+		return blob, nil
+	}
+	modified := time.Date(2021, 5, 6, 7, 8, 10, 0, time.UTC)
+
+	tmpl, err := TemplateFromGitTree(tree, modified, resolve)
+	if err != nil {
+		t.Fatalf("TemplateFromGitTree: %v", err)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatalf("NewArchive: %v", err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if len(r.File) != len(want) {
+		t.Fatalf("got %d files, want %d", len(r.File), len(want))
+	}
+	for i, w := range want {
+		f := r.File[i]
+		if f.Name != w.name {
+			t.Errorf("file %d: name %q, want %q", i, f.Name, w.name)
+		}
+		testFileMode(t, f, w.mode)
+		if !f.Modified.Equal(modified) {
+			t.Errorf("%s: modified %v, want %v", f.Name, f.Modified, modified)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("%s: open: %v", f.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: read: %v", f.Name, err)
+		}
+		if string(data) != w.data {
+			t.Errorf("%s: data %q, want %q", f.Name, data, w.data)
+		}
+	}
+
+	_, err = TemplateFromGitTree([]GitTreeEntry{{Path: "x", Mode: GitModeFile, OID: "ffff"}}, modified, resolve)
+	if err == nil {
+		t.Error("expected error for unknown blob, got nil")
+	}
+}
@@ -0,0 +1,171 @@
+package zipserve
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"time"
+)
+
+// handlerConfig is the configuration of serving an archive over HTTP.
+//
+// Archive embeds the configuration from Template, used by ServeHTTP and ServeEntry. Handler serves the archive
+// with a copy of it modified by HandlerOptions.
+type handlerConfig struct {
+	// name is the file name of the archive passed to http.ServeContent, see Template.DownloadName.
+	name string
+	// typeOverride is Template.ContentType.
+	typeOverride string
+	// contentType is the value of the Content-Type header sent by ServeHTTP.
+	contentType string
+	// contentDisposition is the value of the Content-Disposition header sent by ServeHTTP, if not empty.
+	contentDisposition string
+	cacheControl       string
+	expiresAfter       time.Duration
+	header             http.Header
+	serveTimeout       time.Duration
+	errorHandler       func(w http.ResponseWriter, r *http.Request, err error)
+	// maxRanges limits the number of ranges in a request, zero if unlimited.
+	maxRanges int
+	// maxRequestRate limits the rate of each response body in bytes per second, zero if unlimited.
+	maxRequestRate int64
+	// archiveLimiter limits the total rate of response bodies, nil if unlimited.
+	archiveLimiter *rateLimiter
+	// logger receives messages about problems, nil if not logged.
+	logger Logger
+	// onError is called when reading data fails while serving a request.
+	onError func(r *http.Request, entryName string, offset int64, err error)
+}
+
+// setDownloadName sets the file name of the archive and the Content-Disposition header derived from it.
+func (c *handlerConfig) setDownloadName(name string) {
+	c.name = name
+	c.contentDisposition = ""
+	if name != "" {
+		c.contentDisposition = attachmentDisposition(name)
+	}
+}
+
+// resolveContentType sets contentType from typeOverride or the extension of name, see Template.ContentType.
+func (c *handlerConfig) resolveContentType() {
+	c.contentType = c.typeOverride
+	if c.contentType == "" && c.name != "" {
+		c.contentType = mime.TypeByExtension(path.Ext(c.name))
+	}
+	if c.contentType == "" {
+		c.contentType = "application/zip"
+	}
+}
+
+// HandlerOption changes how a handler created by Archive.Handler serves the archive.
+//
+// Options override the configuration from the Template the archive was created from.
+type HandlerOption func(c *handlerConfig)
+
+// WithDownloadName sets the file name suggested to clients in the Content-Disposition header,
+// see Template.DownloadName. An empty name disables the header.
+func WithDownloadName(name string) HandlerOption {
+	return func(c *handlerConfig) { c.setDownloadName(name) }
+}
+
+// WithContentType sets the Content-Type header, see Template.ContentType.
+func WithContentType(contentType string) HandlerOption {
+	return func(c *handlerConfig) { c.typeOverride = contentType }
+}
+
+// WithCacheControl sets the Cache-Control header sent with the content, see Template.CacheControl.
+func WithCacheControl(value string) HandlerOption {
+	return func(c *handlerConfig) { c.cacheControl = value }
+}
+
+// WithExpiresAfter sets the Expires header sent with the content relative to the time of the request,
+// see Template.ExpiresAfter.
+func WithExpiresAfter(d time.Duration) HandlerOption {
+	return func(c *handlerConfig) { c.expiresAfter = d }
+}
+
+// WithHeader adds headers to every response, see Template.Header.
+// Values of headers also present in Template.Header replace the values from the template.
+func WithHeader(h http.Header) HandlerOption {
+	return func(c *handlerConfig) {
+		merged := c.header.Clone()
+		if merged == nil {
+			merged = make(http.Header, len(h))
+		}
+		for name, values := range h {
+			merged[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+		c.header = merged
+	}
+}
+
+// WithMaxRequestRate limits the rate of each response body in bytes per second, see Template.MaxRequestRate.
+// Zero means no limit.
+func WithMaxRequestRate(bytesPerSecond int64) HandlerOption {
+	return func(c *handlerConfig) { c.maxRequestRate = bytesPerSecond }
+}
+
+// WithMaxArchiveRate limits the total rate of response bodies sent by the handler in bytes per second,
+// see Template.MaxArchiveRate. The limit is separate from the one of the archive and other handlers.
+// Zero means no limit.
+func WithMaxArchiveRate(bytesPerSecond int64) HandlerOption {
+	return func(c *handlerConfig) {
+		c.archiveLimiter = nil
+		if bytesPerSecond > 0 {
+			c.archiveLimiter = newRateLimiter(bytesPerSecond)
+		}
+	}
+}
+
+// WithMaxRanges limits the number of ranges per request, see Template.MaxRanges. Zero means no limit.
+func WithMaxRanges(n int) HandlerOption {
+	return func(c *handlerConfig) { c.maxRanges = n }
+}
+
+// WithServeTimeout limits the time spent serving a single request, see Template.ServeTimeout.
+// Zero means no limit.
+func WithServeTimeout(d time.Duration) HandlerOption {
+	return func(c *handlerConfig) { c.serveTimeout = d }
+}
+
+// WithErrorHandler sets the function writing the response when reading the archive fails,
+// see Template.ErrorHandler.
+func WithErrorHandler(f func(w http.ResponseWriter, r *http.Request, err error)) HandlerOption {
+	return func(c *handlerConfig) { c.errorHandler = f }
+}
+
+// WithLogger sets the logger receiving failed reads and malformed requests, see Template.Logger.
+// A nil logger disables logging.
+func WithLogger(logger Logger) HandlerOption {
+	return func(c *handlerConfig) { c.logger = logger }
+}
+
+// WithOnError sets the function called when reading the archive fails, see Template.OnError.
+func WithOnError(f func(r *http.Request, entryName string, offset int64, err error)) HandlerOption {
+	return func(c *handlerConfig) { c.onError = f }
+}
+
+// Handler returns a handler serving the archive like ServeHTTP, with the configuration from the Template
+// changed by opts. This allows serving one archive at multiple mount points with different policies,
+// for example a public endpoint cached by a CDN and a throttled one for internal tools.
+//
+// Hooks and limits not covered by the options, like Authorize, Metrics and MaxConcurrentRequests, are shared
+// with ServeHTTP.
+func (ar *Archive) Handler(opts ...HandlerOption) http.Handler {
+	h := &archiveHandler{ar: ar, config: ar.handlerConfig}
+	for _, opt := range opts {
+		opt(&h.config)
+	}
+	h.config.resolveContentType()
+	return h
+}
+
+// archiveHandler serves an archive with its own configuration, see Archive.Handler.
+type archiveHandler struct {
+	ar     *Archive
+	config handlerConfig
+}
+
+func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.ar.serveHTTP(w, r, &h.config)
+}
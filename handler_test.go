@@ -0,0 +1,113 @@
+package zipserve
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestArchiveHandler(t *testing.T) {
+	logger := &recordingLogger{}
+	tmpl := metricsTestTemplate(nil, failingReaderAt{err: errors.New("backend failure")})
+	tmpl.Logger = logger
+	tmpl.CacheControl = "public, max-age=3600"
+	tmpl.DownloadName = "archive.zip"
+	tmpl.Header = http.Header{"X-Archive": {"photos"}, "X-Mount": {"default"}}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.messages = nil
+
+	h := ar.Handler(
+		WithCacheControl("no-store"),
+		WithDownloadName("issue 1.cbz"),
+		WithContentType("application/vnd.comicbook+zip"),
+		WithHeader(http.Header{"x-mount": {"internal"}}),
+		WithLogger(nil),
+		WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, "storage unavailable", http.StatusBadGateway)
+		}),
+	)
+
+	head := func(h http.Handler) http.Header {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("status %d, want %d", rec.Code, http.StatusOK)
+		}
+		return rec.Header()
+	}
+	want := map[string]string{
+		"Cache-Control":       "no-store",
+		"Content-Disposition": `attachment; filename="issue 1.cbz"`,
+		"Content-Type":        "application/vnd.comicbook+zip",
+		"X-Archive":           "photos",
+		"X-Mount":             "internal",
+		"Etag":                ar.ETag(),
+	}
+	got := head(h)
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("handler: %s %q, want %q", name, got.Get(name), value)
+		}
+	}
+
+	// the archive itself keeps the configuration from the template
+	want = map[string]string{
+		"Cache-Control":       "public, max-age=3600",
+		"Content-Disposition": `attachment; filename="archive.zip"`,
+		"Content-Type":        "application/zip",
+		"X-Mount":             "default",
+	}
+	got = head(ar)
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("archive: %s %q, want %q", name, got.Get(name), value)
+		}
+	}
+	if !reflect.DeepEqual(tmpl.Header["X-Mount"], []string{"default"}) {
+		t.Errorf("template header changed to %q", tmpl.Header["X-Mount"])
+	}
+
+	start := ar.entryRanges[1].contentStart
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+99))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("failed read: status %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if len(logger.messages) != 0 {
+		t.Errorf("messages %q logged by handler without logger", logger.messages)
+	}
+
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+	if len(logger.messages) != 1 {
+		t.Errorf("messages %q logged by archive, want one", logger.messages)
+	}
+}
+
+func TestArchiveHandlerRate(t *testing.T) {
+	tmpl := metricsTestTemplate(nil, nil)
+	tmpl.MaxArchiveRate = 1000
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlimited := ar.Handler(WithMaxArchiveRate(0)).(*archiveHandler)
+	if unlimited.config.archiveLimiter != nil {
+		t.Error("handler without rate limit uses a limiter")
+	}
+	limited := ar.Handler(WithMaxArchiveRate(5000)).(*archiveHandler)
+	if limited.config.archiveLimiter == nil || limited.config.archiveLimiter == ar.archiveLimiter {
+		t.Error("handler with its own rate limit shares the limiter of the archive")
+	}
+	shared := ar.Handler().(*archiveHandler)
+	if shared.config.archiveLimiter != ar.archiveLimiter {
+		t.Error("handler without options does not share the limiter of the archive")
+	}
+}
@@ -1,6 +1,7 @@
 package zipserve
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -13,17 +14,37 @@ type ReaderAt interface {
 	ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error)
 }
 
-type sizeReaderAt interface {
+// SizedReaderAt is an io.ReaderAt with known size.
+type SizedReaderAt interface {
 	io.ReaderAt
 	Size() int64
 }
 
+// CRC32Provider is implemented by Content that knows the CRC32 checksum of its data,
+// for example from metadata of an object store.
+//
+// If FileHeader.CRC32 is zero and Content implements CRC32Provider, NewArchive uses the CRC32 method to fill it in.
+type CRC32Provider interface {
+	// CRC32 returns the CRC-32 checksum of the uncompressed data using the IEEE polynomial,
+	// as computed by hash/crc32.ChecksumIEEE. Note that CRC-32C (Castagnoli) used by some stores is different.
+	CRC32() uint32
+}
+
+// sizeReaderAtContext is a ReaderAt with known size.
+type sizeReaderAtContext interface {
+	ReaderAt
+	Size() int64
+}
+
 type offsetAndData struct {
 	offset int64
 	data   ReaderAt
 }
 
 // multiReaderAt is a ReaderAt that joins multiple ReaderAt sequentially together.
+//
+// Reading past the end of the multiReaderAt returns io.EOF, while a part that returns io.EOF before its declared
+// size is reached results in io.ErrUnexpectedEOF.
 type multiReaderAt struct {
 	parts []offsetAndData
 	size  int64
@@ -45,8 +66,8 @@ func (mcr *multiReaderAt) add(data ReaderAt, size int64) {
 	mcr.size += size
 }
 
-// addSizeReaderAt is like add, but takes sizeReaderAt
-func (mcr *multiReaderAt) addSizeReaderAt(r sizeReaderAt) {
+// addSizeReaderAt is like add, but takes SizedReaderAt
+func (mcr *multiReaderAt) addSizeReaderAt(r SizedReaderAt) {
 	mcr.add(ignoreContext{r: r}, r.Size())
 }
 
@@ -80,7 +101,14 @@ func (mcr *multiReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64
 		}
 		n2, err2 := mcr.parts[partIndex].data.ReadAtContext(ctx, p[0:sizeToRead], off-mcr.parts[partIndex].offset)
 		n += n2
-		if err2 != nil {
+		if int64(n2) < sizeToRead {
+			// the part is shorter than its declared size, the archive data is corrupted
+			if err2 == nil || err2 == io.EOF {
+				err2 = io.ErrUnexpectedEOF
+			}
+			return n, err2
+		}
+		if err2 != nil && err2 != io.EOF {
 			return n, err2
 		}
 		p = p[n2:]
@@ -109,6 +137,105 @@ func (a ignoreContext) ReadAtContext(_ context.Context, p []byte, off int64) (n
 	return a.r.ReadAt(p, off)
 }
 
+// transformReaderAt applies a transformation to data read from r.
+type transformReaderAt struct {
+	r         ReaderAt
+	transform func(ctx context.Context, p []byte, off int64) error
+}
+
+func (t transformReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	n, err = t.r.ReadAtContext(ctx, p, off)
+	if n > 0 {
+		if terr := t.transform(ctx, p[:n], off); terr != nil {
+			return 0, terr
+		}
+	}
+	return n, err
+}
+
+// bytesReaderAt converts *bytes.Reader to sizeReaderAtContext.
+type bytesReaderAt struct {
+	r *bytes.Reader
+}
+
+func (b bytesReaderAt) ReadAtContext(_ context.Context, p []byte, off int64) (n int, err error) {
+	return b.r.ReadAt(p, off)
+}
+
+func (b bytesReaderAt) Size() int64 {
+	return b.r.Size()
+}
+
+// PartReadError is returned from reads of an archive when the content of an entry is shorter than
+// its declared CompressedSize64, for example because the object in the backing store was truncated.
+type PartReadError struct {
+	// Entry is the name of the entry.
+	Entry string
+	// Offset is the offset within the content of the entry where the data ended.
+	Offset int64
+	// Err is the underlying error, io.ErrUnexpectedEOF.
+	Err error
+}
+
+func (e *PartReadError) Error() string {
+	return fmt.Sprintf("zipserve: content of entry %q ends at offset %d: %v", e.Entry, e.Offset, e.Err)
+}
+
+func (e *PartReadError) Unwrap() error {
+	return e.Err
+}
+
+// entryContentReaderAt reports content of an entry shorter than its declared size as PartReadError.
+type entryContentReaderAt struct {
+	r    ReaderAt
+	name string
+	size int64
+}
+
+func (e entryContentReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	n, err = e.r.ReadAtContext(ctx, p, off)
+	if n < len(p) && off+int64(len(p)) <= e.size && (err == nil || err == io.EOF) {
+		return n, &PartReadError{Entry: e.name, Offset: off + int64(n), Err: io.ErrUnexpectedEOF}
+	}
+	return n, err
+}
+
+// fetchLimitReaderAt limits the number of concurrent reads from r
+// to the capacity of fetches, shared by all readers limited together.
+type fetchLimitReaderAt struct {
+	r       ReaderAt
+	fetches chan struct{}
+}
+
+func (f fetchLimitReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	select {
+	case f.fetches <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	defer func() { <-f.fetches }()
+	return f.r.ReadAtContext(ctx, p, off)
+}
+
+// zeroReaderAt reads size zero bytes.
+type zeroReaderAt struct {
+	size int64
+}
+
+func (z zeroReaderAt) ReadAtContext(_ context.Context, p []byte, off int64) (n int, err error) {
+	if off >= z.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > z.size-off {
+		p = p[:z.size-off]
+		err = io.EOF
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), err
+}
+
 // withContext converts ReaderAt to io.ReaderAt.
 //
 // While usually we shouldn't store context in a structure, we ensure that withContext lives only within single
@@ -121,3 +248,16 @@ type withContext struct {
 func (w withContext) ReadAt(p []byte, off int64) (n int, err error) {
 	return w.r.ReadAtContext(w.ctx, p, off)
 }
+
+// contextReader is an io.Reader that stops reading once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (n int, err error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -1,10 +1,12 @@
 package zipserve
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -243,3 +245,94 @@ func TestMultiReaderAt_ReadAtContextError(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestMultiReaderAt_ReadAtContextShortPart(t *testing.T) {
+	var mcr multiReaderAt
+	mcr.add(ignoreContext{r: bytes.NewReader([]byte("abc"))}, 3)
+	mcr.add(ignoreContext{r: bytes.NewReader([]byte("def"))}, 5) // declared longer than actual
+	mcr.add(ignoreContext{r: bytes.NewReader([]byte("ijk"))}, 3)
+
+	p := make([]byte, 8)
+	n, err := mcr.ReadAtContext(context.Background(), p, 1)
+	if got := string(p[:n]); got != "bcdef" {
+		t.Errorf("expected read %q, got %q", "bcdef", got)
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected err=%v, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	// reading past the declared end is still io.EOF
+	n, err = mcr.ReadAtContext(context.Background(), p, 8)
+	if got := string(p[:n]); got != "ijk" {
+		t.Errorf("expected read %q, got %q", "ijk", got)
+	}
+	if err != io.EOF {
+		t.Errorf("expected err=%v, got %v", io.EOF, err)
+	}
+}
+
+func TestMultiReaderAt_ReadAtContextEOFAtPartEnd(t *testing.T) {
+	var mcr multiReaderAt
+	mcr.add(readWithError{data: []byte("abc"), err: io.EOF}, 3)
+	mcr.add(ignoreContext{r: bytes.NewReader([]byte("def"))}, 3)
+
+	p := make([]byte, 6)
+	n, err := mcr.ReadAtContext(context.Background(), p, 0)
+	if got := string(p[:n]); got != "abcdef" {
+		t.Errorf("expected read %q, got %q", "abcdef", got)
+	}
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// crcProvidingReader is content that knows its CRC32.
+type crcProvidingReader struct {
+	*bytes.Reader
+	crc uint32
+}
+
+func (c crcProvidingReader) CRC32() uint32 { return c.crc }
+
+func TestCRC32Provider(t *testing.T) {
+	data := []byte("content with known checksum")
+	tmpl := &Template{
+		Entries: []*FileHeader{
+			{
+				Name:               "provided.txt",
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(data)),
+				Content:            crcProvidingReader{Reader: bytes.NewReader(data), crc: crc(data)},
+			},
+			{
+				// explicit CRC32 takes precedence
+				Name:               "explicit.txt",
+				CRC32:              crc(data),
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(data)),
+				Content:            crcProvidingReader{Reader: bytes.NewReader(data), crc: 42},
+			},
+		},
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if f.CRC32 != crc(data) {
+			t.Errorf("%s: CRC32 %#x, want %#x", f.Name, f.CRC32, crc(data))
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(rc); err != nil {
+			t.Errorf("%s: reading: %v", f.Name, err)
+		}
+		rc.Close()
+	}
+}
@@ -0,0 +1,264 @@
+package zipserve
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// LazyFile reads a local file that is opened on first read and closed once it is not read for a while.
+//
+// Holding a file descriptor open for each entry of an archive for its whole lifetime doesn't scale to archives
+// with thousands of entries. LazyFile only keeps the file open while it is being read, plus the idle timeout
+// so that subsequent reads of a download don't reopen it. The file is reopened transparently when it is read again.
+//
+// Use FilePool to also limit the number of files open at the same time.
+//
+// LazyFile is safe for concurrent use.
+type LazyFile struct {
+	path        string
+	idleTimeout time.Duration
+	// pool limits open files, nil if not limited.
+	pool *FilePool
+
+	// mu protects the fields below. It is the mutex of the pool for pooled files.
+	mu *sync.Mutex
+	// changed is signalled when a file is opened or closed. It is shared by all files of a pool.
+	changed *broadcaster
+	// file is the open file, nil if closed.
+	file *os.File
+	// opening is set while the file is being opened.
+	opening bool
+	// readers is the number of reads in progress.
+	readers int
+	// closePending is set if Close was called during reads, so the last of them closes the file.
+	closePending bool
+	// idle fires after idleTimeout without reads to close the file.
+	idle *time.Timer
+	// generation is incremented whenever the file is used, so that a stale idle timer doesn't close the file.
+	generation uint64
+	// elem is the element of the file in pool.lru while the file is open.
+	elem *list.Element
+}
+
+// NewLazyFile creates a LazyFile reading the file at path.
+//
+// The file is closed after idleTimeout without reads. If idleTimeout is not positive, the file is closed as soon
+// as no reads are in progress.
+func NewLazyFile(path string, idleTimeout time.Duration) *LazyFile {
+	return &LazyFile{path: path, idleTimeout: idleTimeout, mu: new(sync.Mutex), changed: newBroadcaster()}
+}
+
+// broadcaster wakes up goroutines waiting for a change of state guarded by a mutex. Unlike sync.Cond,
+// waiting can be canceled using a context.
+type broadcaster struct {
+	// ch is closed by the next broadcast. It is guarded by the mutex of the state.
+	ch chan struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{ch: make(chan struct{})}
+}
+
+// broadcast wakes up all waiting goroutines. The mutex of the state must be held.
+func (b *broadcaster) broadcast() {
+	close(b.ch)
+	b.ch = make(chan struct{})
+}
+
+// wait unlocks mu, waits for the next broadcast and locks mu again. It returns ctx.Err() if ctx is done first.
+// mu must be held.
+func (b *broadcaster) wait(ctx context.Context, mu *sync.Mutex) error {
+	ch := b.ch
+	mu.Unlock()
+	defer mu.Lock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FilePool limits the number of files of its LazyFiles open at the same time.
+//
+// When a file needs to be opened and the limit is reached, the least recently used file without reads
+// in progress is closed. If all open files are being read, the read waits until one of them is released.
+//
+// FilePool is safe for concurrent use.
+type FilePool struct {
+	maxOpen     int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	changed *broadcaster
+	// lru contains open files, most recently used first.
+	lru list.List // of *LazyFile
+	// open is the number of files open or being opened.
+	open int
+}
+
+// NewFilePool creates a new FilePool allowing at most maxOpen open files. Zero or negative value means no limit.
+//
+// Files of the pool are closed after idleTimeout without reads, as with NewLazyFile.
+func NewFilePool(maxOpen int, idleTimeout time.Duration) *FilePool {
+	return &FilePool{maxOpen: maxOpen, idleTimeout: idleTimeout, changed: newBroadcaster()}
+}
+
+// File returns a LazyFile reading the file at path, whose open file counts towards the limit of the pool.
+func (p *FilePool) File(path string) *LazyFile {
+	return &LazyFile{path: path, idleTimeout: p.idleTimeout, pool: p, mu: &p.mu, changed: p.changed}
+}
+
+// OpenFiles returns the number of files currently open.
+func (p *FilePool) OpenFiles() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.open
+}
+
+// reserve reserves a slot for opening a file, closing the least recently used idle file if the pool is full.
+// It reports false if all open files are being read. p.mu must be held.
+func (p *FilePool) reserve() bool {
+	if p.maxOpen <= 0 || p.open < p.maxOpen {
+		p.open++
+		return true
+	}
+	for e := p.lru.Back(); e != nil; e = e.Prev() {
+		victim := e.Value.(*LazyFile)
+		if victim.readers > 0 {
+			continue
+		}
+		victim.stopIdle()
+		victim.closeLocked()
+		p.open++
+		return true
+	}
+	return false
+}
+
+// ReadAt reads data of the file.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (l *LazyFile) ReadAt(p []byte, off int64) (n int, err error) {
+	return l.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data of the file, opening it if it is closed. If the file waits for a slot in its FilePool,
+// the wait ends when ctx is done.
+//
+// This methods implements ReaderAt interface.
+func (l *LazyFile) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	f, err := l.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer l.release()
+	return f.ReadAt(p, off)
+}
+
+// Close closes the file if it is open. Reads in progress finish first; the file can be read again after Close.
+func (l *LazyFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopIdle()
+	if l.readers > 0 || l.opening {
+		l.closePending = true
+		return nil
+	}
+	if l.file == nil {
+		return nil
+	}
+	return l.closeLocked()
+}
+
+// acquire opens the file if needed and registers a read in progress.
+func (l *LazyFile) acquire(ctx context.Context) (*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopIdle()
+	for l.file == nil {
+		if l.opening || l.pool != nil && !l.pool.reserve() {
+			if err := l.changed.wait(ctx, l.mu); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// open the file without holding the lock, which may be shared by the whole pool
+		l.opening = true
+		l.mu.Unlock()
+		f, err := os.Open(l.path)
+		l.mu.Lock()
+		l.opening = false
+		l.changed.broadcast()
+		if err != nil {
+			if l.pool != nil {
+				l.pool.open--
+			}
+			return nil, err
+		}
+		l.file = f
+		if l.pool != nil {
+			l.elem = l.pool.lru.PushFront(l)
+		}
+	}
+	if l.elem != nil {
+		l.pool.lru.MoveToFront(l.elem)
+	}
+	l.closePending = false
+	l.readers++
+	return l.file, nil
+}
+
+// release unregisters a read in progress and schedules closing of the file once there are none.
+func (l *LazyFile) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.readers--
+	if l.readers > 0 {
+		return
+	}
+	// wake up reads waiting for a pool slot, this file can be closed now
+	l.changed.broadcast()
+	if l.idleTimeout <= 0 || l.closePending {
+		l.closePending = false
+		l.closeLocked()
+		return
+	}
+	generation := l.generation
+	l.idle = time.AfterFunc(l.idleTimeout, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.generation != generation || l.readers > 0 || l.file == nil {
+			return
+		}
+		l.idle = nil
+		l.closeLocked()
+	})
+}
+
+// stopIdle cancels closing of the idle file. l.mu must be held.
+func (l *LazyFile) stopIdle() {
+	l.generation++
+	if l.idle != nil {
+		l.idle.Stop()
+		l.idle = nil
+	}
+}
+
+// closeLocked closes the file. l.mu must be held.
+func (l *LazyFile) closeLocked() error {
+	err := l.file.Close()
+	l.file = nil
+	if l.pool != nil {
+		l.pool.lru.Remove(l.elem)
+		l.elem = nil
+		l.pool.open--
+		l.changed.broadcast()
+	}
+	return err
+}
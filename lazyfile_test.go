@@ -0,0 +1,173 @@
+package zipserve
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func (l *LazyFile) isOpen() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file != nil
+}
+
+func TestLazyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(path, []byte("lazy file content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLazyFile(path, 20*time.Millisecond)
+	if l.isOpen() {
+		t.Fatal("file opened before first read")
+	}
+	p := make([]byte, 4)
+	if n, err := l.ReadAt(p, 5); err != nil || string(p[:n]) != "file" {
+		t.Fatalf("ReadAt: %q, %v", p[:n], err)
+	}
+	if !l.isOpen() {
+		t.Error("file closed right after read")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for l.isOpen() {
+		if time.Now().After(deadline) {
+			t.Fatal("file not closed after idle timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	p = make([]byte, 10)
+	if n, err := l.ReadAt(p, 10); err != io.EOF || string(p[:n]) != "content" {
+		t.Fatalf("ReadAt after reopening: %q, %v", p[:n], err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l.isOpen() {
+		t.Error("file open after Close")
+	}
+
+	immediate := NewLazyFile(path, 0)
+	if _, err := immediate.ReadAt(p[:4], 0); err != nil {
+		t.Fatal(err)
+	}
+	if immediate.isOpen() {
+		t.Error("file with zero idle timeout left open")
+	}
+
+	missing := NewLazyFile(filepath.Join(dir, "missing"), time.Second)
+	if _, err := missing.ReadAt(p, 0); !os.IsNotExist(err) {
+		t.Errorf("reading missing file: %v", err)
+	}
+}
+
+func TestFilePool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := NewFilePool(2, time.Hour)
+	files := make(map[string]*LazyFile)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name+name+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = pool.File(path)
+	}
+
+	p := make([]byte, 3)
+	for _, name := range []string{"a", "b", "a", "c"} {
+		if n, err := files[name].ReadAt(p, 0); err != nil || string(p[:n]) != name+name+name {
+			t.Fatalf("ReadAt %s: %q, %v", name, p[:n], err)
+		}
+		if pool.OpenFiles() > 2 {
+			t.Fatalf("%d open files, want at most 2", pool.OpenFiles())
+		}
+	}
+	// b was the least recently used file
+	if !files["a"].isOpen() || files["b"].isOpen() || !files["c"].isOpen() {
+		t.Errorf("open files a=%v b=%v c=%v, want a and c", files["a"].isOpen(), files["b"].isOpen(),
+			files["c"].isOpen())
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			names := []string{"a", "b", "c", "d"}
+			p := make([]byte, 3)
+			for i := 0; i < 100; i++ {
+				name := names[rnd.Intn(len(names))]
+				if n, err := files[name].ReadAt(p, 0); err != nil || string(p[:n]) != name+name+name {
+					t.Errorf("ReadAt %s: %q, %v", name, p[:n], err)
+					return
+				}
+				if open := pool.OpenFiles(); open > 2 {
+					t.Errorf("%d open files, want at most 2", open)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pool.OpenFiles() != 0 {
+		t.Errorf("%d open files after Close, want 0", pool.OpenFiles())
+	}
+}
+
+func TestFilePoolWaitCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := NewFilePool(1, time.Hour)
+	var files []*LazyFile
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, pool.File(path))
+	}
+
+	// keep a read of a in progress, so b has to wait for the only slot of the pool
+	if _, err := files[0].acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p := make([]byte, 1)
+	if _, err := files[1].ReadAtContext(ctx, p, 0); err != context.DeadlineExceeded {
+		t.Fatalf("ReadAtContext with full pool: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	files[0].release()
+	if n, err := files[1].ReadAtContext(context.Background(), p, 0); err != nil || string(p[:n]) != "b" {
+		t.Fatalf("ReadAtContext after release: %q, %v", p[:n], err)
+	}
+	if pool.OpenFiles() != 1 {
+		t.Errorf("%d open files, want 1", pool.OpenFiles())
+	}
+}
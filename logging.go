@@ -0,0 +1,86 @@
+package zipserve
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// Logger receives messages about problems with an archive that would otherwise go unnoticed, like failed backend
+// reads that http.ServeContent only reports by aborting the response.
+//
+// *slog.Logger from the log/slog package implements Logger. Messages carry key-value pairs in the style of slog,
+// for example "entry" with the entry name and "offset" with the offset within the entry content.
+type Logger interface {
+	WarnContext(ctx context.Context, msg string, args ...interface{})
+	ErrorContext(ctx context.Context, msg string, args ...interface{})
+}
+
+// readErrorReporter reports failed reads from the content of an archive to Template.Logger and Template.OnError.
+// Reads canceled by the client are not logged.
+type readErrorReporter struct {
+	r   ReaderAt
+	ar  *Archive
+	cfg *handlerConfig
+	req *http.Request
+}
+
+func (e readErrorReporter) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	n, err = e.r.ReadAtContext(ctx, p, off)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	reported := classifyReadError(ctx, err)
+	// parts of the archive are read in order, so the read failed right after the data it returned
+	failedAt := off + int64(n)
+	name, entryOff, ok := e.ar.entryAt(failedAt)
+	if !ok {
+		entryOff = failedAt
+	}
+	if e.cfg.logger != nil && !errors.Is(reported, ErrCanceled) {
+		what := "failed"
+		if errors.Is(reported, ErrTimeout) {
+			what = "timed out"
+		}
+		if ok {
+			e.cfg.logger.ErrorContext(ctx, "zipserve: reading entry "+what, "entry", name, "offset", entryOff,
+				"error", err)
+		} else {
+			e.cfg.logger.ErrorContext(ctx, "zipserve: reading archive "+what, "offset", failedAt, "error", err)
+		}
+	}
+	if e.cfg.onError != nil {
+		e.cfg.onError(e.req, name, entryOff, reported)
+	}
+	return n, err
+}
+
+// entryAt returns the name of the entry whose content contains offset off of the archive and the offset
+// within the content. ok is false if off is not within content of any entry.
+func (ar *Archive) entryAt(off int64) (name string, entryOff int64, ok bool) {
+	ranges := ar.entryRanges
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].contentEnd > off
+	})
+	if i == len(ranges) || ranges[i].contentStart > off {
+		return "", 0, false
+	}
+	return ranges[i].name, off - ranges[i].contentStart, true
+}
+
+// logTemplateWarnings logs suspicious entries of t that are valid but likely a mistake.
+func logTemplateWarnings(logger Logger, t *Template) {
+	ctx := context.Background()
+	names := make(map[string]bool, len(t.Entries))
+	for _, entry := range t.Entries {
+		if names[entry.Name] {
+			logger.WarnContext(ctx, "zipserve: duplicate entry name", "entry", entry.Name)
+		}
+		names[entry.Name] = true
+		if entry.CRC32 == 0 && entry.UncompressedSize64 > 0 {
+			logger.WarnContext(ctx, "zipserve: entry has zero CRC32, the checksum may be missing", "entry", entry.Name)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package zipserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) log(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, strings.TrimSpace(fmt.Sprintln(append([]interface{}{level, msg}, args...)...)))
+}
+
+func (l *recordingLogger) WarnContext(_ context.Context, msg string, args ...interface{}) {
+	l.log("WARN", msg, args)
+}
+
+func (l *recordingLogger) ErrorContext(_ context.Context, msg string, args ...interface{}) {
+	l.log("ERROR", msg, args)
+}
+
+func TestArchiveLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	errBackend := errors.New("backend failure")
+	tmpl := metricsTestTemplate(nil, failingReaderAt{err: errBackend})
+	tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: "a.txt", Method: Store})
+	tmpl.Entries[0].CRC32 = 0
+	tmpl.Logger = logger
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantWarnings := []string{
+		"WARN zipserve: entry has zero CRC32, the checksum may be missing entry a.txt",
+		"WARN zipserve: duplicate entry name entry a.txt",
+	}
+	if strings.Join(logger.messages, "\n") != strings.Join(wantWarnings, "\n") {
+		t.Errorf("construction messages %q, want %q", logger.messages, wantWarnings)
+	}
+
+	logger.messages = nil
+	start := ar.entryRanges[1].contentStart
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start+100, start+199))
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+	if len(logger.messages) != 1 ||
+		logger.messages[0] != "ERROR zipserve: reading entry failed entry b.txt offset 100 error backend failure" {
+		t.Errorf("messages %q, want a read error of b.txt at offset 100", logger.messages)
+	}
+
+	logger.messages = nil
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=abc")
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+	if len(logger.messages) != 1 || logger.messages[0] != "WARN zipserve: malformed Range header range bytes=abc" {
+		t.Errorf("messages %q, want a malformed Range warning", logger.messages)
+	}
+}
+
+func TestArchiveOnError(t *testing.T) {
+	type call struct {
+		entry  string
+		offset int64
+		err    error
+	}
+	var calls []call
+	errBackend := errors.New("backend failure")
+	tmpl := metricsTestTemplate(nil, failingReaderAt{err: errBackend})
+	tmpl.OnError = func(r *http.Request, entryName string, offset int64, err error) {
+		calls = append(calls, call{entry: entryName, offset: offset, err: err})
+	}
+	tmpl.Authorize = func(ctx context.Context, entryName string) error {
+		if entryName == "a.txt" {
+			return errors.New("forbidden")
+		}
+		return nil
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := ar.entryRanges[1]
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", b.contentStart+100, b.contentStart+199))
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+	ar.ServeEntry(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), 1)
+	// a.txt is forbidden, which is not a backend failure
+	ar.ServeEntry(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), 0)
+	want := []call{{entry: "b.txt", offset: 100, err: errBackend}, {entry: "b.txt", offset: 0, err: errBackend}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls %+v, want %+v", calls, want)
+	}
+
+	calls = nil
+	tmpl = metricsTestTemplate(nil, nil)
+	tmpl.Prefix = failingReaderAt{err: errBackend}
+	tmpl.OnError = func(r *http.Request, entryName string, offset int64, err error) {
+		calls = append(calls, call{entry: entryName, offset: offset, err: err})
+	}
+	ar, err = NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := []call{{offset: 0, err: errBackend}}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls %+v, want %+v", calls, want)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+
+func (timeoutError) Timeout() bool { return true }
+
+func TestClassifyReadError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Unix(0, 0))
+	defer cancel()
+	errBackend := errors.New("backend failure")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want error
+	}{
+		{name: "backend", ctx: context.Background(), err: errBackend, want: nil},
+		{name: "client canceled", ctx: canceled, err: errBackend, want: ErrCanceled},
+		{name: "context deadline", ctx: expired, err: errBackend, want: ErrTimeout},
+		{name: "backend deadline", ctx: context.Background(), err: fmt.Errorf("get: %w", context.DeadlineExceeded),
+			want: ErrTimeout},
+		{name: "network timeout", ctx: context.Background(), err: timeoutError{}, want: ErrTimeout},
+	}
+	for _, test := range tests {
+		got := classifyReadError(test.ctx, test.err)
+		if !errors.Is(got, test.err) {
+			t.Errorf("%s: %v does not wrap %v", test.name, got, test.err)
+		}
+		if got.Error() != test.err.Error() {
+			t.Errorf("%s: message %q, want %q", test.name, got.Error(), test.err.Error())
+		}
+		for _, class := range []error{ErrCanceled, ErrTimeout} {
+			if errors.Is(got, class) != (class == test.want) {
+				t.Errorf("%s: errors.Is(%v, %v) = %v", test.name, got, class, !(class == test.want))
+			}
+		}
+	}
+}
+
+func TestArchiveReadTimeoutAndCancel(t *testing.T) {
+	logger := &recordingLogger{}
+	var reported []error
+	tmpl := metricsTestTemplate(nil, failingReaderAt{err: timeoutError{}})
+	tmpl.Logger = logger
+	tmpl.ServeTimeout = time.Minute
+	tmpl.OnError = func(r *http.Request, entryName string, offset int64, err error) {
+		reported = append(reported, err)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := ar.entryRanges[1].contentStart
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+99))
+
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("backend timeout: status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrTimeout) {
+		t.Errorf("backend timeout: reported %v, want a timeout", reported)
+	}
+	if len(logger.messages) != 1 ||
+		logger.messages[0] != "ERROR zipserve: reading entry timed out entry b.txt offset 0 error i/o timeout" {
+		t.Errorf("backend timeout: messages %q", logger.messages)
+	}
+
+	reported, logger.messages = nil, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	ar.ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code == http.StatusServiceUnavailable {
+		t.Errorf("canceled request: status %d", rec.Code)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrCanceled) || errors.Is(reported[0], ErrTimeout) {
+		t.Errorf("canceled request: reported %v, want a cancellation", reported)
+	}
+	if len(logger.messages) != 0 {
+		t.Errorf("canceled request: messages %q, want none", logger.messages)
+	}
+}
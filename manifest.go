@@ -0,0 +1,70 @@
+package zipserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ManifestEntry describes an entry of the archive in the output of Archive.ManifestJSON.
+type ManifestEntry struct {
+	Name string `json:"name"`
+	// Size is the uncompressed size of the entry.
+	Size uint64 `json:"size"`
+	// CRC32 is the checksum of the uncompressed data as 8 lowercase hexadecimal digits.
+	// It may be used as a validator of the entry content.
+	CRC32    string    `json:"crc32"`
+	Method   uint16    `json:"method"`
+	Modified time.Time `json:"modified"`
+}
+
+// ManifestJSON returns a JSON array of ManifestEntry objects describing entries of the archive.
+//
+// It may be served to clients to let them discover the archive contents before downloading it.
+// The array is empty for archives created by NewArchiveFromBytes.
+func (ar *Archive) ManifestJSON() ([]byte, error) {
+	entries := make([]ManifestEntry, 0, len(ar.dir))
+	for _, h := range ar.dir {
+		entries = append(entries, ManifestEntry{
+			Name:     h.Name,
+			Size:     h.UncompressedSize64,
+			CRC32:    fmt.Sprintf("%08x", h.CRC32),
+			Method:   h.Method,
+			Modified: h.Modified,
+		})
+	}
+	return json.Marshal(entries)
+}
+
+// EntryRange describes where the data of an entry is stored in the archive, see Archive.RangeMap.
+type EntryRange struct {
+	Name string `json:"name"`
+	// DataStart is the offset of the entry data from the beginning of the archive.
+	DataStart int64 `json:"dataStart"`
+	// DataLength is the length of the entry data as stored in the archive, that is the compressed size.
+	DataLength       int64  `json:"dataLength"`
+	Method           uint16 `json:"method"`
+	CRC32            uint32 `json:"crc32"`
+	UncompressedSize uint64 `json:"uncompressedSize"`
+}
+
+// RangeMap returns the location of data of each entry in the archive, in the order of Template.Entries.
+//
+// It may be served to clients, for example as JSON, so that they can fetch individual entries using range requests
+// without parsing the archive. The data of entries with Method Store is the content itself, other methods require
+// decompression. The result is empty for archives created by NewArchiveFromBytes.
+func (ar *Archive) RangeMap() []EntryRange {
+	ranges := make([]EntryRange, 0, len(ar.entryRanges))
+	for i, rng := range ar.entryRanges {
+		h := ar.dir[i]
+		ranges = append(ranges, EntryRange{
+			Name:             h.Name,
+			DataStart:        rng.contentStart,
+			DataLength:       rng.contentEnd - rng.contentStart,
+			Method:           h.Method,
+			CRC32:            h.CRC32,
+			UncompressedSize: h.UncompressedSize64,
+		})
+	}
+	return ranges
+}
@@ -0,0 +1,144 @@
+// Package manifest serializes metadata of zipserve templates, so that archives can be rebuilt without
+// recomputing sizes and checksums of their content.
+//
+// A service can prepare the manifest of an archive offline, store it next to the content, and create the Archive
+// at serve time by loading the manifest and resolving content locators to readers.
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/martin-sucha/zipserve"
+)
+
+// version is the version of the manifest format.
+const version = 1
+
+var errMissingLocator = errors.New("missing locator of content")
+
+// Manifest is the serialized form of a zipserve.Template.
+type Manifest struct {
+	Version    int       `json:"version"`
+	Comment    string    `json:"comment,omitempty"`
+	CreateTime time.Time `json:"createTime"`
+	Entries    []Entry   `json:"entries"`
+}
+
+// Entry is the serialized form of a zipserve.FileHeader.
+type Entry struct {
+	Name               string    `json:"name"`
+	Comment            string    `json:"comment,omitempty"`
+	NonUTF8            bool      `json:"nonUTF8,omitempty"`
+	CreatorVersion     uint16    `json:"creatorVersion"`
+	Flags              uint16    `json:"flags,omitempty"`
+	Method             uint16    `json:"method"`
+	Modified           time.Time `json:"modified"`
+	CRC32              uint32    `json:"crc32"`
+	CompressedSize64   uint64    `json:"compressedSize"`
+	UncompressedSize64 uint64    `json:"uncompressedSize"`
+	Extra              []byte    `json:"extra,omitempty"`
+	ExternalAttrs      uint32    `json:"externalAttrs"`
+	Encrypted          bool      `json:"encrypted,omitempty"`
+	EncryptionMethod   uint8     `json:"encryptionMethod,omitempty"`
+	// Locator identifies the content of the entry for the resolver passed to Unmarshal.
+	// It is empty for entries without content.
+	Locator string `json:"locator,omitempty"`
+}
+
+// Locator returns the locator of the content of an entry, for example a path or an object key.
+type Locator func(fh *zipserve.FileHeader) (string, error)
+
+// Resolver returns the content of an entry with the given locator.
+type Resolver func(locator string) (io.ReaderAt, error)
+
+// Marshal serializes the metadata of t to JSON.
+//
+// locate is called for each entry with content. Fields of t that can't be serialized, like Prefix, callbacks,
+// or ContentTransform of entries, are not stored. t must not have been passed to NewArchive yet, since NewArchive
+// modifies the entries.
+func Marshal(t *zipserve.Template, locate Locator) ([]byte, error) {
+	m := Manifest{
+		Version:    version,
+		Comment:    t.Comment,
+		CreateTime: t.CreateTime,
+		Entries:    make([]Entry, 0, len(t.Entries)),
+	}
+	for _, fh := range t.Entries {
+		e := Entry{
+			Name:               fh.Name,
+			Comment:            fh.Comment,
+			NonUTF8:            fh.NonUTF8,
+			CreatorVersion:     fh.CreatorVersion,
+			Flags:              fh.Flags,
+			Method:             fh.Method,
+			Modified:           fh.Modified,
+			CRC32:              fh.CRC32,
+			CompressedSize64:   fh.CompressedSize64,
+			UncompressedSize64: fh.UncompressedSize64,
+			Extra:              fh.Extra,
+			ExternalAttrs:      fh.ExternalAttrs,
+			Encrypted:          fh.Encrypted,
+			EncryptionMethod:   uint8(fh.EncryptionMethod),
+		}
+		if fh.Content != nil {
+			locator, err := locate(fh)
+			if err != nil {
+				return nil, fmt.Errorf("entry %q: %w", fh.Name, err)
+			}
+			e.Locator = locator
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	return json.Marshal(m)
+}
+
+// Unmarshal loads a Template from a manifest created by Marshal.
+//
+// resolve is called for each entry with a locator to obtain its content.
+func Unmarshal(data []byte, resolve Resolver) (*zipserve.Template, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != version {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	t := &zipserve.Template{
+		Comment:    m.Comment,
+		CreateTime: m.CreateTime,
+		Entries:    make([]*zipserve.FileHeader, 0, len(m.Entries)),
+	}
+	for _, e := range m.Entries {
+		fh := &zipserve.FileHeader{
+			Name:               e.Name,
+			Comment:            e.Comment,
+			NonUTF8:            e.NonUTF8,
+			CreatorVersion:     e.CreatorVersion,
+			Flags:              e.Flags,
+			Method:             e.Method,
+			Modified:           e.Modified,
+			CRC32:              e.CRC32,
+			CompressedSize64:   e.CompressedSize64,
+			UncompressedSize64: e.UncompressedSize64,
+			Extra:              e.Extra,
+			ExternalAttrs:      e.ExternalAttrs,
+			Encrypted:          e.Encrypted,
+			EncryptionMethod:   zipserve.EncryptionMethod(e.EncryptionMethod),
+		}
+		if e.Locator != "" {
+			content, err := resolve(e.Locator)
+			if err != nil {
+				return nil, fmt.Errorf("entry %q: %w", e.Name, err)
+			}
+			fh.Content = content
+		} else if e.CompressedSize64 > 0 {
+			return nil, fmt.Errorf("entry %q: %w", e.Name, errMissingLocator)
+		}
+		t.Entries = append(t.Entries, fh)
+	}
+	return t, nil
+}
@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/martin-sucha/zipserve"
+)
+
+func TestRoundTrip(t *testing.T) {
+	modified := time.Date(2021, 3, 4, 5, 6, 8, 0, time.UTC)
+	contents := map[string][]byte{
+		"objects/1": []byte("first file"),
+		"objects/2": []byte("second file, with a comment"),
+	}
+	file := func(name, locator string) *zipserve.FileHeader {
+		data := contents[locator]
+		fh := &zipserve.FileHeader{
+			Name:               name,
+			Modified:           modified,
+			CRC32:              crc32.ChecksumIEEE(data),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(data)),
+			Content:            bytes.NewReader(data),
+		}
+		fh.SetMode(0640)
+		return fh
+	}
+	build := func() *zipserve.Template {
+		second := file("dir/second.txt", "objects/2")
+		second.Comment = "entry comment"
+		dir := &zipserve.FileHeader{Name: "dir/", Modified: modified}
+		dir.SetMode(os.ModeDir | 0750)
+		return &zipserve.Template{
+			Comment:    "archive comment",
+			CreateTime: modified,
+			Entries:    []*zipserve.FileHeader{file("first.txt", "objects/1"), dir, second},
+		}
+	}
+	locators := map[string]string{"first.txt": "objects/1", "dir/second.txt": "objects/2"}
+
+	data, err := Marshal(build(), func(fh *zipserve.FileHeader) (string, error) {
+		return locators[fh.Name], nil
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	tmpl, err := Unmarshal(data, func(locator string) (io.ReaderAt, error) {
+		content, ok := contents[locator]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return bytes.NewReader(content), nil
+	})
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	want, err := zipserve.NewArchive(build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := zipserve.NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBytes, err := ioutil.ReadAll(io.NewSectionReader(want, 0, want.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotBytes, err := ioutil.ReadAll(io.NewSectionReader(got, 0, got.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotBytes, wantBytes) {
+		t.Error("archive from manifest differs from the original")
+	}
+	if _, err := zip.NewReader(bytes.NewReader(gotBytes), int64(len(gotBytes))); err != nil {
+		t.Errorf("reading archive from manifest: %v", err)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	errNotFound := errors.New("not found")
+	resolve := func(locator string) (io.ReaderAt, error) { return nil, errNotFound }
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{name: "version", data: `{"version":2}`},
+		{name: "missing locator", data: `{"version":1,"entries":[{"name":"a","compressedSize":1}]}`, err: errMissingLocator},
+		{name: "resolve", data: `{"version":1,"entries":[{"name":"a","compressedSize":1,"locator":"x"}]}`, err: errNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Unmarshal([]byte(test.data), resolve)
+			if err == nil || test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveManifestJSON(t *testing.T) {
+	modified := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	tmpl := &Template{}
+	for _, wt := range writeTests {
+		if wt.Data == nil {
+			continue
+		}
+		h := testCreate(t, &wt)
+		h.Modified = modified
+		tmpl.Entries = append(tmpl.Entries, h)
+	}
+	tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: "dir/", Modified: modified})
+
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ar.ManifestJSON()
+	if err != nil {
+		t.Fatalf("ManifestJSON: %v", err)
+	}
+	var entries []ManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(entries) != len(tmpl.Entries) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(tmpl.Entries))
+	}
+	for i, h := range tmpl.Entries {
+		e := entries[i]
+		if e.Name != h.Name {
+			t.Errorf("entry %d: name %q, want %q", i, e.Name, h.Name)
+		}
+		if e.Size != h.UncompressedSize64 {
+			t.Errorf("%s: size %d, want %d", h.Name, e.Size, h.UncompressedSize64)
+		}
+		if want := fmt.Sprintf("%08x", h.CRC32); e.CRC32 != want {
+			t.Errorf("%s: crc32 %q, want %q", h.Name, e.CRC32, want)
+		}
+		if e.Method != h.Method {
+			t.Errorf("%s: method %d, want %d", h.Name, e.Method, h.Method)
+		}
+		if !e.Modified.Equal(modified) {
+			t.Errorf("%s: modified %v, want %v", h.Name, e.Modified, modified)
+		}
+	}
+
+	data, err = NewArchiveFromBytes(nil, time.Time{}, "").ManifestJSON()
+	if err != nil {
+		t.Fatalf("ManifestJSON: %v", err)
+	}
+	if string(data) != "[]" {
+		t.Errorf("manifest of archive from bytes %s, want []", data)
+	}
+}
+
+func TestArchiveRangeMap(t *testing.T) {
+	tmpl := &Template{
+		Prefix:     strings.NewReader("prefix"),
+		PrefixSize: 6,
+	}
+	for _, wt := range writeTests {
+		if wt.Data == nil {
+			continue
+		}
+		tmpl.Entries = append(tmpl.Entries, testCreate(t, &wt))
+	}
+	tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: "dir/"})
+
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := ar.RangeMap()
+	if len(ranges) != len(tmpl.Entries) {
+		t.Fatalf("got %d ranges, want %d", len(ranges), len(tmpl.Entries))
+	}
+	data, err := json.Marshal(ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []EntryRange
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, ranges) {
+		t.Errorf("JSON round trip %+v, want %+v", decoded, ranges)
+	}
+
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range r.File {
+		rng := ranges[i]
+		if rng.Name != f.Name {
+			t.Errorf("entry %d: name %q, want %q", i, rng.Name, f.Name)
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rng.DataStart != offset {
+			t.Errorf("%s: data start %d, want %d", f.Name, rng.DataStart, offset)
+		}
+		if rng.DataLength != int64(f.CompressedSize64) {
+			t.Errorf("%s: data length %d, want %d", f.Name, rng.DataLength, f.CompressedSize64)
+		}
+		if rng.Method != f.Method || rng.CRC32 != f.CRC32 || rng.UncompressedSize != f.UncompressedSize64 {
+			t.Errorf("%s: method %d, crc32 %08x, uncompressed size %d, want %d, %08x, %d", f.Name, rng.Method,
+				rng.CRC32, rng.UncompressedSize, f.Method, f.CRC32, f.UncompressedSize64)
+		}
+		raw, err := f.OpenRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadAll(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, rng.DataLength)
+		if _, err := ar.ReadAt(got, rng.DataStart); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: data at range differs from archive/zip raw data", f.Name)
+		}
+	}
+
+	if got := NewArchiveFromBytes(nil, time.Time{}, "").RangeMap(); len(got) != 0 {
+		t.Errorf("range map of archive from bytes %+v, want empty", got)
+	}
+}
@@ -0,0 +1,140 @@
+package zipserve
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// PartKind is the kind of user-supplied data of an archive.
+type PartKind int
+
+const (
+	// PartPrefix is data of Template.Prefix or Template.PrefixParts.
+	PartPrefix PartKind = iota
+	// PartRaw is data of Template.RawParts.
+	PartRaw
+	// PartEntry is Content of an entry.
+	PartEntry
+)
+
+// String returns a lowercase name of the kind, suitable as a metric label.
+func (k PartKind) String() string {
+	switch k {
+	case PartPrefix:
+		return "prefix"
+	case PartRaw:
+		return "raw"
+	case PartEntry:
+		return "entry"
+	default:
+		return "unknown"
+	}
+}
+
+// Metrics receives measurements of reading and serving an archive, so that operators can see which entries and
+// backends dominate traffic.
+//
+// Methods are called concurrently and synchronously while serving requests, so they should be fast.
+type Metrics interface {
+	// BackendRead is called after each read of user-supplied data: Prefix, PrefixParts, RawParts and Content of
+	// entries. entry is the name of the entry for PartEntry and empty otherwise.
+	//
+	// n is the number of bytes read and latency the duration of the read, excluding time spent waiting for
+	// Template.MaxConcurrentFetches. err is the error returned by the read; io.EOF is reported as nil.
+	// Use errors.Is with ErrCanceled and ErrTimeout to tell reads interrupted by clients going away from
+	// reads that timed out and other backend failures.
+	BackendRead(kind PartKind, entry string, n int, latency time.Duration, err error)
+
+	// EntryServed is called by ServeHTTP once per request for each entry whose content is read to serve the request,
+	// and by ServeEntry for each GET request.
+	EntryServed(entry string)
+}
+
+// meteredReaderAt reports reads from r to metrics.
+type meteredReaderAt struct {
+	r       ReaderAt
+	metrics Metrics
+	kind    PartKind
+	entry   string
+}
+
+func (m meteredReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	start := time.Now()
+	n, err = m.r.ReadAtContext(ctx, p, off)
+	reported := classifyReadError(ctx, err)
+	if reported == io.EOF {
+		reported = nil
+	}
+	m.metrics.BackendRead(m.kind, m.entry, n, time.Since(start), reported)
+	return n, err
+}
+
+// entryServeRecorder reports entries whose content is read within a single request to Metrics.EntryServed.
+type entryServeRecorder struct {
+	r  ReaderAt
+	ar *Archive
+	// served contains indexes of already reported entries.
+	served map[int]bool
+}
+
+func (e *entryServeRecorder) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	n, err = e.r.ReadAtContext(ctx, p, off)
+	e.ar.forEachContent(off, off+int64(n), func(i int) error {
+		if !e.served[i] {
+			e.served[i] = true
+			e.ar.metrics.EntryServed(e.ar.entryRanges[i].name)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// entryVisitTracker reports when reads within a single request enter and leave content of entries.
+type entryVisitTracker struct {
+	r   ReaderAt
+	ar  *Archive
+	req *http.Request
+	// current is the index of the entry being read, -1 if none.
+	current int
+	// read is the number of bytes of the current entry read since entering it.
+	read int64
+}
+
+func (v *entryVisitTracker) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	n, err = v.r.ReadAtContext(ctx, p, off)
+	end := off + int64(n)
+	v.ar.forEachContent(off, end, func(i int) error {
+		if i != v.current {
+			v.leave()
+			v.current = i
+			v.read = 0
+			v.ar.onEntryEnter(v.req, v.ar.entryRanges[i].name)
+		}
+		rng := v.ar.entryRanges[i]
+		start, stop := rng.contentStart, rng.contentEnd
+		if off > start {
+			start = off
+		}
+		if end < stop {
+			stop = end
+		}
+		v.read += stop - start
+		return nil
+	})
+	if v.current >= 0 && v.ar.entryRanges[v.current].contentEnd <= end {
+		v.leave()
+	}
+	return n, err
+}
+
+// leave reports leaving the current entry, if any.
+func (v *entryVisitTracker) leave() {
+	if v.current < 0 {
+		return
+	}
+	rng := v.ar.entryRanges[v.current]
+	v.ar.onEntryLeave(v.req, rng.name, v.read, v.read == rng.contentEnd-rng.contentStart)
+	v.current = -1
+}
@@ -0,0 +1,191 @@
+package zipserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	mu     sync.Mutex
+	bytes  map[string]int
+	errors map[string]int
+	served map[string]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{bytes: make(map[string]int), errors: make(map[string]int), served: make(map[string]int)}
+}
+
+func (m *recordingMetrics) BackendRead(kind PartKind, entry string, n int, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := kind.String() + ":" + entry
+	m.bytes[key] += n
+	if err != nil {
+		m.errors[key]++
+	}
+}
+
+func (m *recordingMetrics) EntryServed(entry string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.served[entry]++
+}
+
+type failingReaderAt struct{ err error }
+
+func (f failingReaderAt) ReadAt(p []byte, off int64) (int, error) { return 0, f.err }
+
+func metricsTestTemplate(metrics Metrics, broken io.ReaderAt) *Template {
+	a := []byte(strings.Repeat("a", 1000))
+	b := []byte(strings.Repeat("b", 2000))
+	entry := func(name string, data []byte) *FileHeader {
+		return &FileHeader{
+			Name:               name,
+			Method:             Store,
+			CRC32:              crc32.ChecksumIEEE(data),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(data)),
+			Content:            bytes.NewReader(data),
+		}
+	}
+	tmpl := &Template{
+		Prefix:     strings.NewReader("prefix"),
+		PrefixSize: 6,
+		RawParts:   []RawPart{{Before: 1, Data: strings.NewReader("raw"), Size: 3}},
+		Entries:    []*FileHeader{entry("a.txt", a), entry("b.txt", b), {Name: "dir/"}},
+		Metrics:    metrics,
+	}
+	if broken != nil {
+		tmpl.Entries[1].Content = broken
+	}
+	return tmpl
+}
+
+func TestArchiveMetrics(t *testing.T) {
+	metrics := newRecordingMetrics()
+	ar, err := NewArchive(metricsTestTemplate(metrics, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	wantBytes := map[string]int{"prefix:": 6, "raw:": 3, "entry:a.txt": 1000, "entry:b.txt": 2000}
+	for key, want := range wantBytes {
+		if got := metrics.bytes[key]; got != want {
+			t.Errorf("%s: read %d bytes, want %d", key, got, want)
+		}
+	}
+	if len(metrics.bytes) != len(wantBytes) || len(metrics.errors) != 0 {
+		t.Errorf("unexpected reads %v, errors %v", metrics.bytes, metrics.errors)
+	}
+	if metrics.served["a.txt"] != 1 || metrics.served["b.txt"] != 1 || len(metrics.served) != 2 {
+		t.Errorf("served %v, want a.txt and b.txt once", metrics.served)
+	}
+
+	// a range within the content of b.txt
+	start := ar.entryRanges[1].contentStart
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(start+10, 10)+"-"+strconv.FormatInt(start+20, 10))
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+	if metrics.served["a.txt"] != 1 || metrics.served["b.txt"] != 2 {
+		t.Errorf("served %v after range request, want a.txt once and b.txt twice", metrics.served)
+	}
+
+	rec = httptest.NewRecorder()
+	ar.ServeEntry(rec, httptest.NewRequest(http.MethodGet, "/", nil), 0)
+	if metrics.served["a.txt"] != 2 {
+		t.Errorf("served %v after ServeEntry, want a.txt twice", metrics.served)
+	}
+}
+
+func TestArchiveMetricsErrors(t *testing.T) {
+	metrics := newRecordingMetrics()
+	errBackend := errors.New("backend failure")
+	ar, err := NewArchive(metricsTestTemplate(metrics, failingReaderAt{err: errBackend}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, io.NewSectionReader(ar, 0, ar.Size())); !errors.Is(err, errBackend) {
+		t.Fatalf("error %v, want %v", err, errBackend)
+	}
+	if metrics.errors["entry:b.txt"] != 1 {
+		t.Errorf("errors %v, want one for b.txt", metrics.errors)
+	}
+}
+
+func TestPartKindString(t *testing.T) {
+	for kind, want := range map[PartKind]string{PartPrefix: "prefix", PartRaw: "raw", PartEntry: "entry", 42: "unknown"} {
+		if got := kind.String(); got != want {
+			t.Errorf("%d: got %q, want %q", int(kind), got, want)
+		}
+	}
+}
+
+func TestArchiveEntryVisits(t *testing.T) {
+	var events []string
+	tmpl := metricsTestTemplate(nil, nil)
+	tmpl.OnEntryEnter = func(r *http.Request, entryName string) {
+		events = append(events, "enter "+entryName)
+	}
+	tmpl.OnEntryLeave = func(r *http.Request, entryName string, bytesRead int64, complete bool) {
+		events = append(events, fmt.Sprintf("leave %s %d %v", entryName, bytesRead, complete))
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := ar.entryRanges[0], ar.entryRanges[1]
+
+	tests := []struct {
+		name       string
+		rangeValue string
+		want       []string
+	}{
+		{
+			name: "whole archive",
+			want: []string{"enter a.txt", "leave a.txt 1000 true", "enter b.txt", "leave b.txt 2000 true"},
+		},
+		{
+			name:       "within entry",
+			rangeValue: fmt.Sprintf("bytes=%d-%d", b.contentStart+10, b.contentStart+20),
+			want:       []string{"enter b.txt", "leave b.txt 11 false"},
+		},
+		{
+			name:       "across entries",
+			rangeValue: fmt.Sprintf("bytes=%d-%d", a.contentEnd-10, b.contentStart+9),
+			want:       []string{"enter a.txt", "leave a.txt 10 false", "enter b.txt", "leave b.txt 10 false"},
+		},
+		{
+			name:       "headers only",
+			rangeValue: fmt.Sprintf("bytes=0-%d", a.contentStart-1),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events = nil
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.rangeValue != "" {
+				req.Header.Set("Range", test.rangeValue)
+			}
+			ar.ServeHTTP(httptest.NewRecorder(), req)
+			if strings.Join(events, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("events %q, want %q", events, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package zipserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errMmapUnsupported is returned by mmap on platforms without memory-mapped files.
+var errMmapUnsupported = errors.New("mmap not supported")
+
+// MmapReaderAt reads a local file through a read-only memory mapping, so that reads are served from the page cache
+// without a system call per read.
+//
+// On platforms that don't support memory mapping, reads fall back to reading the file.
+//
+// The file must not be truncated while it is mapped, accessing the missing pages would crash the program.
+// MmapReaderAt is safe for concurrent use, but Close must not be called concurrently with reads.
+type MmapReaderAt struct {
+	// data is the mapped file, nil if the file is empty or not mapped.
+	data []byte
+	// file is used for reading if the file is not mapped.
+	file *os.File
+	size int64
+}
+
+// OpenMmap opens the file at path and maps it into memory.
+func OpenMmap(path string) (*MmapReaderAt, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		f.Close()
+		return &MmapReaderAt{}, nil
+	}
+	if int64(int(size)) != size {
+		f.Close()
+		return nil, fmt.Errorf("mmap %s: file too large", path)
+	}
+	data, err := mmap(f, int(size))
+	if err == errMmapUnsupported {
+		return &MmapReaderAt{file: f, size: size}, nil
+	}
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("mmap %s: %w", path, err)
+	}
+	return &MmapReaderAt{data: data, size: size}, nil
+}
+
+// Size returns the size of the file.
+func (m *MmapReaderAt) Size() int64 { return m.size }
+
+// Close unmaps the file, or closes it on platforms without memory mapping.
+func (m *MmapReaderAt) Close() error {
+	if m.file != nil {
+		return m.file.Close()
+	}
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmap(data)
+}
+
+// ReadAt reads data of the file.
+//
+// See io.ReaderAt for the interface.
+func (m *MmapReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if m.file != nil {
+		return m.file.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ReadAtContext reads data of the file. The context is ignored, reads from memory can't be canceled.
+//
+// This methods implements ReaderAt interface.
+func (m *MmapReaderAt) ReadAtContext(_ context.Context, p []byte, off int64) (n int, err error) {
+	return m.ReadAt(p, off)
+}
@@ -0,0 +1,67 @@
+package zipserve
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapReaderAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(7)).Read(data)
+	path := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size() != int64(len(data)) {
+		t.Errorf("size %d, want %d", m.Size(), len(data))
+	}
+	p := make([]byte, 1000)
+	n, err := m.ReadAt(p, 500)
+	if err != nil || !bytes.Equal(p[:n], data[500:1500]) {
+		t.Errorf("ReadAt: %d, %v", n, err)
+	}
+	n, err = m.ReadAt(p, 9500)
+	if n != 500 || err != io.EOF || !bytes.Equal(p[:n], data[9500:]) {
+		t.Errorf("reading over the end: %d, %v, want 500, EOF", n, err)
+	}
+	if _, err := m.ReadAt(p, 10000); err != io.EOF {
+		t.Errorf("reading at the end: %v, want EOF", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err = OpenMmap(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadAt(p, 0); err != io.EOF {
+		t.Errorf("reading empty file: %v, want EOF", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenMmap(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("opening missing file: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package zipserve
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ErrAlgorithm is returned when the compression method of an entry is not supported.
+var ErrAlgorithm = errors.New("zip: unsupported compression algorithm")
+
+// newDecompressor returns a reader decompressing r compressed using method.
+func newDecompressor(method uint16, r io.Reader) (io.ReadCloser, error) {
+	switch method {
+	case Store:
+		return ioutil.NopCloser(r), nil
+	case Deflate:
+		return flate.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("%w: method %d", ErrAlgorithm, method)
+}
+
+// OpenEntry returns a reader of the uncompressed content of the entry with the given index in Template.Entries.
+//
+// The content is decompressed according to the Method of the entry; ErrAlgorithm is returned for methods other than
+// Store and Deflate and for encrypted entries. The reader returns at most UncompressedSize64 bytes, any data
+// decompressed beyond that is ignored. If the content decompresses to fewer bytes, the reader returns
+// io.ErrUnexpectedEOF. The content is read from the archive, so ContentTransform and
+// MaxConcurrentFetches apply. ctx is passed to ReadAtContext of the content.
+//
+// OpenEntry panics if index is out of range.
+func (ar *Archive) OpenEntry(ctx context.Context, index int) (io.ReadCloser, error) {
+	rng := ar.entryRanges[index]
+	entry := ar.dir[index].FileHeader
+	if entry.Encrypted {
+		return nil, fmt.Errorf("%w: entry %q is encrypted", ErrAlgorithm, entry.Name)
+	}
+	raw := io.NewSectionReader(withContext{r: ar.content, ctx: ctx}, rng.contentStart, rng.contentEnd-rng.contentStart)
+	dc, err := newDecompressor(entry.Method, raw)
+	if err != nil {
+		return nil, err
+	}
+	return &entryReader{r: dc, Closer: dc, remaining: int64(entry.UncompressedSize64)}, nil
+}
+
+// entryReader is a reader of entry content returned from OpenEntry.
+type entryReader struct {
+	r io.Reader
+	io.Closer
+	// remaining is the number of bytes of UncompressedSize64 not read yet.
+	remaining int64
+}
+
+func (e *entryReader) Read(p []byte) (n int, err error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err = e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == io.EOF && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
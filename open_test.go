@@ -0,0 +1,94 @@
+package zipserve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestArchiveOpenEntry(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world\n"), 100)
+	compressed := deflate(data)
+	tmpl := &Template{
+		Entries: []*FileHeader{
+			{
+				Name:               "stored.txt",
+				Method:             Store,
+				CRC32:              crc(data),
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(data)),
+				Content:            bytes.NewReader(data),
+			},
+			{
+				Name:               "deflated.txt",
+				Method:             Deflate,
+				CRC32:              crc(data),
+				CompressedSize64:   uint64(len(compressed)),
+				UncompressedSize64: uint64(len(data)),
+				Content:            bytes.NewReader(compressed),
+			},
+			{
+				// declares less data than the stream contains
+				Name:               "short.txt",
+				Method:             Deflate,
+				CRC32:              crc(data[:10]),
+				CompressedSize64:   uint64(len(compressed)),
+				UncompressedSize64: 10,
+				Content:            bytes.NewReader(compressed),
+			},
+			{
+				// declares more data than the stream contains
+				Name:               "truncated.txt",
+				Method:             Deflate,
+				CRC32:              crc(data),
+				CompressedSize64:   uint64(len(compressed)),
+				UncompressedSize64: uint64(len(data)) + 10,
+				Content:            bytes.NewReader(compressed),
+			},
+			{
+				Name:               "unknown.bin",
+				Method:             12,
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(data)),
+				Content:            bytes.NewReader(data),
+			},
+		},
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range [][]byte{data, data, data[:10]} {
+		rc, err := ar.OpenEntry(context.Background(), i)
+		if err != nil {
+			t.Fatalf("entry %d: OpenEntry: %v", i, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("entry %d: reading: %v", i, err)
+		}
+		if err := rc.Close(); err != nil {
+			t.Errorf("entry %d: Close: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("entry %d: got %d bytes, want %d bytes", i, len(got), len(want))
+		}
+	}
+
+	rc, err := ar.OpenEntry(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("truncated entry: OpenEntry: %v", err)
+	}
+	if _, err := ioutil.ReadAll(rc); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated entry: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	rc.Close()
+
+	if _, err := ar.OpenEntry(context.Background(), 4); !errors.Is(err, ErrAlgorithm) {
+		t.Errorf("unknown method: got error %v, want %v", err, ErrAlgorithm)
+	}
+}
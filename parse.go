@@ -0,0 +1,105 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseArchive reads the central directory of an existing zip file and returns a Template describing it.
+//
+// Content of each entry in the returned template points to the compressed data of the entry in r, so no data is
+// copied or recompressed. The returned template may be modified and passed to NewArchive.
+//
+// r may implement ReaderAt interface from this package, in that case r's ReadAtContext method will be called
+// instead of ReadAt when reading entry contents.
+func ParseArchive(r io.ReaderAt, size int64) (*Template, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	shared := NewSharedFileReaderAt(r, 0)
+	t := &Template{
+		Comment: zr.Comment,
+		Entries: make([]*FileHeader, 0, len(zr.File)),
+	}
+	for _, f := range zr.File {
+		fh := &FileHeader{
+			Name:               f.Name,
+			Comment:            f.Comment,
+			NonUTF8:            parsedNonUTF8(f.Flags, f.Name, f.Comment),
+			PreserveUTF8Flag:   f.Flags&0x800 != 0,
+			CreatorVersion:     f.CreatorVersion,
+			ReaderVersion:      f.ReaderVersion,
+			Flags:              f.Flags,
+			Method:             f.Method,
+			Modified:           f.Modified,
+			CRC32:              f.CRC32,
+			CompressedSize64:   f.CompressedSize64,
+			UncompressedSize64: f.UncompressedSize64,
+			Extra:              stripGeneratedExtra(f.Extra),
+			ExternalAttrs:      f.ExternalAttrs,
+		}
+		if !strings.HasSuffix(f.Name, "/") && f.CompressedSize64 > 0 {
+			offset, err := f.DataOffset()
+			if err != nil {
+				return nil, fmt.Errorf("entry %q: %w", f.Name, err)
+			}
+			fh.Content = shared.Section(offset, int64(f.CompressedSize64))
+		}
+		t.Entries = append(t.Entries, fh)
+	}
+	return t, nil
+}
+
+// parsedNonUTF8 reconstructs FileHeader.NonUTF8 from the flags of a parsed entry.
+//
+// If the UTF-8 flag is set, the name and comment are UTF-8. If it is not set and the name or comment contain
+// bytes outside of ASCII, they are in some other encoding and a rebuild must not set the flag.
+func parsedNonUTF8(flags uint16, name, comment string) bool {
+	if flags&0x800 != 0 {
+		return false
+	}
+	return hasHighBytes(name) || hasHighBytes(comment)
+}
+
+func hasHighBytes(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// stripGeneratedExtra removes extra fields that NewArchive generates itself,
+// so that they are not duplicated when a parsed entry is written again.
+func stripGeneratedExtra(extra []byte) []byte {
+	var out []byte
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		if id != zip64ExtraID && id != extTimeExtraID {
+			out = append(out, extra[:4+size]...)
+		}
+		extra = extra[4+size:]
+	}
+	return out
+}
+
+// ReserveZip creates an Archive serving the entries of an existing zip file.
+//
+// It is a shortcut for calling ParseArchive and NewArchive. The entries keep their compressed data, CRC32, sizes
+// and compression methods, the data is read from r on demand.
+func ReserveZip(r io.ReaderAt, size int64) (*Archive, error) {
+	t, err := ParseArchive(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return NewArchive(t)
+}
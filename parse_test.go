@@ -0,0 +1,216 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestParseArchive(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.SetComment("archive comment")
+	files := []struct {
+		name   string
+		data   string
+		method uint16
+	}{
+		{name: "stored.txt", data: "stored data", method: zip.Store},
+		{name: "deflated.txt", data: "deflated deflated deflated data", method: zip.Deflate},
+		{name: "empty.txt", data: "", method: zip.Store},
+		{name: "dir/", method: zip.Store},
+	}
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := ParseArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("ParseArchive: %v", err)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatalf("NewArchive: %v", err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if r.Comment != "archive comment" {
+		t.Errorf("comment %q, want %q", r.Comment, "archive comment")
+	}
+	if len(r.File) != len(files) {
+		t.Fatalf("got %d files, want %d", len(r.File), len(files))
+	}
+	for i, f := range files {
+		zf := r.File[i]
+		if zf.Name != f.name {
+			t.Errorf("file %d: name %q, want %q", i, zf.Name, f.name)
+		}
+		if zf.Method != f.method {
+			t.Errorf("%s: method %d, want %d", f.name, zf.Method, f.method)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatalf("%s: open: %v", f.name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: read: %v", f.name, err)
+		}
+		if string(data) != f.data {
+			t.Errorf("%s: data %q, want %q", f.name, data, f.data)
+		}
+	}
+}
+
+func TestParseArchiveNonUTF8(t *testing.T) {
+	// Name is Japanese encoded in Shift JIS.
+	const name = "\x93\xfa\x96{\x8c\xea.txt"
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.CreateHeader(&zip.FileHeader{Name: "hi, こんにちわ", Method: zip.Store}); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := ParseArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("ParseArchive: %v", err)
+	}
+	if !tmpl.Entries[0].NonUTF8 {
+		t.Errorf("Shift JIS entry: NonUTF8 false, want true")
+	}
+	if tmpl.Entries[1].NonUTF8 {
+		t.Errorf("UTF-8 entry: NonUTF8 true, want false")
+	}
+
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatalf("NewArchive: %v", err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if flags := r.File[0].Flags; flags&0x800 != 0 {
+		t.Errorf("Shift JIS entry: flags %#x, UTF-8 flag must not be set", flags)
+	}
+	if flags := r.File[1].Flags; flags&0x800 == 0 {
+		t.Errorf("UTF-8 entry: flags %#x, UTF-8 flag must be set", flags)
+	}
+}
+
+func TestParseArchivePreserveUTF8Flag(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.CreateHeader(&zip.FileHeader{Name: "ascii-flag.txt", Method: zip.Store, Flags: 0x800}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.CreateHeader(&zip.FileHeader{Name: "ascii.txt", Method: zip.Store}); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := ParseArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("ParseArchive: %v", err)
+	}
+	if !tmpl.Entries[0].PreserveUTF8Flag {
+		t.Error("entry with UTF-8 flag: PreserveUTF8Flag false, want true")
+	}
+	if tmpl.Entries[1].PreserveUTF8Flag {
+		t.Error("entry without UTF-8 flag: PreserveUTF8Flag true, want false")
+	}
+
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatalf("NewArchive: %v", err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if flags := r.File[0].Flags; flags&0x800 == 0 {
+		t.Errorf("entry with UTF-8 flag: flags %#x, UTF-8 flag must be set", flags)
+	}
+	if flags := r.File[1].Flags; flags&0x800 != 0 {
+		t.Errorf("entry without UTF-8 flag: flags %#x, UTF-8 flag must not be set", flags)
+	}
+
+	fh := &FileHeader{Name: "ascii.txt", Flags: 0x800, NonUTF8: true, PreserveUTF8Flag: true}
+	prepareEntry(fh, true, true)
+	if fh.Flags&0x800 == 0 {
+		t.Errorf("PreserveUTF8Flag with NonUTF8: flags %#x, UTF-8 flag must be kept", fh.Flags)
+	}
+}
+
+func TestReserveZip(t *testing.T) {
+	largeData := make([]byte, 1<<17)
+	if _, err := rand.Read(largeData); err != nil {
+		t.Fatal("rand.Read failed:", err)
+	}
+	writeTests[1].Data = largeData
+	defer func() {
+		writeTests[1].Data = nil
+	}()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, wt := range writeTests {
+		h := &zip.FileHeader{Name: wt.Name, Method: wt.Method}
+		h.SetMode(wt.Mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(wt.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	original, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ar, err := ReserveZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("ReserveZip: %v", err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, wt := range writeTests {
+		f := r.File[i]
+		testReadFile(t, f, &wt)
+		o := original.File[i]
+		if f.CRC32 != o.CRC32 || f.CompressedSize64 != o.CompressedSize64 ||
+			f.UncompressedSize64 != o.UncompressedSize64 || f.Method != o.Method {
+			t.Errorf("%s: metadata differ from original: %+v != %+v", f.Name, f.FileHeader, o.FileHeader)
+		}
+	}
+}
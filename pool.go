@@ -0,0 +1,124 @@
+package zipserve
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// ArchivePool reuses memory allocated for archive structures across builds.
+//
+// It is useful for services that build many short-lived archives, for example a filtered view of a larger archive
+// for each request. An archive obtained by Get must be returned by Put once it is no longer used.
+//
+// The zero value is ready to use. ArchivePool is safe for concurrent use.
+type ArchivePool struct {
+	pool sync.Pool
+}
+
+// Get creates a new Archive from a Template, like NewArchive does, reusing memory of archives returned by Put.
+func (p *ArchivePool) Get(t *Template) (*Archive, error) {
+	bufs, _ := p.pool.Get().(*archiveBuffers)
+	if bufs == nil {
+		bufs = new(archiveBuffers)
+	}
+	bufs.reset()
+	ar, err := buildArchive(t, nil, nil, bufs)
+	if err != nil {
+		p.pool.Put(bufs)
+		return nil, err
+	}
+	return ar, nil
+}
+
+// Put returns the memory of an archive obtained by Get to the pool.
+//
+// The archive must not be used after the call to Put, including any requests still being served from it.
+// Put does nothing for archives not created by an ArchivePool.
+func (p *ArchivePool) Put(ar *Archive) {
+	bufs := ar.buffers
+	if bufs == nil {
+		return
+	}
+	bufs.parts = ar.parts.parts
+	bufs.entryRanges = ar.entryRanges
+	bufs.dir = ar.dir
+	if ar.etagSources != nil {
+		bufs.etagSources = ar.etagSources
+	}
+	*ar = Archive{}
+	bufs.reset()
+	p.pool.Put(bufs)
+}
+
+// archiveBuffers is storage for archive structures that can be reused.
+type archiveBuffers struct {
+	// arena stores data of headers and the central directory.
+	arena       []byte
+	parts       []offsetAndData
+	entryRanges []entryRange
+	dir         []*header
+	headers     []header
+	etagSources []etagSource
+}
+
+// reset clears the buffers, keeping the allocated memory.
+func (b *archiveBuffers) reset() {
+	for i := range b.parts {
+		b.parts[i] = offsetAndData{}
+	}
+	for i := range b.dir {
+		b.dir[i] = nil
+	}
+	for i := range b.headers {
+		b.headers[i] = header{}
+	}
+	for i := range b.entryRanges {
+		b.entryRanges[i] = entryRange{}
+	}
+	for i := range b.etagSources {
+		b.etagSources[i] = etagSource{}
+	}
+	b.arena = b.arena[:0]
+	b.parts = b.parts[:0]
+	b.entryRanges = b.entryRanges[:0]
+	b.dir = b.dir[:0]
+	b.headers = b.headers[:0]
+	b.etagSources = b.etagSources[:0]
+}
+
+// grow ensures there is space for headers of n entries.
+func (b *archiveBuffers) grow(n int) {
+	if cap(b.headers) < n {
+		b.headers = make([]header, 0, n)
+	}
+}
+
+// newHeader returns a header for the entry, allocated from b if b is not nil.
+func (b *archiveBuffers) newHeader(fh *FileHeader, offset uint64) *header {
+	if b == nil || len(b.headers) == cap(b.headers) {
+		// don't grow the slice, as that would leave already returned pointers pointing to the old array
+		return &header{FileHeader: fh, offset: offset}
+	}
+	b.headers = append(b.headers, header{FileHeader: fh, offset: offset})
+	return &b.headers[len(b.headers)-1]
+}
+
+// view is a bufferViewFunc storing the data in the arena.
+func (b *archiveBuffers) view(content func(w io.Writer) error) (SizedReaderAt, error) {
+	start := len(b.arena)
+	if err := content(arenaWriter{b}); err != nil {
+		return nil, err
+	}
+	end := len(b.arena)
+	return bytes.NewReader(b.arena[start:end:end]), nil
+}
+
+type arenaWriter struct {
+	b *archiveBuffers
+}
+
+func (w arenaWriter) Write(p []byte) (int, error) {
+	w.b.arena = append(w.b.arena, p...)
+	return len(p), nil
+}
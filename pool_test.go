@@ -0,0 +1,108 @@
+package zipserve
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func poolTestTemplate() *Template {
+	tmpl := &Template{Comment: "pooled"}
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("content of file %d", i))
+		tmpl.Entries = append(tmpl.Entries, &FileHeader{
+			Name:               fmt.Sprintf("dir/file%d.txt", i),
+			CRC32:              crc(data),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(data)),
+			Content:            bytes.NewReader(data),
+		})
+	}
+	return tmpl
+}
+
+func archiveBytes(t *testing.T, ar *Archive) []byte {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.NewSectionReader(ar, 0, ar.Size())); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchivePool(t *testing.T) {
+	fresh, err := NewArchive(poolTestTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := archiveBytes(t, fresh)
+
+	var pool ArchivePool
+	for i := 0; i < 3; i++ {
+		ar, err := pool.Get(poolTestTemplate())
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if got := archiveBytes(t, ar); !bytes.Equal(got, want) {
+			t.Fatalf("build %d: pooled archive differs from fresh archive", i)
+		}
+		if ar.ETag() != fresh.ETag() {
+			t.Errorf("build %d: etag %s, want %s", i, ar.ETag(), fresh.ETag())
+		}
+		// a differently shaped archive in between
+		small, err := pool.Get(&Template{Entries: []*FileHeader{{Name: "x/"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := archiveBytes(t, ar); !bytes.Equal(got, want) {
+			t.Fatalf("build %d: pooled archive changed by another build", i)
+		}
+		pool.Put(small)
+		pool.Put(ar)
+	}
+
+	if _, err := pool.Get(&Template{Comment: string(make([]byte, uint16max+1))}); err == nil {
+		t.Error("expected error for invalid template, got nil")
+	}
+}
+
+func BenchmarkNewArchive(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tmpl := poolTestTemplate()
+		b.StartTimer()
+		if _, err := NewArchive(tmpl); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewArchiveETag(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tmpl := poolTestTemplate()
+		b.StartTimer()
+		ar, err := NewArchive(tmpl)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ar.ETag()
+	}
+}
+
+func BenchmarkArchivePool(b *testing.B) {
+	b.ReportAllocs()
+	var pool ArchivePool
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tmpl := poolTestTemplate()
+		b.StartTimer()
+		ar, err := pool.Get(tmpl)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pool.Put(ar)
+	}
+}
@@ -0,0 +1,86 @@
+package zipserve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// prefixPart is a part of the archive prefix.
+type prefixPart struct {
+	data ReaderAt
+	size int64
+}
+
+// templatePrefix returns the parts of the prefix of t.
+func templatePrefix(t *Template) ([]prefixPart, error) {
+	if t.Prefix != nil && len(t.PrefixParts) > 0 {
+		return nil, errors.New("both Prefix and PrefixParts are set")
+	}
+	if t.Prefix != nil {
+		return []prefixPart{{data: readerAt(t.Prefix), size: t.PrefixSize}}, nil
+	}
+	parts := make([]prefixPart, 0, len(t.PrefixParts))
+	for _, p := range t.PrefixParts {
+		parts = append(parts, prefixPart{data: readerAt(p), size: p.Size()})
+	}
+	return parts, nil
+}
+
+// validatePrefixParts checks the prefix composed of parts, if it is not too large.
+func validatePrefixParts(parts []prefixPart) error {
+	var prefix multiReaderAt
+	for _, part := range parts {
+		prefix.add(part.data, part.size)
+	}
+	if prefix.size == 0 || prefix.size > MaxValidatePrefixSize {
+		return nil
+	}
+	return validatePrefix(&prefix, prefix.size)
+}
+
+// MaxValidatePrefixSize is the maximum size of Template.Prefix that is checked when Template.ValidatePrefix is set.
+const MaxValidatePrefixSize = 16 << 20
+
+// ErrPrefixSignature is returned by NewArchive if Template.ValidatePrefix is set and the prefix contains
+// a signature of an end of central directory record.
+var ErrPrefixSignature = errors.New("zip: prefix contains end of central directory signature")
+
+// validatePrefix checks that the first size bytes of prefix do not contain end of central directory signatures.
+func validatePrefix(prefix io.ReaderAt, size int64) error {
+	var signatures [3][4]byte
+	binary.LittleEndian.PutUint32(signatures[0][:], directoryEndSignature)
+	binary.LittleEndian.PutUint32(signatures[1][:], directory64EndSignature)
+	binary.LittleEndian.PutUint32(signatures[2][:], directory64LocSignature)
+
+	const overlap = 3 // signature length minus one, so that signatures spanning chunks are found
+	buf := make([]byte, 32*1024)
+	var off int64
+	keep := 0
+	for off < size {
+		chunk := buf[keep:]
+		if remaining := size - off; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := prefix.ReadAt(chunk, off)
+		if n < len(chunk) {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		off += int64(n)
+		data := buf[:keep+n]
+		for _, sig := range signatures {
+			if bytes.Contains(data, sig[:]) {
+				return ErrPrefixSignature
+			}
+		}
+		if len(data) > overlap {
+			data = data[len(data)-overlap:]
+		}
+		keep = copy(buf, data)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestArchiveValidatePrefix(t *testing.T) {
+	var sig [4]byte
+	binary.LittleEndian.PutUint32(sig[:], directoryEndSignature)
+	padding := bytes.Repeat([]byte{'x'}, 32*1024-2)
+
+	tests := []struct {
+		name    string
+		prefix  []byte
+		wantErr error
+	}{
+		{name: "clean", prefix: []byte("#!/bin/sh\nexit 0\n")},
+		{name: "clean large", prefix: bytes.Repeat([]byte("PK"), 100000)},
+		{name: "signature", prefix: append([]byte("self-extractor"), sig[:]...), wantErr: ErrPrefixSignature},
+		{name: "signature across chunks", prefix: append(append([]byte{}, padding...), sig[:]...),
+			wantErr: ErrPrefixSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl := &Template{
+				Prefix:         bytes.NewReader(test.prefix),
+				PrefixSize:     int64(len(test.prefix)),
+				ValidatePrefix: true,
+			}
+			_, err := NewArchive(tmpl)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+
+	tmpl := &Template{
+		Prefix:     bytes.NewReader(sig[:]),
+		PrefixSize: int64(len(sig)),
+	}
+	if _, err := NewArchive(tmpl); err != nil {
+		t.Errorf("prefix is not validated by default, got error %v", err)
+	}
+}
+
+func TestArchivePrefixParts(t *testing.T) {
+	stub1 := []byte("boot stub part 1\n")
+	stub2 := []byte("boot stub part 2\n")
+	template := func() *Template {
+		return &Template{
+			PrefixParts: []SizedReaderAt{bytes.NewReader(stub1), bytes.NewReader(stub2)},
+			Entries:     []*FileHeader{testCreate(t, &writeTests[0])},
+		}
+	}
+	ar, err := NewArchive(template())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefixLen := len(stub1) + len(stub2)
+	p := make([]byte, prefixLen)
+	if _, err := ar.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := string(stub1) + string(stub2); string(p) != want {
+		t.Errorf("prefix %q, want %q", p, want)
+	}
+	if start, _ := ar.EntryRange(0); start != int64(prefixLen) {
+		t.Errorf("first entry starts at %d, want %d", start, prefixLen)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReadFile(t, r.File[0], &writeTests[0])
+
+	breakdown, err := CalculateSize(template())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breakdown.Prefix != int64(prefixLen) || breakdown.Total() != ar.Size() {
+		t.Errorf("CalculateSize prefix %d total %d, want %d and %d",
+			breakdown.Prefix, breakdown.Total(), prefixLen, ar.Size())
+	}
+
+	tmpl := template()
+	tmpl.Prefix = bytes.NewReader(stub1)
+	tmpl.PrefixSize = int64(len(stub1))
+	if _, err := NewArchive(tmpl); err == nil {
+		t.Error("expected error when both Prefix and PrefixParts are set, got nil")
+	}
+}
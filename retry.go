@@ -0,0 +1,97 @@
+package zipserve
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures RetryingReaderAt.
+type RetryPolicy struct {
+	// Retries is the maximum number of times a failed read is retried.
+	Retries int
+
+	// Backoff is the delay before the first retry, it is doubled for each subsequent retry.
+	// Zero means DefaultHTTPBackoff.
+	Backoff time.Duration
+
+	// MaxBackoff limits the delay between retries. Zero means no limit.
+	MaxBackoff time.Duration
+
+	// Retryable reports whether a read that failed with err should be retried.
+	// If nil, all errors except io.EOF and errors caused by a done context are retried.
+	Retryable func(err error) bool
+}
+
+// RetryingReaderAt retries failed reads from an upstream reader, so that a transient error of a remote backend
+// doesn't fail a long download.
+//
+// Delays between retries grow exponentially and are randomized between half and the full delay, so that clients
+// failing at the same time don't retry at the same time. If a read fails after reading some data, only the rest
+// of the data is read again.
+//
+// RetryingReaderAt is safe for concurrent use as long as the upstream reader is.
+type RetryingReaderAt struct {
+	r      ReaderAt
+	policy RetryPolicy
+}
+
+// NewRetryingReaderAt creates a new RetryingReaderAt retrying reads from r according to policy.
+//
+// r may implement ReaderAt interface from this package, in that case r's ReadAtContext method will be called
+// instead of ReadAt.
+func NewRetryingReaderAt(r io.ReaderAt, policy RetryPolicy) *RetryingReaderAt {
+	return &RetryingReaderAt{r: readerAt(r), policy: policy}
+}
+
+// ReadAt reads data from the upstream reader, retrying failed reads.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (r *RetryingReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return r.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data from the upstream reader, retrying failed reads.
+//
+// If the retries are exhausted, the error of the last read is returned.
+//
+// This methods implements ReaderAt interface.
+func (r *RetryingReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	backoff := r.policy.Backoff
+	if backoff <= 0 {
+		backoff = DefaultHTTPBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		n2, err := r.r.ReadAtContext(ctx, p[n:], off+int64(n))
+		n += n2
+		if err == nil || n == len(p) && err == io.EOF {
+			return n, err
+		}
+		if attempt >= r.policy.Retries || ctx.Err() != nil || !r.retryable(err) {
+			return n, err
+		}
+		if r.policy.MaxBackoff > 0 && backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return n, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (r *RetryingReaderAt) retryable(err error) bool {
+	if r.policy.Retryable != nil {
+		return r.policy.Retryable(err)
+	}
+	return err != io.EOF && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,92 @@
+package zipserve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// flakyReaderAt fails reads with errors from failures before reading from r. A failure after partial
+// data returns half of the requested data.
+type flakyReaderAt struct {
+	r        io.ReaderAt
+	failures []error
+	partial  bool
+	reads    int
+}
+
+func (f *flakyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	f.reads++
+	if len(f.failures) > 0 {
+		err := f.failures[0]
+		f.failures = f.failures[1:]
+		if f.partial {
+			n, _ := f.r.ReadAt(p[:len(p)/2], off)
+			return n, err
+		}
+		return 0, err
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func TestRetryingReaderAt(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	errTransient := errors.New("transient")
+	upstream := &flakyReaderAt{r: bytes.NewReader(data), failures: []error{errTransient, errTransient}, partial: true}
+	r := NewRetryingReaderAt(upstream, RetryPolicy{Retries: 2, Backoff: time.Millisecond})
+	p := make([]byte, 8)
+	n, err := r.ReadAt(p, 4)
+	if err != nil || string(p[:n]) != "456789ab" {
+		t.Fatalf("ReadAt after failures: %q, %v", p[:n], err)
+	}
+	if upstream.reads != 3 {
+		t.Errorf("%d reads, want 3", upstream.reads)
+	}
+
+	upstream.failures = []error{errTransient, errTransient, errTransient}
+	upstream.reads = 0
+	if _, err := r.ReadAt(p, 0); err != errTransient {
+		t.Errorf("error %v after exhausting retries, want %v", err, errTransient)
+	}
+	if upstream.reads != 3 {
+		t.Errorf("%d reads, want 3", upstream.reads)
+	}
+
+	upstream.reads = 0
+	n, err = r.ReadAt(p, 12)
+	if n != 4 || err != io.EOF {
+		t.Errorf("reading over the end: %d, %v, want 4, EOF", n, err)
+	}
+	if upstream.reads != 1 {
+		t.Errorf("%d reads for EOF, want 1", upstream.reads)
+	}
+}
+
+func TestRetryingReaderAtClassifier(t *testing.T) {
+	errPermanent := errors.New("permanent")
+	upstream := &flakyReaderAt{r: bytes.NewReader([]byte("data")), failures: []error{errPermanent}}
+	r := NewRetryingReaderAt(upstream, RetryPolicy{
+		Retries:   5,
+		Backoff:   time.Millisecond,
+		Retryable: func(err error) bool { return err != errPermanent },
+	})
+	if _, err := r.ReadAt(make([]byte, 4), 0); err != errPermanent {
+		t.Errorf("error %v, want %v", err, errPermanent)
+	}
+	if upstream.reads != 1 {
+		t.Errorf("%d reads, want 1", upstream.reads)
+	}
+}
+
+func TestRetryingReaderAtCanceled(t *testing.T) {
+	upstream := &flakyReaderAt{r: bytes.NewReader([]byte("data")), failures: []error{errors.New("transient")}}
+	r := NewRetryingReaderAt(upstream, RetryPolicy{Retries: 1, Backoff: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.ReadAtContext(ctx, make([]byte, 4), 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
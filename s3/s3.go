@@ -0,0 +1,212 @@
+// Package s3 reads content of zipserve archive entries directly from Amazon S3 and compatible object stores.
+//
+// Objects are read using GetObject requests with Range headers, authenticated with AWS Signature Version 4.
+// The package only depends on the standard library.
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPartSize is the maximum number of bytes fetched by a single request if Client.PartSize is zero.
+const DefaultPartSize = 8 << 20
+
+// maxDrain is the maximum number of unread bytes of a response body read before closing it, so that
+// the connection can be reused.
+const maxDrain = 64 << 10
+
+// Credentials are AWS credentials used to sign requests.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is required for temporary credentials, it may be empty otherwise.
+	SessionToken string
+}
+
+// Client reads objects from a S3 endpoint.
+//
+// A Client is safe for concurrent use. Connections are reused across requests as long as HTTPClient's transport
+// keeps them alive, which is the case for http.DefaultTransport.
+type Client struct {
+	// HTTPClient is used to send the requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Endpoint is the base URL of the service, for example "https://s3.eu-central-1.amazonaws.com".
+	Endpoint string
+
+	// Region is the region used to sign requests, for example "eu-central-1".
+	Region string
+
+	// Credentials are used to sign requests. If AccessKeyID is empty, requests are not signed,
+	// which is enough for public objects.
+	Credentials Credentials
+
+	// PathStyle addresses buckets in the path of the URL ("https://endpoint/bucket/key") instead of
+	// the host name ("https://bucket.endpoint/key"). Many S3 compatible stores require path style.
+	PathStyle bool
+
+	// PartSize is the maximum number of bytes fetched by a single request. Larger reads are split into
+	// multiple requests, so that a slow or failed request doesn't need to transfer too much data again.
+	// Zero means DefaultPartSize.
+	PartSize int64
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// Object is the content of an object in a bucket.
+//
+// It implements the ReaderAt interface of zipserve, so it can be used as FileHeader.Content.
+type Object struct {
+	client *Client
+	url    *url.URL
+	size   int64
+	etag   string
+}
+
+// Open returns the object with the given key in bucket.
+//
+// It sends a HEAD request to determine the size of the object. The object must not change while it is being
+// read; reads fail if its ETag changes.
+func (c *Client) Open(ctx context.Context, bucket, key string) (*Object, error) {
+	u, err := c.objectURL(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodHead, u, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HEAD %s: unexpected status %s", u, resp.Status)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("HEAD %s: invalid Content-Length: %w", u, err)
+	}
+	return &Object{client: c, url: u, size: size, etag: resp.Header.Get("Etag")}, nil
+}
+
+// objectURL returns the URL of the object.
+func (c *Client) objectURL(bucket, key string) (*url.URL, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == "" {
+		return nil, errors.New("empty bucket name")
+	}
+	path := "/" + key
+	if c.PathStyle {
+		path = "/" + bucket + path
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = escapePath(u.Path)
+	return u, nil
+}
+
+// do sends a request for the object at u, with the given Range header value if not empty.
+func (c *Client) do(ctx context.Context, method string, u *url.URL, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	if c.Credentials.AccessKeyID != "" {
+		now := time.Now
+		if c.now != nil {
+			now = c.now
+		}
+		sign(req, c.Credentials, c.Region, now())
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+// Size returns the size of the object in bytes.
+func (o *Object) Size() int64 { return o.size }
+
+// ReadAt reads data of the object.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (o *Object) ReadAt(p []byte, off int64) (n int, err error) {
+	return o.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data of the object using one or more range requests.
+//
+// This methods implements ReaderAt interface of zipserve.
+func (o *Object) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	eof := false
+	if max := o.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = true
+	}
+	partSize := o.client.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	for len(p) > 0 {
+		part := p
+		if int64(len(part)) > partSize {
+			part = part[:partSize]
+		}
+		n2, err := o.readPart(ctx, part, off)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+		p = p[n2:]
+		off += int64(n2)
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readPart reads len(p) bytes at off using a single request.
+func (o *Object) readPart(ctx context.Context, p []byte, off int64) (int, error) {
+	resp, err := o.client.do(ctx, http.MethodGet, o.url, fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// drain the rest of a short body so that the connection can be reused
+		io.CopyN(ioutil.Discard, resp.Body, maxDrain)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("GET %s: unexpected status %s", o.url, resp.Status)
+	}
+	if etag := resp.Header.Get("Etag"); o.etag != "" && etag != "" && etag != o.etag {
+		return 0, fmt.Errorf("GET %s: object changed, ETag %s, expected %s", o.url, etag, o.etag)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err != nil {
+		return n, fmt.Errorf("GET %s: %w", o.url, err)
+	}
+	return n, nil
+}
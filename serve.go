@@ -0,0 +1,514 @@
+package zipserve
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeoutResponseWriter delays writing the response status until the first byte of the body is written,
+// so that the response can be replaced if it times out or fails before that.
+type timeoutResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (tw *timeoutResponseWriter) WriteHeader(statusCode int) {
+	if tw.wroteHeader || tw.status != 0 {
+		return
+	}
+	tw.status = statusCode
+}
+
+func (tw *timeoutResponseWriter) Write(p []byte) (int, error) {
+	tw.flushHeader()
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *timeoutResponseWriter) flushHeader() {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	tw.ResponseWriter.WriteHeader(tw.status)
+}
+
+// finish completes the response. If fail is not nil, serving the content failed and fail writes the response
+// instead, unless part of the response was already sent.
+func (tw *timeoutResponseWriter) finish(fail func(w http.ResponseWriter)) {
+	switch {
+	case fail != nil && tw.wroteHeader:
+		// The client already received part of the response, the only option is to abort the connection.
+		panic(http.ErrAbortHandler)
+	case fail != nil:
+		h := tw.ResponseWriter.Header()
+		for _, name := range []string{"Content-Length", "Content-Range", "Content-Type", "Etag", "Last-Modified",
+			"Cache-Control", "Expires"} {
+			h.Del(name)
+		}
+		fail(tw.ResponseWriter)
+	default:
+		tw.flushHeader()
+	}
+}
+
+// respondTimeout is the response to requests whose reads timed out, see ErrTimeout.
+func respondTimeout(w http.ResponseWriter) {
+	http.Error(w, "timeout serving archive", http.StatusServiceUnavailable)
+}
+
+var (
+	// ErrCanceled matches errors reported to hooks like Template.OnError and Metrics.BackendRead when a read failed
+	// because the request was canceled, usually because the client went away.
+	ErrCanceled = errors.New("zip: request canceled")
+	// ErrTimeout matches errors reported to hooks like Template.OnError and Metrics.BackendRead when a read failed
+	// because a deadline expired: Template.ServeTimeout, a deadline of the request context, or a timeout
+	// of the backend itself, like a network timeout.
+	ErrTimeout = errors.New("zip: read timed out")
+)
+
+// classifiedError is an error of a read annotated with ErrCanceled or ErrTimeout.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+
+func (e *classifiedError) Unwrap() error { return e.err }
+
+func (e *classifiedError) Is(target error) bool { return target == e.class }
+
+// classifyReadError annotates err returned from a read with context ctx, so that errors.Is reports whether
+// the read was canceled or timed out. Other errors are returned unchanged.
+func classifyReadError(ctx context.Context, err error) error {
+	if err == nil || err == io.EOF || errors.Is(err, ErrCanceled) || errors.Is(err, ErrTimeout) {
+		return err
+	}
+	var timeout interface{ Timeout() bool }
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		// the backend may fail with an unrelated error when the read is interrupted, so trust the context
+		return &classifiedError{class: ErrCanceled, err: err}
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &timeout) && timeout.Timeout():
+		return &classifiedError{class: ErrTimeout, err: err}
+	default:
+		return err
+	}
+}
+
+// contentForRequest returns the data of the archive to be used by a single request, see Template.RequestContent.
+func (ar *Archive) contentForRequest() ReaderAt {
+	if ar.requestContent == nil {
+		return ar.content
+	}
+	return readerAt(ar.requestContent(requestReaderAt{ar.content}))
+}
+
+// requestReaderAt passes the data of an archive to Template.RequestContent.
+type requestReaderAt struct {
+	ReaderAt
+}
+
+func (r requestReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return r.ReadAtContext(context.TODO(), p, off)
+}
+
+// addHeader adds Template.Header to h, keeping headers that are already set.
+func (c *handlerConfig) addHeader(h http.Header) {
+	for name, values := range c.header {
+		if _, ok := h[name]; !ok {
+			h[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// addCacheHeaders sets Cache-Control and Expires headers configured in Template, unless they are already set.
+func (c *handlerConfig) addCacheHeaders(h http.Header) {
+	if _, ok := h["Cache-Control"]; !ok && c.cacheControl != "" {
+		h.Set("Cache-Control", c.cacheControl)
+	}
+	if _, ok := h["Expires"]; !ok && c.expiresAfter > 0 {
+		h.Set("Expires", time.Now().Add(c.expiresAfter).UTC().Format(http.TimeFormat))
+	}
+}
+
+// attachmentDisposition returns the value of a Content-Disposition header suggesting to download the content
+// as a file with the given name.
+//
+// The name is sent in the filename parameter as a quoted string, with characters other than printable ASCII
+// replaced by underscores. If that changes the name, the exact name is also sent in the filename* parameter
+// encoded as UTF-8 according to RFC 5987, which clients prefer if they support it.
+func attachmentDisposition(name string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range name {
+		if r < ' ' || r > '~' || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	value := `attachment; filename="` + fallback.String() + `"`
+	if fallback.String() != name {
+		value += "; filename*=UTF-8''" + encoded.String()
+	}
+	return value
+}
+
+// isAttrChar reports whether b can be used in RFC 5987 ext-value without percent-encoding.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// recordErrorReaderAt remembers the first error returned from r, classified using classifyReadError.
+type recordErrorReaderAt struct {
+	r   ReaderAt
+	err error
+}
+
+func (e *recordErrorReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	n, err = e.r.ReadAtContext(ctx, p, off)
+	if err != nil && e.err == nil {
+		e.err = classifyReadError(ctx, err)
+	}
+	return n, err
+}
+
+// completionResponseWriter counts and optionally hashes the response body written to the client.
+type completionResponseWriter struct {
+	http.ResponseWriter
+	// written is the number of body bytes written successfully.
+	written int64
+	// hash, if not nil, receives the body bytes written successfully.
+	hash hash.Hash
+}
+
+func (c *completionResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.written += int64(n)
+	if c.hash != nil {
+		c.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+// accountingResponseWriter records the status and the number of body bytes written to the client.
+type accountingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (a *accountingResponseWriter) WriteHeader(statusCode int) {
+	if a.status == 0 {
+		a.status = statusCode
+	}
+	a.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (a *accountingResponseWriter) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(p)
+	a.written += int64(n)
+	return n, err
+}
+
+// disconnectResponseWriter detects failures writing the response to the client.
+//
+// Once a write fails, nothing else is written to the underlying ResponseWriter.
+type disconnectResponseWriter struct {
+	http.ResponseWriter
+	// written is the number of body bytes written successfully.
+	written int64
+	// err is the first write error.
+	err error
+}
+
+func (d *disconnectResponseWriter) WriteHeader(statusCode int) {
+	if d.err != nil {
+		return
+	}
+	d.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (d *disconnectResponseWriter) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.ResponseWriter.Write(p)
+	d.written += int64(n)
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// entryAuthorizer checks access to entries within a single request.
+type entryAuthorizer struct {
+	ar *Archive
+	// checked contains results of authorization of entries by their index.
+	checked map[int]error
+}
+
+func newEntryAuthorizer(ar *Archive) *entryAuthorizer {
+	return &entryAuthorizer{ar: ar, checked: make(map[int]error)}
+}
+
+// check authorizes all entries whose content overlaps the byte range [start, end).
+func (a *entryAuthorizer) check(ctx context.Context, start, end int64) error {
+	return a.ar.forEachContent(start, end, func(i int) error {
+		err, ok := a.checked[i]
+		if !ok {
+			err = a.ar.authorize(ctx, a.ar.entryRanges[i].name)
+			a.checked[i] = err
+		}
+		return err
+	})
+}
+
+// forEachContent calls fn with the index of each entry with non-empty content overlapping the byte range
+// [start, end), stopping at the first error.
+func (ar *Archive) forEachContent(start, end int64, fn func(i int) error) error {
+	ranges := ar.entryRanges
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].contentEnd > start
+	})
+	for ; i < len(ranges) && ranges[i].contentStart < end; i++ {
+		if ranges[i].contentStart == ranges[i].contentEnd {
+			continue
+		}
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizingReaderAt fails reads of content of entries that are not authorized.
+type authorizingReaderAt struct {
+	r    ReaderAt
+	auth *entryAuthorizer
+}
+
+func (a authorizingReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if err := a.auth.check(ctx, off, off+int64(len(p))); err != nil {
+		return 0, err
+	}
+	return a.r.ReadAtContext(ctx, p, off)
+}
+
+type byteRange struct {
+	start, end int64
+}
+
+// requestedRanges returns byte ranges of the archive that will be read to serve the request.
+//
+// The result may be a superset of what http.ServeContent actually reads, for example it returns the whole archive
+// if the Range header is missing, conditional, or malformed.
+func requestedRanges(r *http.Request, size int64) []byteRange {
+	header := r.Header.Get("Range")
+	if header == "" || r.Header.Get("If-Range") != "" {
+		return []byteRange{{start: 0, end: size}}
+	}
+	ranges, ok := parseRanges(header, size)
+	if !ok {
+		return []byteRange{{start: 0, end: size}}
+	}
+	return ranges
+}
+
+// requestedByteRanges returns the byte ranges requested by the Range header of r, nil if there are none.
+// The result is empty but not nil if none of the ranges is satisfiable.
+func requestedByteRanges(r *http.Request, size int64) []ByteRange {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return nil
+	}
+	ranges, ok := parseRanges(header, size)
+	if !ok {
+		return nil
+	}
+	result := make([]ByteRange, len(ranges))
+	for i, rng := range ranges {
+		result[i] = ByteRange{Start: rng.start, End: rng.end}
+	}
+	return result
+}
+
+// parseRanges parses the value of a Range header. ok is false if the header is malformed.
+//
+// Ranges starting at or beyond size are dropped like in net/http, so ranges is empty if none of them is satisfiable.
+func parseRanges(header string, size int64) (ranges []byteRange, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, false
+	}
+	unsatisfiable := false
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, false
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		var rng byteRange
+		if first == "" {
+			// suffix range
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n > size {
+				n = size
+			}
+			rng = byteRange{start: size - n, end: size}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, false
+			}
+			rng = byteRange{start: start, end: size}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, false
+				}
+				if end+1 < size {
+					rng.end = end + 1
+				}
+			}
+			if start >= size {
+				unsatisfiable = true
+				continue
+			}
+		}
+		ranges = append(ranges, rng)
+	}
+	if len(ranges) == 0 && !unsatisfiable {
+		return nil, false
+	}
+	return ranges, true
+}
+
+// limitRanges returns r without the Range header if it requests more than Template.MaxRanges ranges.
+func (c *handlerConfig) limitRanges(r *http.Request) *http.Request {
+	header := r.Header.Get("Range")
+	if c.maxRanges <= 0 || countRanges(header) <= c.maxRanges {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	r2.Header.Del("Range")
+	return r2
+}
+
+// countRanges returns the number of ranges in a Range header value, without validating them.
+func countRanges(header string) int {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0
+	}
+	n := 0
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		if strings.TrimSpace(spec) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// inflateReadSeeker decompresses a deflate stream, supporting seeks by decompressing from the beginning
+// of the stream when needed.
+type inflateReadSeeker struct {
+	src io.ReadSeeker
+	// size is the size of the uncompressed data.
+	size int64
+	// off is the offset of the next Read.
+	off int64
+	// r decompresses src, nil if not started yet.
+	r io.ReadCloser
+	// pos is the offset of the data r returns next.
+	pos int64
+}
+
+func (s *inflateReadSeeker) Read(p []byte) (int, error) {
+	if s.off >= s.size {
+		return 0, io.EOF
+	}
+	if s.r == nil || s.off < s.pos {
+		if _, err := s.src.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if s.r == nil {
+			s.r = flate.NewReader(s.src)
+		} else if err := s.r.(flate.Resetter).Reset(s.src, nil); err != nil {
+			return 0, err
+		}
+		s.pos = 0
+	}
+	if s.off > s.pos {
+		n, err := io.CopyN(ioutil.Discard, s.r, s.off-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > s.size-s.off {
+		p = p[:s.size-s.off]
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.off = s.pos
+	if err == io.EOF && s.off < s.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *inflateReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("zipserve: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("zipserve: negative position")
+	}
+	s.off = offset
+	return offset, nil
+}
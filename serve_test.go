@@ -0,0 +1,861 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingReaderAt blocks reads until the context is done.
+type blockingReaderAt struct{}
+
+func (blockingReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (blockingReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return blockingReaderAt{}.ReadAtContext(context.Background(), p, off)
+}
+
+func TestArchiveServeTimeout(t *testing.T) {
+	tmpl := &Template{
+		Prefix:       blockingReaderAt{},
+		PrefixSize:   10,
+		ServeTimeout: 50 * time.Millisecond,
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- rec
+	}()
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		if etag := rec.Header().Get("Etag"); etag != "" {
+			t.Errorf("unexpected Etag %q", etag)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeHTTP did not return after timeout")
+	}
+}
+
+func TestArchiveServeTimeoutAbort(t *testing.T) {
+	tmpl := &Template{
+		Entries: []*FileHeader{{
+			Name:               "slow.txt",
+			CompressedSize64:   10,
+			UncompressedSize64: 10,
+			Content:            blockingReaderAt{},
+		}},
+		ServeTimeout: 50 * time.Millisecond,
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ar)
+	defer srv.Close()
+
+	// Depending on buffering, the connection is aborted either before or after the headers are received.
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Error("expected error reading aborted response, got nil")
+	}
+}
+
+func TestArchiveServeTimeoutNotExpired(t *testing.T) {
+	data := []byte("hello")
+	tmpl := &Template{
+		Entries: []*FileHeader{{
+			Name:               "fast.txt",
+			CRC32:              crc(data),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(data)),
+			Content:            bytes.NewReader(data),
+		}},
+		ServeTimeout: time.Minute,
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	ar.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	var sig [4]byte
+	if _, err := ar.ReadAt(sig[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), sig[:]) {
+		t.Errorf("body %x, want %x", rec.Body.Bytes(), sig)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", ar.ETag())
+	ar.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+func TestArchiveErrorHandler(t *testing.T) {
+	errBackend := errors.New("backend unavailable")
+	tmpl := metricsTestTemplate(nil, failingReaderAt{err: errBackend})
+	var handled []error
+	tmpl.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = append(handled, err)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "storage unavailable", http.StatusBadGateway)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := ar.entryRanges[1].contentStart
+
+	check := func(name string, rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, http.StatusBadGateway)
+		}
+		if got := rec.Header().Get("Retry-After"); got != "30" {
+			t.Errorf("%s: Retry-After %q, want %q", name, got, "30")
+		}
+		for _, h := range []string{"Content-Range", "Etag"} {
+			if got := rec.Header().Get(h); got != "" {
+				t.Errorf("%s: unexpected %s %q", name, h, got)
+			}
+		}
+		if len(handled) != 1 || !errors.Is(handled[0], errBackend) {
+			t.Errorf("%s: handled errors %v, want %v", name, handled, errBackend)
+		}
+		handled = nil
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+99))
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, req)
+	check("ServeHTTP", rec)
+
+	rec = httptest.NewRecorder()
+	ar.ServeEntry(rec, httptest.NewRequest(http.MethodGet, "/", nil), 1)
+	check("ServeEntry", rec)
+
+	rec = httptest.NewRecorder()
+	ar.ServeEntry(rec, httptest.NewRequest(http.MethodGet, "/", nil), 0)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 1000 || len(handled) != 0 {
+		t.Errorf("healthy entry: status %d, %d bytes, handled errors %v", rec.Code, rec.Body.Len(), handled)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	ar.ServeHTTP(rec, req.WithContext(ctx))
+	if len(handled) != 0 {
+		t.Errorf("handler called for canceled request: %v", handled)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("recovered %v, want %v", r, http.ErrAbortHandler)
+			}
+		}()
+		ar.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	if len(handled) != 0 {
+		t.Errorf("handler called after the body was partially sent: %v", handled)
+	}
+}
+
+func TestAttachmentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "photos.zip", want: `attachment; filename="photos.zip"`},
+		{name: "my photos (2019).zip", want: `attachment; filename="my photos (2019).zip"`},
+		{name: `say "hi".zip`, want: `attachment; filename="say _hi_.zip"; filename*=UTF-8''say%20%22hi%22.zip`},
+		{name: "fotky léto.zip", want: `attachment; filename="fotky l_to.zip"; filename*=UTF-8''fotky%20l%C3%A9to.zip`},
+		{name: "€.zip", want: `attachment; filename="_.zip"; filename*=UTF-8''%E2%82%AC.zip`},
+	}
+	for _, test := range tests {
+		if got := attachmentDisposition(test.name); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestArchiveDownloadName(t *testing.T) {
+	tmpl := metricsTestTemplate(nil, nil)
+	tmpl.DownloadName = "archive.zip"
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+	if got, want := rec.Header().Get("Content-Disposition"), `attachment; filename="archive.zip"`; got != want {
+		t.Errorf("Content-Disposition %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	rec.Header().Set("Content-Disposition", "inline")
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+	if got := rec.Header().Get("Content-Disposition"); got != "inline" {
+		t.Errorf("Content-Disposition %q, want the header set by the caller", got)
+	}
+}
+
+func TestArchiveContentType(t *testing.T) {
+	if err := mime.AddExtensionType(".cbz", "application/vnd.comicbook+zip"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		contentType, downloadName string
+		want                      string
+	}{
+		{want: "application/zip"},
+		{downloadName: "photos.unknown-extension", want: "application/zip"},
+		{downloadName: "issue 1.cbz", want: "application/vnd.comicbook+zip"},
+		{contentType: "application/epub+zip", downloadName: "issue 1.cbz", want: "application/epub+zip"},
+	}
+	for _, test := range tests {
+		tmpl := metricsTestTemplate(nil, nil)
+		tmpl.ContentType = test.contentType
+		tmpl.DownloadName = test.downloadName
+		ar, err := NewArchive(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Range", "bytes=0-9")
+		ar.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Type"); got != test.want {
+			t.Errorf("ContentType %q, DownloadName %q: Content-Type %q, want %q", test.contentType,
+				test.downloadName, got, test.want)
+		}
+		if rec.Code != http.StatusPartialContent || rec.Body.Len() != 10 {
+			t.Errorf("ContentType %q, DownloadName %q: status %d, %d bytes", test.contentType, test.downloadName,
+				rec.Code, rec.Body.Len())
+		}
+	}
+}
+
+func TestArchiveCacheHeaders(t *testing.T) {
+	tmpl := metricsTestTemplate(nil, nil)
+	tmpl.CacheControl = "public, max-age=3600"
+	tmpl.ExpiresAfter = time.Hour
+	tmpl.Header = http.Header{"X-Archive": {"photos"}, "Vary": {"Origin"}}
+	tmpl.Authorize = func(ctx context.Context, entryName string) error {
+		if entryName == "b.txt" {
+			return errors.New("forbidden")
+		}
+		return nil
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, rec *httptest.ResponseRecorder, cached bool) {
+		t.Helper()
+		h := rec.Header()
+		if got := h.Get("X-Archive"); got != "photos" {
+			t.Errorf("%s: X-Archive %q, want %q", name, got, "photos")
+		}
+		if got := h["Vary"]; !reflect.DeepEqual(got, []string{"Accept-Encoding"}) {
+			t.Errorf("%s: Vary %q, want the header set by the caller", name, got)
+		}
+		if !cached {
+			if h.Get("Cache-Control") != "" || h.Get("Expires") != "" {
+				t.Errorf("%s: unexpected caching headers %q, %q", name, h.Get("Cache-Control"), h.Get("Expires"))
+			}
+			return
+		}
+		if got := h.Get("Cache-Control"); got != "public, max-age=3600" {
+			t.Errorf("%s: Cache-Control %q", name, got)
+		}
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			t.Fatalf("%s: Expires: %v", name, err)
+		}
+		if d := time.Until(expires); d < 59*time.Minute || d > time.Hour {
+			t.Errorf("%s: Expires %v from now, want an hour", name, d)
+		}
+	}
+	get := func() (*httptest.ResponseRecorder, *http.Request) {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Vary", "Accept-Encoding")
+		return rec, httptest.NewRequest(http.MethodGet, "/", nil)
+	}
+
+	rec, req := get()
+	req.Header.Set("Range", "bytes=0-9")
+	ar.ServeHTTP(rec, req)
+	check("ServeHTTP", rec, true)
+
+	rec, req = get()
+	ar.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	check("forbidden", rec, false)
+
+	rec, req = get()
+	ar.ServeEntry(rec, req, 0)
+	check("ServeEntry", rec, true)
+}
+
+func TestArchiveMaxRanges(t *testing.T) {
+	var servedRanges int
+	tmpl := metricsTestTemplate(nil, nil)
+	tmpl.MaxRanges = 2
+	tmpl.OnRequestServed = func(r *http.Request, stats RequestStats) {
+		servedRanges = len(stats.Ranges)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rangeHeader string
+		status      int
+		ranges      int
+	}{
+		{rangeHeader: "bytes=0-9", status: http.StatusPartialContent, ranges: 1},
+		{rangeHeader: "bytes=0-9, 100-109", status: http.StatusPartialContent, ranges: 2},
+		{rangeHeader: "bytes=0-9,100-109,200-209", status: http.StatusOK, ranges: 0},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Range", test.rangeHeader)
+		rec := httptest.NewRecorder()
+		ar.ServeHTTP(rec, req)
+		if rec.Code != test.status || servedRanges != test.ranges {
+			t.Errorf("ServeHTTP %s: status %d with %d ranges, want %d with %d", test.rangeHeader, rec.Code, servedRanges,
+				test.status, test.ranges)
+		}
+		if test.status == http.StatusOK && int64(rec.Body.Len()) != ar.Size() {
+			t.Errorf("ServeHTTP %s: %d bytes, want the whole archive", test.rangeHeader, rec.Body.Len())
+		}
+		if got := req.Header.Get("Range"); got != test.rangeHeader {
+			t.Errorf("Range header of the request changed to %q", got)
+		}
+
+		rec = httptest.NewRecorder()
+		ar.ServeEntry(rec, req, 0)
+		if rec.Code != test.status {
+			t.Errorf("ServeEntry %s: status %d, want %d", test.rangeHeader, rec.Code, test.status)
+		}
+	}
+}
+
+func TestArchiveAuthorize(t *testing.T) {
+	public := []byte("public data")
+	secret := []byte("secret data")
+	var calls []string
+	errDenied := errors.New("denied")
+	tmpl := &Template{
+		Entries: []*FileHeader{
+			{
+				Name: "public.txt", CRC32: crc(public), Content: bytes.NewReader(public),
+				CompressedSize64: uint64(len(public)), UncompressedSize64: uint64(len(public)),
+			},
+			{
+				Name: "secret.txt", CRC32: crc(secret), Content: bytes.NewReader(secret),
+				CompressedSize64: uint64(len(secret)), UncompressedSize64: uint64(len(secret)),
+			},
+		},
+		Authorize: func(ctx context.Context, entryName string) error {
+			calls = append(calls, entryName)
+			if entryName == "secret.txt" {
+				return errDenied
+			}
+			return nil
+		},
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 2 {
+		t.Fatalf("got %d files, want 2", len(r.File))
+	}
+	contentRange := func(i int) string {
+		off, err := r.File[i].DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("bytes=%d-%d", off, off+int64(r.File[i].CompressedSize64)-1)
+	}
+
+	tests := []struct {
+		name       string
+		rangeSpec  string
+		wantStatus int
+		wantCalls  []string
+	}{
+		{name: "public entry", rangeSpec: contentRange(0), wantStatus: http.StatusPartialContent,
+			wantCalls: []string{"public.txt"}},
+		{name: "secret entry", rangeSpec: contentRange(1), wantStatus: http.StatusForbidden,
+			wantCalls: []string{"secret.txt"}},
+		{name: "central directory", rangeSpec: fmt.Sprintf("bytes=%d-", ar.CentralDirectoryOffset()),
+			wantStatus: http.StatusPartialContent},
+		{name: "both entries", rangeSpec: contentRange(0) + "," + contentRange(1)[len("bytes="):],
+			wantStatus: http.StatusForbidden, wantCalls: []string{"public.txt", "secret.txt"}},
+		{name: "whole archive", wantStatus: http.StatusForbidden, wantCalls: []string{"public.txt", "secret.txt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls = nil
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.rangeSpec != "" {
+				req.Header.Set("Range", test.rangeSpec)
+			}
+			rec := httptest.NewRecorder()
+			ar.ServeHTTP(rec, req)
+			if rec.Code != test.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, test.wantStatus)
+			}
+			if !reflect.DeepEqual(calls, test.wantCalls) {
+				t.Errorf("Authorize calls %q, want %q", calls, test.wantCalls)
+			}
+			if bytes.Contains(rec.Body.Bytes(), secret) {
+				t.Error("response contains secret data")
+			}
+		})
+	}
+}
+
+// disconnectingResponseWriter simulates a client that closes the connection after limit bytes.
+type disconnectingResponseWriter struct {
+	*httptest.ResponseRecorder
+	limit  int
+	writes int
+}
+
+var errBrokenPipe = errors.New("broken pipe")
+
+func (d *disconnectingResponseWriter) Write(p []byte) (int, error) {
+	d.writes++
+	remaining := d.limit - d.Body.Len()
+	if len(p) <= remaining {
+		return d.ResponseRecorder.Write(p)
+	}
+	n, _ := d.ResponseRecorder.Write(p[:remaining])
+	return n, errBrokenPipe
+}
+
+func TestArchiveOnClientDisconnect(t *testing.T) {
+	var disconnects []int64
+	tmpl := &Template{
+		OnClientDisconnect: func(r *http.Request, bytesSent int64) {
+			disconnects = append(disconnects, bytesSent)
+		},
+	}
+	tmpl.Entries = append(tmpl.Entries, testCreate(t, &WriteTest{Name: "large", Data: make([]byte, 1<<17), Method: Store}))
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &disconnectingResponseWriter{ResponseRecorder: httptest.NewRecorder(), limit: 40000}
+	ar.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(disconnects) != 1 || disconnects[0] != 40000 {
+		t.Errorf("OnClientDisconnect calls %v, want [40000]", disconnects)
+	}
+	if w.writes != 2 {
+		t.Errorf("%d writes to the response, want 2", w.writes)
+	}
+
+	disconnects = nil
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(disconnects) != 0 {
+		t.Errorf("unexpected OnClientDisconnect calls %v", disconnects)
+	}
+	if int64(rec.Body.Len()) != ar.Size() {
+		t.Errorf("response size %d, want %d", rec.Body.Len(), ar.Size())
+	}
+}
+
+// gatedReaderAt blocks reads until gate is closed, signalling entered on the first read.
+type gatedReaderAt struct {
+	entered chan struct{}
+	once    *sync.Once
+	gate    chan struct{}
+}
+
+func (g gatedReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	g.once.Do(func() { close(g.entered) })
+	<-g.gate
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestArchiveMaxConcurrentRequests(t *testing.T) {
+	prefix := gatedReaderAt{entered: make(chan struct{}), once: new(sync.Once), gate: make(chan struct{})}
+	tmpl := &Template{
+		Prefix:                prefix,
+		PrefixSize:            10,
+		MaxConcurrentRequests: 1,
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- rec.Code
+	}()
+	<-prefix.entered
+
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status of request over limit %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+
+	close(prefix.gate)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("status of first request %d, want %d", code, http.StatusOK)
+	}
+
+	rec = httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status after first request finished %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// panicReaderAt panics on read.
+type panicReaderAt struct{}
+
+func (panicReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	panic("read failed")
+}
+
+func TestArchiveMaxConcurrentRequestsPanic(t *testing.T) {
+	ar, err := NewArchive(&Template{Prefix: panicReaderAt{}, PrefixSize: 10, MaxConcurrentRequests: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("request %d: expected panic", i)
+				}
+			}()
+			ar.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+	}
+}
+
+func TestArchiveServeEntry(t *testing.T) {
+	plain := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 1000)
+	compressed := deflate(plain)
+	tmpl := &Template{
+		Entries: []*FileHeader{
+			{
+				Name:               "first.txt",
+				Method:             Store,
+				CRC32:              crc([]byte("first")),
+				CompressedSize64:   5,
+				UncompressedSize64: 5,
+				Content:            bytes.NewReader([]byte("first")),
+			},
+			{
+				Name:               "fox.txt",
+				Method:             Deflate,
+				CRC32:              crc(plain),
+				CompressedSize64:   uint64(len(compressed)),
+				UncompressedSize64: uint64(len(plain)),
+				Content:            bytes.NewReader(compressed),
+			},
+		},
+	}
+
+	get := func(ar *Archive, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		ar.ServeEntry(rec, req, 1)
+		return rec
+	}
+
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := get(ar, "bytes=10-99")
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), compressed[10:100]) {
+		t.Error("raw range does not match compressed data")
+	}
+	if got, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes 10-99/%d", len(compressed)); got != want {
+		t.Errorf("Content-Range %q, want %q", got, want)
+	}
+	rawETag := rec.Header().Get("Etag")
+	if want := fmt.Sprintf("%08x", crc(plain)); !bytes.Contains([]byte(rawETag), []byte(want)) {
+		t.Errorf("Etag %q does not contain CRC32 %s", rawETag, want)
+	}
+
+	rec = get(ar, "")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), compressed) {
+		t.Errorf("full raw response: status %d, body matches: %v", rec.Code, bytes.Equal(rec.Body.Bytes(), compressed))
+	}
+
+	tmpl.ServeEntryDecompressed = true
+	ar, err = NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rng := range [][2]int{{30000, 30099}, {5, 9}, {len(plain) - 10, len(plain) - 1}} {
+		rec = get(ar, fmt.Sprintf("bytes=%d-%d", rng[0], rng[1]))
+		if rec.Code != http.StatusPartialContent {
+			t.Fatalf("status %d, want %d", rec.Code, http.StatusPartialContent)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), plain[rng[0]:rng[1]+1]) {
+			t.Errorf("decompressed range %v does not match", rng)
+		}
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type %q", got)
+	}
+	if rec.Header().Get("Etag") == rawETag {
+		t.Error("decompressed content has the same Etag as the raw content")
+	}
+}
+
+func TestArchiveHashResponses(t *testing.T) {
+	type completion struct {
+		bytesSent int64
+		digest    []byte
+	}
+	var completions []completion
+	tmpl := &Template{
+		HashResponses: func() hash.Hash { return sha256.New() },
+		OnRequestComplete: func(r *http.Request, bytesSent int64, digest []byte) {
+			completions = append(completions, completion{bytesSent: bytesSent, digest: digest})
+		},
+	}
+	for i := range writeTests {
+		tmpl.Entries = append(tmpl.Entries, testCreate(t, &writeTests[i]))
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(completions) != 2 {
+		t.Fatalf("got %d completions, want 2", len(completions))
+	}
+	wantFull := sha256.Sum256(all)
+	if completions[0].bytesSent != int64(len(all)) || !bytes.Equal(completions[0].digest, wantFull[:]) {
+		t.Errorf("full response: %d bytes with digest %x, want %d bytes with digest %x",
+			completions[0].bytesSent, completions[0].digest, len(all), wantFull)
+	}
+	wantRange := sha256.Sum256(all[100:200])
+	if completions[1].bytesSent != 100 || !bytes.Equal(completions[1].digest, wantRange[:]) {
+		t.Errorf("range response: %d bytes with digest %x, want 100 bytes with digest %x",
+			completions[1].bytesSent, completions[1].digest, wantRange)
+	}
+
+	// only bytes actually written are hashed
+	completions = nil
+	w := &disconnectingResponseWriter{ResponseRecorder: httptest.NewRecorder(), limit: 1000}
+	ar.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(completions) != 1 {
+		t.Fatalf("got %d completions, want 1", len(completions))
+	}
+	written := w.Body.Bytes()
+	wantPartial := sha256.Sum256(written)
+	if completions[0].bytesSent != int64(len(written)) || !bytes.Equal(completions[0].digest, wantPartial[:]) {
+		t.Errorf("disconnected response: %d bytes with digest %x, want %d bytes with digest %x",
+			completions[0].bytesSent, completions[0].digest, len(written), wantPartial)
+	}
+}
+
+func TestArchiveServeLastByte(t *testing.T) {
+	data := []byte("last byte")
+	template := func() *Template {
+		return &Template{
+			Comment: "comment!",
+			Entries: []*FileHeader{{
+				Name:               "file.txt",
+				CRC32:              crc(data),
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(data)),
+				Content:            bytes.NewReader(data),
+			}},
+		}
+	}
+	ar, err := NewArchive(template())
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := archiveBytes(t, ar)
+	withTimeout := template()
+	withTimeout.ServeTimeout = time.Minute
+	arTimeout, err := NewArchive(withTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives := map[string]*Archive{
+		"default":      ar,
+		"ServeTimeout": arTimeout,
+		"bytes":        NewArchiveFromBytes(full, time.Time{}, ""),
+	}
+	size := int64(len(full))
+	for name, ar := range archives {
+		t.Run(name, func(t *testing.T) {
+			var last [1]byte
+			n, err := ar.ReadAtContext(context.Background(), last[:], size-1)
+			if n != 1 || (err != nil && err != io.EOF) {
+				t.Fatalf("ReadAtContext at size-1: %d, %v", n, err)
+			}
+			if last[0] != '!' {
+				t.Errorf("last byte %q, want %q", last[0], '!')
+			}
+
+			for _, rng := range []string{fmt.Sprintf("bytes=%d-%d", size-1, size-1), "bytes=-1"} {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Range", rng)
+				ar.ServeHTTP(rec, req)
+				if rec.Code != http.StatusPartialContent {
+					t.Fatalf("%s: status %d, want %d", rng, rec.Code, http.StatusPartialContent)
+				}
+				wantRange := fmt.Sprintf("bytes %d-%d/%d", size-1, size-1, size)
+				if got := rec.Header().Get("Content-Range"); got != wantRange {
+					t.Errorf("%s: Content-Range %q, want %q", rng, got, wantRange)
+				}
+				if got := rec.Header().Get("Content-Length"); got != "1" {
+					t.Errorf("%s: Content-Length %q, want 1", rng, got)
+				}
+				if got := rec.Body.String(); got != "!" {
+					t.Errorf("%s: body %q, want %q", rng, got, "!")
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveOnRequestServed(t *testing.T) {
+	var got []RequestStats
+	tmpl := metricsTestTemplate(nil, nil)
+	tmpl.OnRequestServed = func(r *http.Request, stats RequestStats) {
+		got = append(got, stats)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ar.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=0-9,-5")
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=x")
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+	ar.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "/", nil))
+	size := ar.Size()
+	// ranges starting beyond the end are not satisfiable
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", size))
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-9,%d-%d", size+100, size+200))
+	ar.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := []RequestStats{
+		{Status: http.StatusOK, BytesSent: size},
+		{Status: http.StatusPartialContent, Ranges: []ByteRange{{Start: 0, End: 10}, {Start: size - 5, End: size}}},
+		{Status: http.StatusRequestedRangeNotSatisfiable},
+		{Status: http.StatusOK},
+		{Status: http.StatusRequestedRangeNotSatisfiable, Ranges: []ByteRange{}},
+		{Status: http.StatusPartialContent, BytesSent: 10, Ranges: []ByteRange{{Start: 0, End: 10}}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d calls, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if i == 1 {
+			// multipart response includes boundaries
+			if got[i].BytesSent <= 15 {
+				t.Errorf("request %d: %d bytes sent, want more than 15", i, got[i].BytesSent)
+			}
+			got[i].BytesSent = 0
+		}
+		if got[i].Status == http.StatusRequestedRangeNotSatisfiable {
+			// error message
+			got[i].BytesSent = 0
+		}
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("request %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Package sftp reads content of zipserve archive entries from files on SFTP servers.
+//
+// The package doesn't implement the SFTP protocol itself, it manages a pool of connections created by a Dial
+// function, for example using github.com/pkg/sftp:
+//
+//	type conn struct{ *sftp.Client }
+//
+//	func (c conn) Open(path string) (zipsftp.File, error) { return c.Client.Open(path) }
+//
+//	pool := &zipsftp.Pool{
+//		Dial: func(ctx context.Context) (zipsftp.Conn, error) {
+//			sshClient, err := ssh.Dial("tcp", addr, config)
+//			if err != nil {
+//				return nil, err
+//			}
+//			client, err := sftp.NewClient(sshClient)
+//			if err != nil {
+//				sshClient.Close()
+//				return nil, err
+//			}
+//			return conn{client}, nil
+//		},
+//		MaxConns: 4,
+//	}
+//
+// The connection of the example doesn't close the underlying SSH connection, a real implementation should.
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrPoolClosed is returned when reading using a Pool that was closed.
+var ErrPoolClosed = errors.New("sftp: pool closed")
+
+// File is a remote file opened for reading.
+type File interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Conn is a connection to a SFTP server.
+type Conn interface {
+	// Open opens the file with the given path for reading.
+	Open(path string) (File, error)
+	// Close closes the connection.
+	Close() error
+}
+
+// Pool maintains connections to a SFTP server.
+//
+// A Pool is safe for concurrent use. The zero value is not usable, Dial must be set.
+type Pool struct {
+	// Dial creates a new connection.
+	Dial func(ctx context.Context) (Conn, error)
+
+	// MaxConns limits the number of connections, including idle ones. Zero means no limit.
+	MaxConns int
+
+	// MaxIdle limits the number of idle connections kept for reuse. Zero means MaxConns, or no limit
+	// if MaxConns is zero too.
+	MaxIdle int
+
+	mu    sync.Mutex
+	idle  []Conn
+	conns int
+	// closed is set by Close.
+	closed bool
+	// released is signalled when a connection is returned or closed while MaxConns is reached.
+	released chan struct{}
+}
+
+// Close closes idle connections. Connections in use are closed once they are returned to the pool.
+// Reads that need a connection after Close fail with ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	// wake up reads waiting for a connection, they fail now
+	p.signal()
+	idle := p.idle
+	p.idle = nil
+	p.conns -= len(idle)
+	p.mu.Unlock()
+	var firstErr error
+	for _, c := range idle {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// File returns the content of the remote file with the given path and size.
+//
+// The returned value may be used as FileHeader.Content. The file is opened on each read.
+func (p *Pool) File(path string, size int64) *RemoteFile {
+	return &RemoteFile{pool: p, path: path, size: size}
+}
+
+// get returns an idle connection or dials a new one, waiting if MaxConns connections are in use.
+func (p *Pool) get(ctx context.Context) (Conn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if n := len(p.idle); n > 0 {
+			c := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+			return c, nil
+		}
+		if p.MaxConns <= 0 || p.conns < p.MaxConns {
+			p.conns++
+			p.mu.Unlock()
+			c, err := p.Dial(ctx)
+			if err != nil {
+				p.discard(nil)
+				return nil, err
+			}
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				p.discard(c)
+				return nil, ErrPoolClosed
+			}
+			return c, nil
+		}
+		if p.released == nil {
+			p.released = make(chan struct{})
+		}
+		released := p.released
+		p.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// put returns a healthy connection to the pool. The connection is closed if the pool is closed.
+func (p *Pool) put(c Conn) {
+	p.mu.Lock()
+	maxIdle := p.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = p.MaxConns
+	}
+	if p.closed || maxIdle > 0 && len(p.idle) >= maxIdle {
+		p.mu.Unlock()
+		p.discard(c)
+		return
+	}
+	p.idle = append(p.idle, c)
+	p.signal()
+	p.mu.Unlock()
+}
+
+// discard closes a broken or superfluous connection.
+func (p *Pool) discard(c Conn) {
+	if c != nil {
+		c.Close()
+	}
+	p.mu.Lock()
+	p.conns--
+	p.signal()
+	p.mu.Unlock()
+}
+
+// signal wakes up goroutines waiting in get. p.mu must be held.
+func (p *Pool) signal() {
+	if p.released != nil {
+		close(p.released)
+		p.released = nil
+	}
+}
+
+// RemoteFile is the content of a file on a SFTP server.
+//
+// It implements the ReaderAt interface of zipserve, so it can be used as FileHeader.Content.
+type RemoteFile struct {
+	pool *Pool
+	path string
+	size int64
+}
+
+// Size returns the size of the file in bytes.
+func (f *RemoteFile) Size() int64 { return f.size }
+
+// ReadAt reads data of the file.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (n int, err error) {
+	return f.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data of the file using a connection from the pool.
+//
+// If the read fails for other reasons than a missing file or insufficient permissions, the connection is assumed
+// to be broken: it is closed and the read is retried once with a new connection.
+//
+// This methods implements ReaderAt interface of zipserve.
+func (f *RemoteFile) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	eof := false
+	if max := f.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = true
+	}
+	for attempt := 0; ; attempt++ {
+		n, err = f.readAt(ctx, p, off)
+		if err == nil || attempt > 0 || ctx.Err() != nil || !retryable(err) {
+			break
+		}
+	}
+	if err == nil && eof {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readAt reads from the file using a single connection.
+func (f *RemoteFile) readAt(ctx context.Context, p []byte, off int64) (n int, err error) {
+	conn, err := f.pool.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	file, err := conn.Open(f.path)
+	if err != nil {
+		f.release(conn, err)
+		return 0, err
+	}
+	n, err = file.ReadAt(p, off)
+	closeErr := file.Close()
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	if err == nil {
+		err = closeErr
+	}
+	f.release(conn, err)
+	return n, err
+}
+
+// release returns the connection to the pool, or discards it if err indicates that it is broken.
+func (f *RemoteFile) release(conn Conn, err error) {
+	if err != nil && retryable(err) {
+		f.pool.discard(conn)
+		return
+	}
+	f.pool.put(conn)
+}
+
+// retryable reports whether err may be caused by a broken connection.
+func retryable(err error) bool {
+	return !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission) && err != io.EOF
+}
@@ -0,0 +1,197 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errBroken = errors.New("connection lost")
+
+type fakeServer struct {
+	mu     sync.Mutex
+	files  map[string][]byte
+	dials  int
+	open   int
+	closed int
+	// failReads is the number of reads that fail with errBroken.
+	failReads int
+}
+
+func (s *fakeServer) dial(ctx context.Context) (Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dials++
+	s.open++
+	return &fakeConn{server: s}, nil
+}
+
+type fakeConn struct {
+	server *fakeServer
+}
+
+func (c *fakeConn) Open(path string) (File, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	data, ok := c.server.files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return &fakeFile{server: c.server, r: bytes.NewReader(data)}, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.open--
+	c.server.closed++
+	return nil
+}
+
+type fakeFile struct {
+	server *fakeServer
+	r      *bytes.Reader
+}
+
+func (f *fakeFile) ReadAt(p []byte, off int64) (int, error) {
+	f.server.mu.Lock()
+	fail := f.server.failReads > 0
+	if fail {
+		f.server.failReads--
+	}
+	f.server.mu.Unlock()
+	if fail {
+		return 0, errBroken
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func (f *fakeFile) Close() error { return nil }
+
+func TestRemoteFileRead(t *testing.T) {
+	server := &fakeServer{files: map[string][]byte{"a.txt": []byte("hello world")}}
+	pool := &Pool{Dial: server.dial}
+	f := pool.File("a.txt", 11)
+	buf := make([]byte, 8)
+	n, err := f.ReadAt(buf, 6)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF at end of file, got %v", err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Fatalf("got %q", buf[:n])
+	}
+	n, err = f.ReadAt(buf[:5], 0)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	if server.dials != 1 {
+		t.Errorf("expected connection reuse, got %d dials", server.dials)
+	}
+	if _, err := f.ReadAt(buf, 11); err != io.EOF {
+		t.Errorf("expected io.EOF past end of file, got %v", err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if server.open != 0 {
+		t.Errorf("%d connections left open", server.open)
+	}
+}
+
+func TestRemoteFileReconnect(t *testing.T) {
+	server := &fakeServer{files: map[string][]byte{"a.txt": []byte("hello world")}, failReads: 1}
+	pool := &Pool{Dial: server.dial}
+	buf := make([]byte, 5)
+	n, err := pool.File("a.txt", 11).ReadAt(buf, 0)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	if server.dials != 2 || server.closed != 1 {
+		t.Errorf("expected broken connection to be replaced, got %d dials, %d closed", server.dials, server.closed)
+	}
+
+	server.failReads = 2
+	if _, err := pool.File("a.txt", 11).ReadAt(buf, 0); !errors.Is(err, errBroken) {
+		t.Errorf("expected error after failed retry, got %v", err)
+	}
+}
+
+func TestRemoteFileNotExist(t *testing.T) {
+	server := &fakeServer{files: map[string][]byte{}}
+	pool := &Pool{Dial: server.dial}
+	_, err := pool.File("missing", 10).ReadAt(make([]byte, 5), 0)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if server.dials != 1 || server.closed != 0 {
+		t.Errorf("expected connection to be kept, got %d dials, %d closed", server.dials, server.closed)
+	}
+}
+
+func TestPoolMaxConns(t *testing.T) {
+	server := &fakeServer{}
+	pool := &Pool{Dial: server.dial, MaxConns: 1}
+	ctx := context.Background()
+	c, err := pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.get(timeoutCtx); err != context.DeadlineExceeded {
+		t.Fatalf("expected to wait for a connection, got %v", err)
+	}
+
+	got := make(chan Conn)
+	go func() {
+		c, err := pool.get(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- c
+	}()
+	pool.put(c)
+	if c2 := <-got; c2 != c {
+		t.Error("expected the returned connection to be reused")
+	}
+	if server.dials != 1 {
+		t.Errorf("expected 1 dial, got %d", server.dials)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	server := &fakeServer{}
+	pool := &Pool{Dial: server.dial, MaxConns: 1}
+	ctx := context.Background()
+	c, err := pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waiting := make(chan error)
+	go func() {
+		_, err := pool.get(ctx)
+		waiting <- err
+	}()
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waiting; err != ErrPoolClosed {
+		t.Errorf("waiting get: got %v, want %v", err, ErrPoolClosed)
+	}
+	if _, err := pool.get(ctx); err != ErrPoolClosed {
+		t.Errorf("get after Close: got %v, want %v", err, ErrPoolClosed)
+	}
+
+	// the connection in use is closed once it is returned
+	pool.put(c)
+	if server.open != 0 {
+		t.Errorf("%d connections left open", server.open)
+	}
+}
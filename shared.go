@@ -0,0 +1,94 @@
+package zipserve
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// SharedFileReaderAt serves content of multiple entries from a single underlying file.
+//
+// It is useful when many entries are stored in one large file (for example a pack file), so that only a single
+// file descriptor is needed for all of them. Each entry obtains its own view using Section.
+//
+// SharedFileReaderAt is safe for concurrent use as long as the underlying io.ReaderAt is.
+// *os.File satisfies this requirement as ReadAt uses positioned reads.
+type SharedFileReaderAt struct {
+	r   ReaderAt
+	sem chan struct{}
+}
+
+// NewSharedFileReaderAt creates a new SharedFileReaderAt reading from r.
+//
+// At most maxConcurrentReads reads are issued to r simultaneously. Zero or negative value means no limit.
+//
+// r may implement ReaderAt interface from this package, in that case r's ReadAtContext method will be called
+// instead of ReadAt.
+func NewSharedFileReaderAt(r io.ReaderAt, maxConcurrentReads int) *SharedFileReaderAt {
+	s := &SharedFileReaderAt{r: readerAt(r)}
+	if maxConcurrentReads > 0 {
+		s.sem = make(chan struct{}, maxConcurrentReads)
+	}
+	return s
+}
+
+// Section returns a view of size bytes of the underlying file starting at offset off.
+//
+// The returned value may be used as FileHeader.Content. Sections may overlap, so entries with the same data can
+// share a single copy of it in the underlying file. Sections are read independently; to avoid fetching the shared
+// data repeatedly, r passed to NewSharedFileReaderAt may be a CachingReaderAt.
+func (s *SharedFileReaderAt) Section(off, size int64) *SharedFileSection {
+	return &SharedFileSection{shared: s, off: off, size: size}
+}
+
+func (s *SharedFileReaderAt) readAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if s.sem != nil {
+		select {
+		case s.sem <- struct{}{}:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		defer func() { <-s.sem }()
+	}
+	return s.r.ReadAtContext(ctx, p, off)
+}
+
+// SharedFileSection is a byte range of a SharedFileReaderAt.
+type SharedFileSection struct {
+	shared *SharedFileReaderAt
+	off    int64
+	size   int64
+}
+
+// Size returns the size of the section in bytes.
+func (s *SharedFileSection) Size() int64 { return s.size }
+
+// ReadAt reads data of the section.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (s *SharedFileSection) ReadAt(p []byte, off int64) (n int, err error) {
+	return s.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data of the section.
+//
+// This methods implements ReaderAt interface.
+func (s *SharedFileSection) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	if max := s.size - off; int64(len(p)) > max {
+		p = p[:max]
+		n, err = s.shared.readAtContext(ctx, p, s.off+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return s.shared.readAtContext(ctx, p, s.off+off)
+}
@@ -0,0 +1,205 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSharedFileReaderAt(t *testing.T) {
+	contents := []string{"first entry", "", "second entry data", "third"}
+
+	f, err := ioutil.TempFile("", "zipserve-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	shared := NewSharedFileReaderAt(f, 2)
+	tmpl := &Template{}
+	var off int64
+	for i, c := range contents {
+		if _, err := f.WriteString(c); err != nil {
+			t.Fatal(err)
+		}
+		fh := &FileHeader{
+			Name:               string(rune('a'+i)) + ".txt",
+			Method:             Store,
+			CRC32:              crc([]byte(c)),
+			CompressedSize64:   uint64(len(c)),
+			UncompressedSize64: uint64(len(c)),
+		}
+		if len(c) > 0 {
+			fh.Content = shared.Section(off, int64(len(c)))
+		}
+		tmpl.Entries = append(tmpl.Entries, fh)
+		off += int64(len(c))
+	}
+
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != len(contents) {
+		t.Fatalf("got %d files, want %d", len(r.File), len(contents))
+	}
+	for i, want := range contents {
+		rc, err := r.File[i].Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", r.File[i].Name, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", r.File[i].Name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", r.File[i].Name, got, want)
+		}
+	}
+}
+
+func TestSharedFileSection_ReadAtBounds(t *testing.T) {
+	f, err := ioutil.TempFile("", "zipserve-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString("abcdefgh"); err != nil {
+		t.Fatal(err)
+	}
+
+	section := NewSharedFileReaderAt(f, 0).Section(2, 4)
+	p := make([]byte, 10)
+	n, err := section.ReadAt(p, 1)
+	if n != 3 || string(p[:n]) != "def" {
+		t.Errorf("got %q, want %q", p[:n], "def")
+	}
+	if err == nil {
+		t.Error("expected EOF for short read, got nil")
+	}
+	if _, err := section.ReadAt(p, 4); err != io.EOF {
+		t.Errorf("reading past section: got %v, want EOF", err)
+	}
+	if _, err := section.ReadAt(p, -1); err == nil || err == io.EOF {
+		t.Errorf("reading at negative offset: got %v, want an error other than EOF", err)
+	}
+}
+
+// countingSource is an io.ReaderAt that counts reads of each offset.
+type countingSource struct {
+	data  []byte
+	mu    sync.Mutex
+	reads map[int64]int
+}
+
+func (c *countingSource) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	c.reads[off]++
+	c.mu.Unlock()
+	return bytes.NewReader(c.data).ReadAt(p, off)
+}
+
+func TestSharedFileReaderAtOverlapping(t *testing.T) {
+	data := []byte("deduplicated content shared by entries")
+	source := &countingSource{data: data, reads: make(map[int64]int)}
+	shared := NewSharedFileReaderAt(source, 0)
+	entry := func(name string, off, size int64) *FileHeader {
+		part := data[off : off+size]
+		return &FileHeader{
+			Name:               name,
+			CRC32:              crc(part),
+			CompressedSize64:   uint64(size),
+			UncompressedSize64: uint64(size),
+			Content:            shared.Section(off, size),
+		}
+	}
+	size := int64(len(data))
+	ar, err := NewArchive(&Template{Entries: []*FileHeader{
+		entry("first.txt", 0, size),
+		entry("copy.txt", 0, size),
+		entry("suffix.txt", 13, size-13),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", f.Name, err)
+		}
+		if f.Name == "suffix.txt" {
+			if !bytes.Equal(got, data[13:]) {
+				t.Errorf("%s: got %q, want %q", f.Name, got, data[13:])
+			}
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("%s: got %q, want %q", f.Name, got, data)
+		}
+	}
+
+	// concurrent range requests for the content of each entry
+	source.mu.Lock()
+	source.reads = make(map[int64]int)
+	source.mu.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				rng := ar.entryRanges[i]
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rng.contentStart, rng.contentEnd-1))
+				rec := httptest.NewRecorder()
+				ar.ServeHTTP(rec, req)
+				want := data
+				if i == 2 {
+					want = data[13:]
+				}
+				if !bytes.Equal(rec.Body.Bytes(), want) {
+					t.Errorf("entry %d: got %q, want %q", i, rec.Body.Bytes(), want)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	if source.reads[0] != 8 || source.reads[13] != 4 {
+		t.Errorf("source reads %v, want 8 reads at offset 0 and 4 at offset 13", source.reads)
+	}
+
+	// with a cache, the shared data is fetched once
+	source.reads = make(map[int64]int)
+	cached := NewSharedFileReaderAt(NewCachingReaderAt(source, cacheBlockSize), 0)
+	for _, section := range []*SharedFileSection{cached.Section(0, size), cached.Section(0, size), cached.Section(13, size-13)} {
+		p := make([]byte, section.Size())
+		if _, err := section.ReadAt(p, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(source.reads) != 1 || source.reads[0] != 1 {
+		t.Errorf("source reads with cache %v, want a single read at offset 0", source.reads)
+	}
+}
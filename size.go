@@ -0,0 +1,145 @@
+package zipserve
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SizeBreakdown describes how the size of an archive is composed.
+type SizeBreakdown struct {
+	// Prefix is the size of Template.Prefix or Template.PrefixParts.
+	Prefix int64
+	// RawParts is the total size of Template.RawParts.
+	RawParts int64
+	// LocalHeaders is the total size of local file headers, including names and extra fields.
+	LocalHeaders int64
+	// Content is the total size of entry contents.
+	Content int64
+	// DataDescriptors is the total size of data descriptors.
+	DataDescriptors int64
+	// Padding is the size of padding inserted before the central directory due to Template.EOCDAlignment.
+	Padding int64
+	// CentralDirectory is the size of the central directory headers.
+	CentralDirectory int64
+	// DirectoryEnd is the size of the end of central directory records, including the zip64 records and
+	// the archive comment.
+	DirectoryEnd int64
+	// Zip64 reports whether the archive uses zip64 end of central directory records.
+	Zip64 bool
+}
+
+// Total returns the size of the whole archive.
+func (b SizeBreakdown) Total() int64 {
+	return b.dataSize() + b.CentralDirectory + b.DirectoryEnd
+}
+
+// dataSize returns the size of the archive before the central directory.
+func (b SizeBreakdown) dataSize() int64 {
+	return b.Prefix + b.RawParts + b.LocalHeaders + b.Content + b.DataDescriptors + b.Padding
+}
+
+// CalculateSize computes the size of the archive that NewArchive would create from the template.
+//
+// Unlike NewArchive, CalculateSize does not modify the template and does not allocate the archive structures,
+// so it is cheap to call for planning purposes. It returns the same errors as NewArchive for invalid templates.
+func CalculateSize(t *Template) (SizeBreakdown, error) {
+	var b SizeBreakdown
+	if err := validateComment(t.Comment); err != nil {
+		return b, err
+	}
+	if err := validateRawParts(t); err != nil {
+		return b, err
+	}
+	if err := validateLegacyCompat(t); err != nil {
+		return b, err
+	}
+	prefix, err := templatePrefix(t)
+	if err != nil {
+		return b, err
+	}
+	for _, part := range prefix {
+		b.Prefix += part.size
+	}
+	rawPartsSize := func(before int) int64 {
+		var size int64
+		for _, part := range t.RawParts {
+			if part.Before == before {
+				size += part.Size
+			}
+		}
+		return size
+	}
+
+	for i, entry := range t.Entries {
+		if err := validateEntry(entry); err != nil {
+			return b, err
+		}
+		if err := validateName(t, entry.Name); err != nil {
+			return b, err
+		}
+		b.RawParts += rawPartsSize(i)
+		offset := uint64(b.dataSize())
+		extraLen := int64(len(entry.Extra))
+		if extendedTimestamp(t, entry) {
+			extraLen += extTimeExtraLen
+		}
+		isDir := strings.HasSuffix(entry.Name, "/")
+		size := entry.CompressedSize64
+		isZip64 := false
+		if isDir {
+			size = 0
+		} else {
+			isZip64 = entry.isZip64()
+		}
+
+		if !isDir && entry.Encrypted && entry.EncryptionMethod.aesStrength() != 0 {
+			extraLen += aesExtraLen
+		}
+		localExtraLen := extraLen
+		if !isDir && (t.OmitDataDescriptors && isZip64 || t.Zip64LocalHeaders) {
+			localExtraLen += 20 // zip64 extra with sizes
+		}
+		if localExtraLen > uint16max {
+			return b, errLongExtra
+		}
+		b.LocalHeaders += fileHeaderLen + int64(len(entry.Name)) + localExtraLen
+		b.Content += int64(size)
+		if (!isDir || t.DirDataDescriptors) && !t.OmitDataDescriptors && !t.Zip64LocalHeaders {
+			if isZip64 {
+				b.DataDescriptors += dataDescriptor64Len
+			} else {
+				b.DataDescriptors += dataDescriptorLen
+			}
+		}
+
+		centralExtraLen := extraLen
+		if isZip64 || offset >= uint32max {
+			centralExtraLen += 28 // zip64 extra with sizes and offset
+		}
+		b.CentralDirectory += directoryHeaderLen + int64(len(entry.Name)) + centralExtraLen + int64(len(entry.Comment))
+	}
+
+	b.RawParts += rawPartsSize(len(t.Entries))
+	b.Padding, err = directoryPadding(t, b.dataSize())
+	if err != nil {
+		return b, err
+	}
+	start := uint64(b.dataSize())
+	commentLen := len(t.Comment)
+	if t.CommentWithDirectoryOffset {
+		commentLen += len(fmt.Sprintf("\x00CDOFF:%d", start))
+		if commentLen > uint16max {
+			return b, errors.New("comment with directory offset too long")
+		}
+	}
+	b.DirectoryEnd = directoryEndLen + int64(commentLen)
+	if len(t.Entries) >= uint16max || uint64(b.CentralDirectory) >= uint32max || start >= uint32max {
+		b.Zip64 = true
+		b.DirectoryEnd += directory64EndLen + directory64LocLen
+		if t.DirectoryChecksum {
+			b.DirectoryEnd += directoryChecksumLen
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,95 @@
+package zipserve
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCalculateSize(t *testing.T) {
+	entries := func() []*FileHeader {
+		var result []*FileHeader
+		for _, wt := range writeTests {
+			if wt.Data == nil {
+				continue
+			}
+			h := testCreate(t, &wt)
+			h.Comment = "comment of " + wt.Name
+			result = append(result, h)
+		}
+		return append(result, &FileHeader{Name: "dir/", Extra: []byte{0xff, 0xff, 1, 0, 42}})
+	}
+	huge := func() []*FileHeader {
+		const size = 1 << 32
+		return []*FileHeader{
+			{
+				Name:               "huge.txt",
+				UncompressedSize64: size,
+				CompressedSize64:   size,
+				Content:            io.NewSectionReader(&sameBytes{b: 0}, 0, size),
+			},
+			{Name: "after.txt"},
+		}
+	}
+	prefix := []byte("prefix data")
+
+	tests := []struct {
+		name      string
+		template  func() *Template
+		wantZip64 bool
+	}{
+		{name: "empty", template: func() *Template { return &Template{} }},
+		{name: "entries", template: func() *Template { return &Template{Entries: entries()} }},
+		{name: "prefix and comment", template: func() *Template {
+			return &Template{
+				Prefix:     bytes.NewReader(prefix),
+				PrefixSize: int64(len(prefix)),
+				Comment:    "archive comment",
+				Entries:    entries(),
+			}
+		}},
+		{name: "directory offset comment", template: func() *Template {
+			return &Template{Entries: entries(), CommentWithDirectoryOffset: true}
+		}},
+		{name: "omit data descriptors", template: func() *Template {
+			return &Template{Entries: entries(), OmitDataDescriptors: true}
+		}},
+		{name: "zip64 local headers", template: func() *Template {
+			return &Template{Entries: entries(), Zip64LocalHeaders: true}
+		}},
+		{name: "eocd alignment", template: func() *Template {
+			return &Template{Entries: entries(), EOCDAlignment: 4096, CommentWithDirectoryOffset: true}
+		}},
+		{name: "zip64", template: func() *Template { return &Template{Entries: huge()} }, wantZip64: true},
+		{name: "zip64 omit data descriptors", template: func() *Template {
+			return &Template{Entries: huge(), OmitDataDescriptors: true}
+		}, wantZip64: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breakdown, err := CalculateSize(test.template())
+			if err != nil {
+				t.Fatalf("CalculateSize: %v", err)
+			}
+			ar, err := NewArchive(test.template())
+			if err != nil {
+				t.Fatalf("NewArchive: %v", err)
+			}
+			if got, want := breakdown.Total(), ar.Size(); got != want {
+				t.Errorf("total size %d, want %d (%+v)", got, want, breakdown)
+			}
+			if got, want := breakdown.Total()-breakdown.CentralDirectory-breakdown.DirectoryEnd,
+				ar.CentralDirectoryOffset(); got != want {
+				t.Errorf("central directory offset %d, want %d", got, want)
+			}
+			if breakdown.Zip64 != test.wantZip64 {
+				t.Errorf("zip64 %v, want %v", breakdown.Zip64, test.wantZip64)
+			}
+		})
+	}
+
+	_, err := CalculateSize(&Template{Entries: []*FileHeader{{Name: "file.txt", CompressedSize64: 5}}})
+	if err == nil {
+		t.Error("expected error for missing content, got nil")
+	}
+}
@@ -0,0 +1,30 @@
+//go:build go1.21
+// +build go1.21
+
+package zipserve
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var _ Logger = (*slog.Logger)(nil)
+
+func TestArchiveSlog(t *testing.T) {
+	var buf bytes.Buffer
+	tmpl := metricsTestTemplate(nil, failingReaderAt{err: errors.New("backend failure")})
+	tmpl.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if out := buf.String(); !strings.Contains(out, `level=ERROR msg="zipserve: reading entry failed" entry=b.txt offset=0`) {
+		t.Errorf("unexpected log output %q", out)
+	}
+}
@@ -0,0 +1,143 @@
+// Package sqlblob reads content of zipserve archive entries from BLOB columns of SQL databases.
+//
+// Blobs are read in parts using queries that select a substring of the column, so whole blobs are never loaded
+// into memory. The package works with any database/sql driver; the queries are provided by the user since
+// the syntax differs between databases.
+package sqlblob
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultPartSize is the maximum number of bytes fetched by a single query if Table.PartSize is zero.
+const DefaultPartSize = 1 << 20
+
+// Queryer executes queries returning a single row.
+//
+// It is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type Queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Table reads blobs stored in a column of a database table.
+//
+// A Table is safe for concurrent use if DB is.
+type Table struct {
+	// DB executes the queries.
+	DB Queryer
+
+	// RangeQuery selects a part of a blob. The first two query arguments are the 1-based position of the first byte
+	// and the number of bytes, followed by the key passed to Open or Blob.
+	//
+	// For example "SELECT SUBSTR(data, ?, ?) FROM files WHERE id = ?" for SQLite and MySQL or
+	// "SELECT substring(data FROM $1 FOR $2) FROM files WHERE id = $3" for PostgreSQL.
+	RangeQuery string
+
+	// SizeQuery selects the size of a blob in bytes. The query arguments are the key passed to Open.
+	// It is only needed by Open.
+	//
+	// For example "SELECT LENGTH(data) FROM files WHERE id = ?" for SQLite and MySQL or
+	// "SELECT octet_length(data) FROM files WHERE id = $1" for PostgreSQL.
+	SizeQuery string
+
+	// PartSize is the maximum number of bytes fetched by a single query. Larger reads are split into
+	// multiple queries. Zero means DefaultPartSize.
+	PartSize int64
+}
+
+// Blob is the content of a BLOB value.
+//
+// It implements the ReaderAt interface of zipserve, so it can be used as FileHeader.Content.
+type Blob struct {
+	table *Table
+	key   []interface{}
+	size  int64
+}
+
+// Open returns the blob identified by key, querying its size with SizeQuery.
+func (t *Table) Open(ctx context.Context, key ...interface{}) (*Blob, error) {
+	if t.SizeQuery == "" {
+		return nil, errors.New("sqlblob: SizeQuery not set")
+	}
+	var size sql.NullInt64
+	if err := t.DB.QueryRowContext(ctx, t.SizeQuery, key...).Scan(&size); err != nil {
+		return nil, fmt.Errorf("sqlblob: query size of %v: %w", key, err)
+	}
+	if !size.Valid {
+		return nil, fmt.Errorf("sqlblob: blob %v is NULL", key)
+	}
+	return t.Blob(size.Int64, key...), nil
+}
+
+// Blob returns the blob identified by key with a known size, without querying the database.
+func (t *Table) Blob(size int64, key ...interface{}) *Blob {
+	return &Blob{table: t, key: key, size: size}
+}
+
+// Size returns the size of the blob in bytes.
+func (b *Blob) Size() int64 { return b.size }
+
+// ReadAt reads data of the blob.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (b *Blob) ReadAt(p []byte, off int64) (n int, err error) {
+	return b.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data of the blob using one or more range queries.
+//
+// This methods implements ReaderAt interface of zipserve.
+func (b *Blob) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	eof := false
+	if max := b.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = true
+	}
+	partSize := b.table.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	for len(p) > 0 {
+		part := p
+		if int64(len(part)) > partSize {
+			part = part[:partSize]
+		}
+		n2, err := b.readPart(ctx, part, off)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+		p = p[n2:]
+		off += int64(n2)
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readPart reads len(p) bytes at off using a single query.
+func (b *Blob) readPart(ctx context.Context, p []byte, off int64) (int, error) {
+	args := make([]interface{}, 0, 2+len(b.key))
+	args = append(args, off+1, int64(len(p)))
+	args = append(args, b.key...)
+	var data []byte
+	if err := b.table.DB.QueryRowContext(ctx, b.table.RangeQuery, args...).Scan(&data); err != nil {
+		return 0, fmt.Errorf("sqlblob: read blob %v: %w", b.key, err)
+	}
+	n := copy(p, data)
+	if len(data) != len(p) {
+		return n, fmt.Errorf("sqlblob: read blob %v: got %d bytes at offset %d, expected %d: %w",
+			b.key, len(data), off, len(p), io.ErrUnexpectedEOF)
+	}
+	return n, nil
+}
@@ -0,0 +1,218 @@
+package sqlblob
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martin-sucha/zipserve"
+)
+
+const (
+	testRangeQuery = "SELECT SUBSTR(data, ?, ?) FROM blobs WHERE id = ?"
+	testSizeQuery  = "SELECT LENGTH(data) FROM blobs WHERE id = ?"
+)
+
+// fakeDriver implements just enough of a database to run testRangeQuery and testSizeQuery.
+type fakeDriver struct {
+	mu      sync.Mutex
+	blobs   map[string][]byte
+	queries int
+}
+
+var testDriver = &fakeDriver{blobs: make(map[string][]byte)}
+
+func init() {
+	sql.Register("sqlblobtest", testDriver)
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn{d}, nil }
+
+func (d *fakeDriver) set(key string, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.blobs[key] = data
+}
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if query != testRangeQuery && query != testSizeQuery {
+		return nil, errors.New("unsupported query")
+	}
+	return fakeStmt{c.d, query}, nil
+}
+
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s fakeStmt) Close() error { return nil }
+
+func (s fakeStmt) NumInput() int { return strings.Count(s.query, "?") }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.queries++
+	data, ok := s.d.blobs[args[len(args)-1].(string)]
+	if !ok {
+		return &fakeRows{}, nil
+	}
+	if s.query == testSizeQuery {
+		return &fakeRows{values: []driver.Value{int64(len(data))}}, nil
+	}
+	// SUBSTR semantics: 1-based start, result truncated at the end of the value.
+	start, length := args[0].(int64)-1, args[1].(int64)
+	if start > int64(len(data)) {
+		start = int64(len(data))
+	}
+	end := start + length
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return &fakeRows{values: []driver.Value{append([]byte(nil), data[start:end]...)}}, nil
+}
+
+type fakeRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"value"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done || r.values == nil {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+func openTestTable(t *testing.T, partSize int64) *Table {
+	db, err := sql.Open("sqlblobtest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Table{DB: db, RangeQuery: testRangeQuery, SizeQuery: testSizeQuery, PartSize: partSize}
+}
+
+func TestBlobReadAt(t *testing.T) {
+	testDriver.set("blob1", []byte("0123456789abcdef"))
+	table := openTestTable(t, 5)
+	blob, err := table.Open(context.Background(), "blob1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Size() != 16 {
+		t.Fatalf("expected size 16, got %d", blob.Size())
+	}
+	testDriver.mu.Lock()
+	testDriver.queries = 0
+	testDriver.mu.Unlock()
+
+	buf := make([]byte, 12)
+	n, err := blob.ReadAt(buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "23456789abcd" {
+		t.Fatalf("got %q", buf[:n])
+	}
+	if testDriver.queries != 3 {
+		t.Errorf("expected read split into 3 queries, got %d", testDriver.queries)
+	}
+
+	n, err = blob.ReadAt(buf, 10)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if string(buf[:n]) != "abcdef" {
+		t.Fatalf("got %q", buf[:n])
+	}
+	if _, err := blob.ReadAt(buf, 16); err != io.EOF {
+		t.Fatalf("expected io.EOF past end, got %v", err)
+	}
+}
+
+func TestBlobChanged(t *testing.T) {
+	testDriver.set("blob2", []byte("0123456789"))
+	table := openTestTable(t, 0)
+	blob := table.Blob(10, "blob2")
+	testDriver.set("blob2", []byte("01234"))
+	_, err := blob.ReadAt(make([]byte, 8), 0)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	table := openTestTable(t, 0)
+	if _, err := table.Open(context.Background(), "missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestServeArchive(t *testing.T) {
+	content := bytes.Repeat([]byte("stored in a database "), 1000)
+	testDriver.set("archived", content)
+	table := openTestTable(t, 4096)
+	blob, err := table.Open(context.Background(), "archived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := zipserve.NewArchive(&zipserve.Template{
+		Entries: []*zipserve.FileHeader{{
+			Name:               "data.txt",
+			Method:             zip.Store,
+			Modified:           time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			CRC32:              crc32.ChecksumIEEE(content),
+			CompressedSize64:   uint64(len(content)),
+			UncompressedSize64: uint64(len(content)),
+			Content:            blob,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("content mismatch")
+	}
+}
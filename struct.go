@@ -5,6 +5,7 @@
 package zipserve
 
 import (
+	"context"
 	"io"
 	"os"
 	"path"
@@ -43,6 +44,7 @@ const (
 	// Version numbers.
 	zipVersion20 = 20 // 2.0
 	zipVersion45 = 45 // 4.5 (reads and writes zip64 archives)
+	zipVersion51 = 51 // 5.1 (AES encryption)
 
 	// Limits for non zip64 files.
 	uint16max = (1 << 16) - 1
@@ -59,8 +61,55 @@ const (
 	// See http://mdfs.net/Docs/Comp/Archiving/Zip/ExtraField
 	zip64ExtraID   = 0x0001 // Zip64 extended information
 	extTimeExtraID = 0x5455 // Extended timestamp
+	aesExtraID     = 0x9901 // WinZip AES encryption
+
+	// directoryChecksumID identifies the block with CRC32 of the central directory headers
+	// in the zip64 extensible data sector. It is specific to this package.
+	directoryChecksumID  = 0x737a // "zs"
+	directoryChecksumLen = 10     // SizeOf(uint16) + 2*SizeOf(uint32)
+
+	aesExtraLen = 11 // 2*SizeOf(uint16) + SizeOf(uint16) + 2*SizeOf(uint8) + SizeOf(uint8) + SizeOf(uint16)
+
+	// methodAES is the compression method of entries encrypted with WinZip AES.
+	// The actual compression method is stored in the AES extra field.
+	methodAES = 99
+)
+
+// ExtraField identifies a kind of extra field in file headers, see Template.ExtraOrder.
+type ExtraField int
+
+// Kinds of extra fields.
+const (
+	ExtraUser      ExtraField = iota // fields from FileHeader.Extra
+	ExtraTimestamp                   // extended timestamp generated from FileHeader.Modified
+	ExtraZip64                       // zip64 extended information
+	ExtraAES                         // WinZip AES encryption, see FileHeader.Encrypted
 )
 
+// EncryptionMethod identifies how encrypted content of an entry was encrypted.
+type EncryptionMethod uint8
+
+// Encryption methods.
+const (
+	ZipCrypto EncryptionMethod = iota // traditional PKWARE encryption
+	AES128                            // WinZip AES with 128-bit key
+	AES192                            // WinZip AES with 192-bit key
+	AES256                            // WinZip AES with 256-bit key
+)
+
+// aesStrength returns the AES strength stored in the AES extra field or 0 if m is not AES.
+func (m EncryptionMethod) aesStrength() uint8 {
+	switch m {
+	case AES128:
+		return 1
+	case AES192:
+		return 2
+	case AES256:
+		return 3
+	}
+	return 0
+}
+
 // FileHeader describes a file within a zip file.
 // See the zip spec for details.
 type FileHeader struct {
@@ -85,6 +134,12 @@ type FileHeader struct {
 	// automatically sets the ZIP format's UTF-8 flag for valid UTF-8 strings.
 	NonUTF8 bool
 
+	// PreserveUTF8Flag keeps the UTF-8 flag (0x800) in Flags as is, instead of setting or clearing it
+	// based on NonUTF8 and the contents of Name and Comment.
+	//
+	// ParseArchive sets it for entries that had the flag set, so that they are written with the flag again.
+	PreserveUTF8Flag bool
+
 	CreatorVersion uint16
 	ReaderVersion  uint16
 	Flags          uint16
@@ -96,12 +151,13 @@ type FileHeader struct {
 	//
 	// An extended timestamp (which is timezone-agnostic) is always emitted.
 	// The legacy MS-DOS date field is encoded according to the
-	// location of the Modified time.
+	// location of the Modified time, unless Template.MSDOSTimeUTC is set.
 	Modified time.Time
 
 	// CRC32 is a checksum of the uncompressed file data.
 	//
 	// It can be created using crc32.NewIEEE() from hash/crc32 package.
+	// If it is zero and Content implements CRC32Provider, the provided checksum is used.
 	CRC32 uint32
 
 	CompressedSize64   uint64
@@ -118,7 +174,39 @@ type FileHeader struct {
 	//
 	// Content may implement ReaderAt interface from this package, in that case
 	// Content's ReadAtContext method will be called instead of ReadAt.
+	//
+	// Content must be nil if CompressedSize64 is zero, as non-nil Content of zero size is usually a mistake
+	// of not filling in the sizes. An exception is Content that reports zero size using a Size method,
+	// like an empty bytes.Reader.
 	Content io.ReaderAt
+
+	// PresetDictionary indicates that Content was compressed using a preset dictionary.
+	//
+	// Deflate streams in ZIP files cannot refer to a preset dictionary, so readers would not be able to decompress
+	// such content. NewArchive returns an error for entries with PresetDictionary set.
+	PresetDictionary bool
+
+	// ContentTransform, if not nil, is applied in place to the bytes read from Content before they are returned
+	// from the archive.
+	//
+	// off is the offset of p[0] within the content of the entry. The transform must be deterministic and depend only
+	// on the position within the content so that reads of different byte ranges are consistent.
+	// It must not change the length of the data, so CompressedSize64 and CRC32 must describe the transformed content.
+	//
+	// If ContentTransform returns an error, the read fails with that error.
+	ContentTransform func(ctx context.Context, p []byte, off int64) error
+
+	// Encrypted indicates that Content is already encrypted using EncryptionMethod.
+	//
+	// zipserve does not encrypt data, it only writes the headers readers need to decrypt the content,
+	// so Content must include the encryption header (and for AES, the salt, password verifier and
+	// authentication code) and CompressedSize64 must include their size.
+	// For AES, Method is the compression method used before encryption; the headers record method 99 and
+	// keep the actual method in the AES extra field. The AE-2 format is used if CRC32 is zero, AE-1 otherwise.
+	Encrypted bool
+
+	// EncryptionMethod is the method used to encrypt Content if Encrypted is set.
+	EncryptionMethod EncryptionMethod
 }
 
 // FileInfo returns an os.FileInfo for the FileHeader.
@@ -0,0 +1,141 @@
+package zipserve
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttleChunkSize is the maximum number of bytes written at once by throttledResponseWriter.
+const throttleChunkSize = 32 * 1024
+
+// rateLimiter is a token bucket limiting the rate of bytes written.
+//
+// Waiting callers reserve tokens in advance, so concurrent callers share the rate fairly in the order they arrive.
+type rateLimiter struct {
+	// rate is the number of bytes per second.
+	rate int64
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+
+	mu sync.Mutex
+	// tokens available at time last, negative if reserved by waiting callers.
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, now: time.Now}
+}
+
+// burst is the maximum number of tokens accumulated while idle, which is also the largest allowed wait size.
+func (l *rateLimiter) burst() int64 {
+	if l.rate < throttleChunkSize {
+		return l.rate
+	}
+	return throttleChunkSize
+}
+
+// wait blocks until n bytes may be written or ctx is done. n must not be larger than burst.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// the bytes won't be written, let other callers use the tokens
+		l.cancel(n)
+		return ctx.Err()
+	}
+}
+
+// cancel returns n tokens reserved by a caller that gave up waiting.
+func (l *rateLimiter) cancel(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += float64(n)
+	if burst := float64(l.burst()); l.tokens > burst {
+		l.tokens = burst
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller has to wait until they are available.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.last.IsZero() {
+		l.tokens = float64(l.burst())
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if burst := float64(l.burst()); l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// throttledResponseWriter limits the rate of writing the response body.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	// limiters are waited for before each chunk is written.
+	limiters []*rateLimiter
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (n int, err error) {
+	chunkSize := throttleChunkSize
+	for _, l := range t.limiters {
+		if burst := int(l.burst()); burst < chunkSize {
+			chunkSize = burst
+		}
+	}
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		for i, l := range t.limiters {
+			if err := l.wait(t.ctx, len(chunk)); err != nil {
+				// the chunk won't be written, return the tokens taken from the limiters waited for already
+				for _, waited := range t.limiters[:i] {
+					waited.cancel(len(chunk))
+				}
+				return n, err
+			}
+		}
+		n2, err := t.ResponseWriter.Write(chunk)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+		p = p[n2:]
+	}
+	return n, nil
+}
+
+// throttle wraps w to honor Template.MaxRequestRate and Template.MaxArchiveRate.
+func (c *handlerConfig) throttle(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	var limiters []*rateLimiter
+	if c.maxRequestRate > 0 {
+		limiters = append(limiters, newRateLimiter(c.maxRequestRate))
+	}
+	if c.archiveLimiter != nil {
+		limiters = append(limiters, c.archiveLimiter)
+	}
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}
+}
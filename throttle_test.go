@@ -0,0 +1,134 @@
+package zipserve
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(1000)
+	l.now = func() time.Time { return now }
+
+	// a full bucket allows a burst of one second worth of data
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("first reservation waits %v, want 0", d)
+	}
+	if d := l.reserve(500); d != 500*time.Millisecond {
+		t.Errorf("second reservation waits %v, want 500ms", d)
+	}
+	// reservations of waiting callers are queued
+	if d := l.reserve(500); d != time.Second {
+		t.Errorf("third reservation waits %v, want 1s", d)
+	}
+	now = now.Add(10 * time.Second)
+	// idle time doesn't accumulate more than the burst
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("reservation after idle waits %v, want 0", d)
+	}
+	if d := l.reserve(100); d != 100*time.Millisecond {
+		t.Errorf("reservation after burst waits %v, want 100ms", d)
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	l := newRateLimiter(1)
+	l.reserve(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRateLimiterCancelReturnsTokens(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(1000)
+	l.now = func() time.Time { return now }
+	l.reserve(1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 500); err != context.Canceled {
+		t.Errorf("error %v, want %v", err, context.Canceled)
+	}
+	// the canceled reservation doesn't delay the next caller
+	if d := l.reserve(500); d != 500*time.Millisecond {
+		t.Errorf("reservation after cancel waits %v, want 500ms", d)
+	}
+}
+
+func TestThrottledWriteCanceled(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first, second := newRateLimiter(1000), newRateLimiter(1000)
+	first.now = func() time.Time { return now }
+	second.now = func() time.Time { return now }
+	// the second limiter is exhausted, so the write waits for it after taking tokens from the first one
+	second.reserve(1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	w := &throttledResponseWriter{ResponseWriter: rec, ctx: ctx, limiters: []*rateLimiter{first, second}}
+	if n, err := w.Write(make([]byte, 500)); n != 0 || err != context.Canceled {
+		t.Errorf("Write: %d, %v, want 0, %v", n, err, context.Canceled)
+	}
+	// both limiters got the tokens of the unwritten chunk back
+	if d := first.reserve(1000); d != 0 {
+		t.Errorf("first limiter waits %v, want 0", d)
+	}
+	if d := second.reserve(500); d != 500*time.Millisecond {
+		t.Errorf("second limiter waits %v, want 500ms", d)
+	}
+}
+
+func TestArchiveMaxRequestRate(t *testing.T) {
+	tmpl := &Template{
+		Prefix:         bytes.NewReader(make([]byte, 50000)),
+		PrefixSize:     50000,
+		MaxRequestRate: 100000,
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	elapsed := time.Since(start)
+	if rec.Code != http.StatusOK || int64(rec.Body.Len()) != ar.Size() {
+		t.Fatalf("status %d, %d bytes, want 200, %d bytes", rec.Code, rec.Body.Len(), ar.Size())
+	}
+	// the first 32 KiB are sent immediately, the rest at 100 kB/s
+	if want := 150 * time.Millisecond; elapsed < want {
+		t.Errorf("response took %v, want at least %v", elapsed, want)
+	}
+}
+
+func TestArchiveMaxArchiveRate(t *testing.T) {
+	tmpl := &Template{
+		Prefix:         bytes.NewReader(make([]byte, 20000)),
+		PrefixSize:     20000,
+		MaxArchiveRate: 100000,
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two requests share the limit, so together they exceed the burst
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		ar.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK || int64(rec.Body.Len()) != ar.Size() {
+			t.Fatalf("status %d, %d bytes, want 200, %d bytes", rec.Code, rec.Body.Len(), ar.Size())
+		}
+	}
+	if want := 50 * time.Millisecond; time.Since(start) < want {
+		t.Errorf("responses took %v, want at least %v", time.Since(start), want)
+	}
+}
@@ -0,0 +1,370 @@
+package zipserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URLEntry describes an entry of a Template backed by a HTTP URL.
+type URLEntry struct {
+	// Name is the name of the entry in the archive.
+	Name string
+	// URL is the location of the entry content.
+	URL string
+	// CRC32 is a checksum of the content. It is used only if HasCRC32 is true,
+	// otherwise the checksum is computed by downloading the content.
+	CRC32    uint32
+	HasCRC32 bool
+}
+
+// TemplateFromURLs creates a Template with entries whose content is fetched from URLs.
+//
+// The size and modification time of each entry is determined by a HEAD request. The servers must support range
+// requests, as the content is fetched lazily using range requests when the archive is read.
+// Entries are stored uncompressed.
+//
+// If client is nil, http.DefaultClient is used.
+func TemplateFromURLs(ctx context.Context, client *http.Client, entries []URLEntry) (*Template, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	t := &Template{
+		Entries: make([]*FileHeader, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		fh, err := urlFileHeader(ctx, client, entry)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", entry.Name, err)
+		}
+		t.Entries = append(t.Entries, fh)
+	}
+	return t, nil
+}
+
+func urlFileHeader(ctx context.Context, client *http.Client, entry URLEntry) (*FileHeader, error) {
+	req, err := http.NewRequest(http.MethodHead, entry.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HEAD %s: unexpected status %s", entry.URL, resp.Status)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return nil, fmt.Errorf("HEAD %s: server does not support range requests", entry.URL)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("HEAD %s: invalid Content-Length", entry.URL)
+	}
+
+	content := &HTTPReaderAt{Client: client, URL: entry.URL}
+	fh := &FileHeader{
+		Name:               entry.Name,
+		Method:             Store,
+		CRC32:              entry.CRC32,
+		CompressedSize64:   uint64(size),
+		UncompressedSize64: uint64(size),
+	}
+	if size > 0 {
+		fh.Content = content
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		if modified, err := http.ParseTime(lastModified); err == nil {
+			fh.Modified = modified
+		}
+	}
+	if !entry.HasCRC32 {
+		fh.CRC32, err = urlCRC32(ctx, client, entry.URL, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fh, nil
+}
+
+// urlCRC32 computes CRC32 of the content at url by downloading it.
+func urlCRC32(ctx context.Context, client *http.Client, url string, size int64) (uint32, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(hash, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if n != size {
+		return 0, fmt.Errorf("GET %s: got %d bytes, expected %d", url, n, size)
+	}
+	return hash.Sum32(), nil
+}
+
+// HTTPReaderAt reads data from a URL using HTTP range requests, so that entry content can be stored on any web server
+// or CDN supporting them.
+//
+// Failed requests are retried: network errors, 5xx and 429 responses, responses with an unexpected Content-Range
+// and truncated responses. Other responses, like 404, fail the read immediately. If a server returns a shorter range
+// than requested, the rest is requested again.
+//
+// Presigned URLs, which expire after some time, are supported by setting Refresh.
+//
+// HTTPReaderAt is safe for concurrent use. It must not be copied after first use.
+type HTTPReaderAt struct {
+	// Client is used to send the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// URL is the location of the data. It is replaced by URLs returned from Refresh.
+	URL string
+
+	// Refresh returns a new URL of the data when the current one has expired, which is detected by a 401 or 403
+	// response. This is useful for presigned URLs, which may expire in the middle of a long download.
+	// A read fails if the request with the refreshed URL is rejected too.
+	//
+	// If nil, 401 and 403 responses fail the read.
+	Refresh func(ctx context.Context) (string, error)
+
+	// Retries is the maximum number of times a failed request is retried.
+	Retries int
+
+	// Backoff is the delay before the first retry, it is doubled for each subsequent retry.
+	// Zero means DefaultHTTPBackoff.
+	Backoff time.Duration
+
+	// MaxBackoff limits the delay between retries. Zero means DefaultHTTPMaxBackoff.
+	MaxBackoff time.Duration
+
+	// mu protects url.
+	mu sync.Mutex
+	// url is the URL returned by the last call to Refresh, or empty if Refresh wasn't called yet.
+	url string
+}
+
+// DefaultHTTPBackoff is the delay before the first retry of HTTPReaderAt if Backoff is zero.
+const DefaultHTTPBackoff = 100 * time.Millisecond
+
+// DefaultHTTPMaxBackoff is the limit of the delay between retries of HTTPReaderAt if MaxBackoff is zero.
+const DefaultHTTPMaxBackoff = 10 * time.Second
+
+// errRetry marks errors of requests that may be retried.
+type errRetry struct {
+	err error
+}
+
+func (e errRetry) Error() string { return e.err.Error() }
+
+// errExpired marks errors of requests rejected because the URL may have expired.
+type errExpired struct {
+	err error
+}
+
+func (e errExpired) Error() string { return e.err.Error() }
+
+// ReadAt reads data from the URL.
+//
+// This is same as calling ReadAtContext with context.TODO()
+//
+// See io.ReaderAt for the interface.
+func (h *HTTPReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return h.ReadAtContext(context.TODO(), p, off)
+}
+
+// ReadAtContext reads data from the URL using a range request, retrying failed requests.
+//
+// This methods implements ReaderAt interface.
+func (h *HTTPReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	// servers may return less data than requested, request the rest until the end of the data
+	for n < len(p) {
+		n2, err := h.readRange(ctx, p[n:], off+int64(n))
+		n += n2
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readRange reads a prefix of p from the URL using a single range request, retrying failed requests.
+// It returns io.EOF if the end of the data is reached.
+func (h *HTTPReaderAt) readRange(ctx context.Context, p []byte, off int64) (n int, err error) {
+	backoff := h.Backoff
+	if backoff <= 0 {
+		backoff = DefaultHTTPBackoff
+	}
+	maxBackoff := h.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultHTTPMaxBackoff
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		url := h.currentURL()
+		n, err = h.readAt(ctx, url, p, off)
+		var expired errExpired
+		if errors.As(err, &expired) {
+			if refreshed {
+				return n, expired.err
+			}
+			refreshed = true
+			if err := h.refresh(ctx, url); err != nil {
+				return 0, err
+			}
+			// requests with an expired URL don't count as retries
+			attempt--
+			continue
+		}
+		var retry errRetry
+		if !errors.As(err, &retry) {
+			return n, err
+		}
+		if attempt >= h.Retries {
+			return n, retry.err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// currentURL returns the URL to use for requests.
+func (h *HTTPReaderAt) currentURL() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.url != "" {
+		return h.url
+	}
+	return h.URL
+}
+
+// refresh replaces expired URL with a new one returned by Refresh.
+//
+// If another read already replaced the expired URL, Refresh is not called again.
+func (h *HTTPReaderAt) refresh(ctx context.Context, expired string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := h.url
+	if current == "" {
+		current = h.URL
+	}
+	if current != expired {
+		return nil
+	}
+	url, err := h.Refresh(ctx)
+	if err != nil {
+		return fmt.Errorf("refresh URL: %w", err)
+	}
+	h.url = url
+	return nil
+}
+
+// readAt sends a single range request to url and reads the returned range into a prefix of p. It returns io.EOF
+// if the range is shorter than p because it ends at the end of the data. Errors that may be resolved by retrying are wrapped in errRetry,
+// errors that may be resolved by refreshing the URL are wrapped in errExpired.
+func (h *HTTPReaderAt) readAt(ctx context.Context, url string, p []byte, off int64) (n int, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, err
+		}
+		return 0, errRetry{err}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return 0, errRetry{fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)}
+	case (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && h.Refresh != nil:
+		return 0, errExpired{fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)}
+	default:
+		return 0, fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+
+	start, end, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil || start != off || end < start || end >= off+int64(len(p)) {
+		return 0, errRetry{fmt.Errorf("GET %s: unexpected Content-Range %q for offset %d and length %d", url,
+			resp.Header.Get("Content-Range"), off, len(p))}
+	}
+	length := end - start + 1
+	n, err = io.ReadFull(resp.Body, p[:length])
+	if err != nil {
+		if ctx.Err() != nil {
+			return n, err
+		}
+		return 0, errRetry{fmt.Errorf("GET %s: %w", url, err)}
+	}
+	if length < int64(len(p)) && end+1 == total {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// parseContentRange parses the value of Content-Range header of a 206 response, like "bytes 0-99/1000".
+// total is -1 if the total size is unknown, as in "bytes 0-99/*".
+func parseContentRange(s string) (start, end, total int64, err error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	i := strings.IndexByte(s, '-')
+	j := strings.IndexByte(s, '/')
+	if i < 0 || j < i {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	start, err = strconv.ParseInt(s[len(prefix):i], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	end, err = strconv.ParseInt(s[i+1:j], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if s[j+1:] == "*" {
+		return start, end, -1, nil
+	}
+	total, err = strconv.ParseInt(s[j+1:], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return start, end, total, nil
+}
@@ -0,0 +1,346 @@
+package zipserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTemplateFromURLs(t *testing.T) {
+	files := map[string]string{
+		"/a.txt": "content of a",
+		"/b.txt": "content of b, a bit longer",
+	}
+	modified := time.Date(2019, 3, 4, 5, 6, 8, 0, time.UTC)
+	var ranges int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranges++
+		}
+		http.ServeContent(w, r, "", modified, bytes.NewReader([]byte(data)))
+	}))
+	defer srv.Close()
+
+	tmpl, err := TemplateFromURLs(context.Background(), srv.Client(), []URLEntry{
+		{Name: "a.txt", URL: srv.URL + "/a.txt"},
+		{Name: "b.txt", URL: srv.URL + "/b.txt", CRC32: crc([]byte(files["/b.txt"])), HasCRC32: true},
+	})
+	if err != nil {
+		t.Fatalf("TemplateFromURLs: %v", err)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranges != 0 {
+		t.Errorf("content fetched with %d range requests before reading the archive", ranges)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a.txt", "b.txt"} {
+		f := r.File[i]
+		if f.Name != name {
+			t.Errorf("file %d: name %q, want %q", i, f.Name, name)
+		}
+		if !f.Modified.Equal(modified) {
+			t.Errorf("%s: modified %v, want %v", name, f.Modified, modified)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want := files["/"+name]; string(data) != want {
+			t.Errorf("%s: data %q, want %q", name, data, want)
+		}
+	}
+	if ranges == 0 {
+		t.Error("expected content to be fetched using range requests")
+	}
+
+	_, err = TemplateFromURLs(context.Background(), srv.Client(), []URLEntry{
+		{Name: "missing.txt", URL: srv.URL + "/missing.txt"},
+	})
+	if err == nil {
+		t.Error("expected error for missing URL, got nil")
+	}
+}
+
+func TestTemplateFromURLsNoRangeSupport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		if r.Method != http.MethodHead {
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer srv.Close()
+
+	_, err := TemplateFromURLs(context.Background(), srv.Client(), []URLEntry{
+		{Name: "a.txt", URL: srv.URL},
+	})
+	if err == nil {
+		t.Error("expected error for server without range support, got nil")
+	}
+}
+
+func TestHTTPReaderAtRetries(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	var failures []func(w http.ResponseWriter)
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/data" {
+			http.NotFound(w, r)
+			return
+		}
+		if len(failures) > 0 {
+			fail := failures[0]
+			failures = failures[1:]
+			fail(w)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	unavailable := func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) }
+	wrongRange := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Range", "bytes 0-3/16")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:4])
+	}
+	truncated := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Range", "bytes 4-7/16")
+		w.Header().Set("Content-Length", "4")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[4:6])
+	}
+
+	h := &HTTPReaderAt{Client: srv.Client(), URL: srv.URL + "/data", Retries: 3, Backoff: time.Millisecond}
+	failures = []func(w http.ResponseWriter){unavailable, wrongRange, truncated}
+	p := make([]byte, 4)
+	n, err := h.ReadAt(p, 4)
+	if err != nil || string(p[:n]) != "4567" {
+		t.Errorf("ReadAt after failures: %q, %v", p[:n], err)
+	}
+	if requests != 4 {
+		t.Errorf("%d requests, want 4", requests)
+	}
+
+	unknownTotal := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Range", "bytes 4-7/*")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[4:8])
+	}
+	requests = 0
+	failures = []func(w http.ResponseWriter){unknownTotal}
+	n, err = h.ReadAt(p, 4)
+	if err != nil || string(p[:n]) != "4567" {
+		t.Errorf("ReadAt with unknown total size: %q, %v", p[:n], err)
+	}
+	if requests != 1 {
+		t.Errorf("%d requests with unknown total size, want 1", requests)
+	}
+
+	failures = []func(w http.ResponseWriter){unavailable, unavailable, unavailable, unavailable}
+	if _, err := h.ReadAt(p, 4); err == nil {
+		t.Error("expected an error after exhausting retries, got nil")
+	}
+
+	p = make([]byte, 10)
+	n, err = h.ReadAt(p, 10)
+	if n != 6 || err != io.EOF || string(p[:n]) != "abcdef" {
+		t.Errorf("reading over the end: %q, %v, want %q, EOF", p[:n], err, "abcdef")
+	}
+	if _, err := h.ReadAt(p, 16); err != io.EOF {
+		t.Errorf("reading at the end: %v, want EOF", err)
+	}
+
+	requests = 0
+	missing := &HTTPReaderAt{Client: srv.Client(), URL: srv.URL + "/missing", Retries: 3, Backoff: time.Millisecond}
+	if _, err := missing.ReadAt(p, 0); err == nil {
+		t.Error("expected an error for missing URL, got nil")
+	}
+	if requests != 1 {
+		t.Errorf("%d requests for missing URL, want 1", requests)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	failures = []func(w http.ResponseWriter){func(w http.ResponseWriter) {
+		cancel()
+		unavailable(w)
+	}}
+	slow := &HTTPReaderAt{Client: srv.Client(), URL: srv.URL + "/data", Retries: 1, Backoff: time.Hour}
+	if _, err := slow.ReadAtContext(ctx, p, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want %v", err, context.Canceled)
+	}
+
+	failures = []func(w http.ResponseWriter){unavailable, unavailable}
+	capped := &HTTPReaderAt{Client: srv.Client(), URL: srv.URL + "/data", Retries: 2, Backoff: time.Hour,
+		MaxBackoff: time.Millisecond}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p = make([]byte, 4)
+	if n, err := capped.ReadAtContext(ctx, p, 0); err != nil || string(p[:n]) != "0123" {
+		t.Errorf("ReadAt with capped backoff: %q, %v", p[:n], err)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value             string
+		start, end, total int64
+		valid             bool
+	}{
+		{value: "bytes 0-99/1000", start: 0, end: 99, total: 1000, valid: true},
+		{value: "bytes 100-199/*", start: 100, end: 199, total: -1, valid: true},
+		{value: "bytes */1000"},
+		{value: "bytes 0-99"},
+		{value: "items 0-99/1000"},
+		{value: ""},
+	}
+	for _, test := range tests {
+		start, end, total, err := parseContentRange(test.value)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got nil", test.value)
+			}
+			continue
+		}
+		if err != nil || start != test.start || end != test.end || total != test.total {
+			t.Errorf("%q: %d, %d, %d, %v, want %d, %d, %d", test.value, start, end, total, err, test.start,
+				test.end, test.total)
+		}
+	}
+}
+
+func TestHTTPReaderAtShortRanges(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	for _, total := range []string{"16", "*"} {
+		var requests int
+		// the server returns at most 3 bytes per response
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			var start, end int64
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+				t.Errorf("invalid Range %q", r.Header.Get("Range"))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if start >= int64(len(data)) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if end >= int64(len(data)) {
+				end = int64(len(data)) - 1
+			}
+			if end > start+2 {
+				end = start + 2
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end, total))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+		}))
+
+		h := &HTTPReaderAt{Client: srv.Client(), URL: srv.URL, Retries: 1, Backoff: time.Millisecond}
+		p := make([]byte, 8)
+		if n, err := h.ReadAt(p, 2); err != nil || string(p[:n]) != "23456789" {
+			t.Errorf("total %s: ReadAt: %q, %v", total, p[:n], err)
+		}
+		if requests != 3 {
+			t.Errorf("total %s: %d requests, want 3", total, requests)
+		}
+		if n, err := h.ReadAt(p, 10); err != io.EOF || string(p[:n]) != "abcdef" {
+			t.Errorf("total %s: reading over the end: %q, %v, want %q, EOF", total, p[:n], err, "abcdef")
+		}
+		srv.Close()
+	}
+}
+
+func TestHTTPReaderAtRefresh(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	var mu sync.Mutex
+	valid := "1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ok := r.URL.Query().Get("token") == valid
+		mu.Unlock()
+		if !ok {
+			http.Error(w, "Request has expired", http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	var refreshes int
+	h := &HTTPReaderAt{
+		Client: srv.Client(),
+		URL:    srv.URL + "/data?token=1",
+		Refresh: func(ctx context.Context) (string, error) {
+			refreshes++
+			mu.Lock()
+			defer mu.Unlock()
+			return srv.URL + "/data?token=" + valid, nil
+		},
+	}
+	p := make([]byte, 4)
+	if n, err := h.ReadAt(p, 0); err != nil || string(p[:n]) != "0123" {
+		t.Fatalf("ReadAt with valid URL: %q, %v", p[:n], err)
+	}
+
+	mu.Lock()
+	valid = "2"
+	mu.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			p := make([]byte, 4)
+			if n, err := h.ReadAt(p, off); err != nil || string(p[:n]) != string(data[off:off+4]) {
+				t.Errorf("ReadAt after expiry: %q, %v", p[:n], err)
+			}
+		}(int64(i * 4))
+	}
+	wg.Wait()
+	if refreshes != 1 {
+		t.Errorf("%d refreshes, want 1", refreshes)
+	}
+
+	h.Refresh = func(ctx context.Context) (string, error) {
+		return srv.URL + "/data?token=still-expired", nil
+	}
+	mu.Lock()
+	valid = "3"
+	mu.Unlock()
+	if _, err := h.ReadAt(p, 0); err == nil {
+		t.Error("expected an error when refreshed URL is rejected, got nil")
+	}
+
+	refreshErr := errors.New("refresh failed")
+	h.Refresh = func(ctx context.Context) (string, error) { return "", refreshErr }
+	if _, err := h.ReadAt(p, 0); !errors.Is(err, refreshErr) {
+		t.Errorf("error %v, want %v", err, refreshErr)
+	}
+}
@@ -0,0 +1,54 @@
+package zipserve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// verifyBufferSize is size of the buffer used to read entry content during verification.
+const verifyBufferSize = 32 * 1024
+
+var (
+	// ErrChecksum is returned by VerifyCRC when the CRC32 of the content does not match.
+	ErrChecksum = errors.New("zip: checksum error")
+	// ErrSize is returned by VerifyCRC when the uncompressed size of the content does not match.
+	ErrSize = errors.New("zip: uncompressed size mismatch")
+)
+
+// VerifyCRC reads the content of the entry and checks that it matches CRC32 and UncompressedSize64.
+//
+// The content is processed in a streaming fashion with a fixed size buffer, so the memory usage does not depend on
+// the size of the entry. Entries compressed using Deflate are decompressed on the fly.
+//
+// The context is passed to Content's ReadAtContext, if Content implements ReaderAt interface from this package.
+func VerifyCRC(ctx context.Context, fh *FileHeader) error {
+	var r io.Reader
+	if fh.Content != nil {
+		r = io.NewSectionReader(withContext{ctx: ctx, r: readerAt(fh.Content)}, 0, int64(fh.CompressedSize64))
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	dc, err := newDecompressor(fh.Method, r)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	hash := crc32.NewIEEE()
+	buf := make([]byte, verifyBufferSize)
+	// reading one byte more than declared is enough to detect the mismatch, don't decompress the rest of the stream
+	n, err := io.CopyBuffer(hash, io.LimitReader(dc, int64(fh.UncompressedSize64)+1), buf)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != fh.UncompressedSize64 {
+		return ErrSize
+	}
+	if hash.Sum32() != fh.CRC32 {
+		return ErrChecksum
+	}
+	return nil
+}
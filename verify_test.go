@@ -0,0 +1,106 @@
+package zipserve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestVerifyCRC(t *testing.T) {
+	data := []byte("Rabbits, guinea pigs, gophers, marsupial rats, and quolls.")
+	compressed := deflate(data)
+	tests := []struct {
+		name    string
+		header  *FileHeader
+		wantErr error
+	}{
+		{
+			name: "store",
+			header: &FileHeader{Method: Store, CRC32: crc(data), UncompressedSize64: uint64(len(data)),
+				CompressedSize64: uint64(len(data)), Content: bytes.NewReader(data)},
+		},
+		{
+			name: "deflate",
+			header: &FileHeader{Method: Deflate, CRC32: crc(data), UncompressedSize64: uint64(len(data)),
+				CompressedSize64: uint64(len(compressed)), Content: bytes.NewReader(compressed)},
+		},
+		{
+			name:   "empty",
+			header: &FileHeader{Method: Store, CRC32: crc(nil)},
+		},
+		{
+			name: "bad checksum",
+			header: &FileHeader{Method: Store, CRC32: crc(data) + 1, UncompressedSize64: uint64(len(data)),
+				CompressedSize64: uint64(len(data)), Content: bytes.NewReader(data)},
+			wantErr: ErrChecksum,
+		},
+		{
+			name: "bad size",
+			header: &FileHeader{Method: Deflate, CRC32: crc(data), UncompressedSize64: uint64(len(data)) + 1,
+				CompressedSize64: uint64(len(compressed)), Content: bytes.NewReader(compressed)},
+			wantErr: ErrSize,
+		},
+		{
+			name: "size too small",
+			header: &FileHeader{Method: Deflate, CRC32: crc(data), UncompressedSize64: uint64(len(data)) - 1,
+				CompressedSize64: uint64(len(compressed)), Content: bytes.NewReader(compressed)},
+			wantErr: ErrSize,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyCRC(context.Background(), test.header)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// maxReadRecorder is an io.ReaderAt that records the largest buffer it was asked to fill.
+type maxReadRecorder struct {
+	r       io.ReaderAt
+	maxRead int
+}
+
+func (m *maxReadRecorder) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > m.maxRead {
+		m.maxRead = len(p)
+	}
+	return m.r.ReadAt(p, off)
+}
+
+func TestVerifyCRCLargeEntryMemory(t *testing.T) {
+	data := make([]byte, 64<<20)
+	compressed := deflate(data)
+	headers := map[string]*FileHeader{
+		"store": {
+			Method:             Store,
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(data)),
+			Content:            bytes.NewReader(data),
+		},
+		"deflate": {
+			Method:             Deflate,
+			CompressedSize64:   uint64(len(compressed)),
+			UncompressedSize64: uint64(len(data)),
+			Content:            bytes.NewReader(compressed),
+		},
+	}
+	for name, fh := range headers {
+		t.Run(name, func(t *testing.T) {
+			fh.CRC32 = crc(data)
+			recorder := &maxReadRecorder{r: fh.Content}
+			fh.Content = recorder
+			if err := VerifyCRC(context.Background(), fh); err != nil {
+				t.Fatalf("VerifyCRC: %v", err)
+			}
+			// the content is read in chunks of a fixed size, not all at once
+			if recorder.maxRead > verifyBufferSize {
+				t.Errorf("read %d bytes at once, want at most %d", recorder.maxRead, verifyBufferSize)
+			}
+		})
+	}
+}
@@ -7,14 +7,25 @@ package zipserve
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"sort"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
 var (
 	errLongName  = errors.New("zip: FileHeader.Name too long")
 	errLongExtra = errors.New("zip: FileHeader.Extra too long")
+
+	errPresetDictionary = errors.New("zip: preset dictionary is not supported")
+	errContentZeroSize  = errors.New("zip: non-nil content with zero CompressedSize64")
+	errDirContent       = errors.New("directory entry non-nil content")
+	errMissingContent   = errors.New("empty entry with nonzero length")
+	errDotDot           = errors.New("zip: FileHeader.Name contains \"..\" path component")
 )
 
 type header struct {
@@ -45,16 +56,105 @@ func detectUTF8(s string) (valid, require bool) {
 	return true, require
 }
 
-func writeHeader(w io.Writer, h *FileHeader) error {
+// headerOptions configures how writeHeader writes a local file header.
+type headerOptions struct {
+	// extraOrder is the order of extra fields, see Template.ExtraOrder.
+	extraOrder []ExtraField
+	// zip64 stores sizes in a zip64 extra block even if they fit into the local header.
+	// It has no effect for entries with a data descriptor.
+	zip64 bool
+	// goCompat writes zero MS-DOS date and time for zero Modified time, as archive/zip does.
+	goCompat bool
+	// msdosTimeUTC computes MS-DOS date and time from UTC components of Modified.
+	msdosTimeUTC bool
+}
+
+// msDosTime converts t to MS-DOS date and time.
+// If goCompat is set, zero time is converted to zero date and time like archive/zip does.
+// If utc is set, the UTC components of t are used instead of the components in the location of t.
+func msDosTime(t time.Time, goCompat, utc bool) (fDate uint16, fTime uint16) {
+	if goCompat && t.IsZero() {
+		return 0, 0
+	}
+	if utc {
+		t = t.UTC()
+	}
+	return timeToMsDosTime(t)
+}
+
+// validateEntry checks that fh describes a valid entry.
+func validateEntry(fh *FileHeader) error {
+	if len(fh.Name) > uint16max {
+		return errLongName
+	}
+	if fh.PresetDictionary {
+		return errPresetDictionary
+	}
+	if strings.HasSuffix(fh.Name, "/") {
+		if fh.Content != nil {
+			return errDirContent
+		}
+		return nil
+	}
+	if fh.Content == nil && fh.CompressedSize64 != 0 {
+		return errMissingContent
+	}
+	if fh.CompressedSize64 == 0 && fh.Content != nil && contentSize(fh.Content) != 0 {
+		return errContentZeroSize
+	}
+	return nil
+}
+
+// contentSize returns the size of content if it reports one using a Size method, like bytes.Reader, or -1.
+func contentSize(content io.ReaderAt) int64 {
+	if sized, ok := content.(interface{ Size() int64 }); ok {
+		return sized.Size()
+	}
+	return -1
+}
+
+// hasDotDot reports whether name contains a ".." path component.
+func hasDotDot(name string) bool {
+	for _, component := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if component == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// validateName checks that the name of an entry is allowed by the template.
+func validateName(t *Template, name string) error {
+	if !t.AllowDotDot && hasDotDot(name) {
+		return errDotDot
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, h *FileHeader, opts headerOptions) error {
 	const maxUint16 = 1<<16 - 1
 	if len(h.Name) > maxUint16 {
 		return errLongName
 	}
-	if len(h.Extra) > maxUint16 {
+	extra := h.Extra
+	zip64 := h.Flags&0x8 == 0 && (h.isZip64() || opts.zip64 && !strings.HasSuffix(h.Name, "/"))
+	if zip64 {
+		// sizes don't fit into the local header (or uniform headers were requested),
+		// store them in a zip64 extra block
+		var buf [20]byte // 2x uint16 + 2x uint64
+		eb := writeBuf(buf[:])
+		eb.uint16(zip64ExtraID)
+		eb.uint16(16) // size = 2x uint64
+		eb.uint64(h.UncompressedSize64)
+		eb.uint64(h.CompressedSize64)
+		extra = append(extra[:len(extra):len(extra)], buf[:]...)
+	}
+	extra = orderExtra(extra, opts.extraOrder)
+	if len(extra) > maxUint16 {
 		return errLongExtra
 	}
 
-	modifiedDate, modifiedTime := timeToMsDosTime(h.Modified)
+	modifiedDate, modifiedTime := msDosTime(h.Modified, opts.goCompat, opts.msdosTimeUTC)
 
 	var buf [fileHeaderLen]byte
 	b := writeBuf(buf[:])
@@ -64,18 +164,29 @@ func writeHeader(w io.Writer, h *FileHeader) error {
 	b.uint16(h.Method)
 	b.uint16(modifiedTime)
 	b.uint16(modifiedDate)
-	b.uint32(0) // since we are writing a data descriptor crc32,
-	b.uint32(0) // compressed size,
-	b.uint32(0) // and uncompressed size should be zero
+	switch {
+	case h.Flags&0x8 != 0:
+		b.uint32(0) // since we are writing a data descriptor crc32,
+		b.uint32(0) // compressed size,
+		b.uint32(0) // and uncompressed size should be zero
+	case zip64:
+		b.uint32(h.CRC32)
+		b.uint32(uint32max) // compressed and uncompressed size
+		b.uint32(uint32max) // are stored in the zip64 extra block
+	default:
+		b.uint32(h.CRC32)
+		b.uint32(uint32(h.CompressedSize64))
+		b.uint32(uint32(h.UncompressedSize64))
+	}
 	b.uint16(uint16(len(h.Name)))
-	b.uint16(uint16(len(h.Extra)))
+	b.uint16(uint16(len(extra)))
 	if _, err := w.Write(buf[:]); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, h.Name); err != nil {
 		return err
 	}
-	_, err := w.Write(h.Extra)
+	_, err := w.Write(extra)
 	return err
 }
 
@@ -112,12 +223,37 @@ func (b *writeBuf) uint64(v uint64) {
 	*b = (*b)[8:]
 }
 
-func writeCentralDirectory(start int64, dir []*header, writer io.Writer, comment string,
+// directoryOptions configures optional records written by writeCentralDirectory.
+type directoryOptions struct {
+	// checksum adds CRC32 of the central directory headers to the zip64 end of central directory record.
+	checksum bool
+	// extraOrder is the order of extra fields in the headers, see Template.ExtraOrder.
+	extraOrder []ExtraField
+	// goCompat writes zero MS-DOS date and time for zero Modified time, as archive/zip does.
+	goCompat bool
+	// msdosTimeUTC computes MS-DOS date and time from UTC components of Modified.
+	msdosTimeUTC bool
+	// onZip64Required, if not nil, is called for each reason why zip64 end records are written.
+	onZip64Required func(reason string)
+}
+
+func writeCentralDirectory(start int64, dir []*header, writer io.Writer, comment string, opts directoryOptions,
 	testHookCloseSizeOffset func(size, offset uint64)) error {
 	// write central directory
 	cw := &countWriter{w: writer}
+	var headers io.Writer = cw
+	var directoryCRC hash.Hash32
+	if opts.checksum {
+		directoryCRC = crc32.NewIEEE()
+		headers = io.MultiWriter(cw, directoryCRC)
+	}
+	// version needed to extract the whole archive, zip64 end records require at least 4.5
+	var readerVersion uint16 = zipVersion45
 	for _, h := range dir {
-		modifiedDate, modifiedTime := timeToMsDosTime(h.Modified)
+		if h.ReaderVersion > readerVersion {
+			readerVersion = h.ReaderVersion
+		}
+		modifiedDate, modifiedTime := msDosTime(h.Modified, opts.goCompat, opts.msdosTimeUTC)
 
 		var buf [directoryHeaderLen]byte
 		b := writeBuf(buf[:])
@@ -150,8 +286,9 @@ func writeCentralDirectory(start int64, dir []*header, writer io.Writer, comment
 			b.uint32(uint32(h.UncompressedSize64))
 		}
 
+		extra := orderExtra(h.Extra, opts.extraOrder)
 		b.uint16(uint16(len(h.Name)))
-		b.uint16(uint16(len(h.Extra)))
+		b.uint16(uint16(len(extra)))
 		b.uint16(uint16(len(h.Comment)))
 		b = b[4:] // skip disk number start and internal file attr (2x uint16)
 		b.uint32(h.ExternalAttrs)
@@ -160,16 +297,16 @@ func writeCentralDirectory(start int64, dir []*header, writer io.Writer, comment
 		} else {
 			b.uint32(uint32(h.offset))
 		}
-		if _, err := cw.Write(buf[:]); err != nil {
+		if _, err := headers.Write(buf[:]); err != nil {
 			return err
 		}
-		if _, err := io.WriteString(cw, h.Name); err != nil {
+		if _, err := io.WriteString(headers, h.Name); err != nil {
 			return err
 		}
-		if _, err := cw.Write(h.Extra); err != nil {
+		if _, err := headers.Write(extra); err != nil {
 			return err
 		}
-		if _, err := io.WriteString(cw, h.Comment); err != nil {
+		if _, err := io.WriteString(headers, h.Comment); err != nil {
 			return err
 		}
 	}
@@ -184,20 +321,49 @@ func writeCentralDirectory(start int64, dir []*header, writer io.Writer, comment
 	}
 
 	if records >= uint16max || size >= uint32max || offset >= uint32max {
+		if f := opts.onZip64Required; f != nil {
+			if records >= uint16max {
+				f(fmt.Sprintf("number of entries %d does not fit into 16 bits", records))
+			}
+			if size >= uint32max {
+				f(fmt.Sprintf("central directory size %d does not fit into 32 bits", size))
+			}
+			if offset >= uint32max {
+				f(fmt.Sprintf("central directory offset %d does not fit into 32 bits", offset))
+			}
+		}
+
+		var extensible []byte
+		if opts.checksum {
+			var buf [directoryChecksumLen]byte
+			eb := writeBuf(buf[:])
+			eb.uint16(directoryChecksumID)
+			eb.uint32(directoryChecksumLen - 6) // size minus header ID (uint16) and data size (uint32)
+			eb.uint32(directoryCRC.Sum32())
+			extensible = buf[:]
+		}
+
 		var buf [directory64EndLen + directory64LocLen]byte
 		b := writeBuf(buf[:])
 
 		// zip64 end of central directory record
 		b.uint32(directory64EndSignature)
-		b.uint64(directory64EndLen - 12) // length minus signature (uint32) and length fields (uint64)
-		b.uint16(zipVersion45)           // version made by
-		b.uint16(zipVersion45)           // version needed to extract
-		b.uint32(0)                      // number of this disk
-		b.uint32(0)                      // number of the disk with the start of the central directory
-		b.uint64(records)                // total number of entries in the central directory on this disk
-		b.uint64(records)                // total number of entries in the central directory
-		b.uint64(size)                   // size of the central directory
-		b.uint64(offset)                 // offset of start of central directory with respect to the starting disk number
+		b.uint64(uint64(directory64EndLen - 12 + len(extensible))) // length minus signature and length fields
+		b.uint16(zipVersion45)                                     // version made by
+		b.uint16(readerVersion)                                    // version needed to extract
+		b.uint32(0)                                                // number of this disk
+		b.uint32(0)                                                // number of the disk with the start of the central directory
+		b.uint64(records)                                          // total number of entries in the central directory on this disk
+		b.uint64(records)                                          // total number of entries in the central directory
+		b.uint64(size)                                             // size of the central directory
+		b.uint64(offset)                                           // offset of start of central directory with respect to the starting disk number
+
+		if _, err := cw.Write(buf[:directory64EndLen]); err != nil {
+			return err
+		}
+		if _, err := cw.Write(extensible); err != nil {
+			return err
+		}
 
 		// zip64 end of central directory locator
 		b.uint32(directory64LocSignature)
@@ -205,7 +371,7 @@ func writeCentralDirectory(start int64, dir []*header, writer io.Writer, comment
 		b.uint64(uint64(end)) // relative offset of the zip64 end of central directory record
 		b.uint32(1)           // total number of disks
 
-		if _, err := cw.Write(buf[:]); err != nil {
+		if _, err := cw.Write(buf[directory64EndLen:]); err != nil {
 			return err
 		}
 
@@ -236,13 +402,68 @@ func writeCentralDirectory(start int64, dir []*header, writer io.Writer, comment
 	return nil
 }
 
+// extraFieldKind returns the kind of the extra field with the given header ID.
+func extraFieldKind(id uint16) ExtraField {
+	switch id {
+	case extTimeExtraID:
+		return ExtraTimestamp
+	case zip64ExtraID:
+		return ExtraZip64
+	case aesExtraID:
+		return ExtraAES
+	}
+	return ExtraUser
+}
+
+// orderExtra returns extra with the fields reordered according to order.
+//
+// Fields of kinds missing in order follow the listed ones in their original order.
+// extra is returned unchanged if order is empty or extra is not a valid sequence of extra fields.
+func orderExtra(extra []byte, order []ExtraField) []byte {
+	if len(order) == 0 {
+		return extra
+	}
+	type field struct {
+		data []byte
+		rank int
+	}
+	var fields []field
+	for rest := extra; len(rest) > 0; {
+		if len(rest) < 4 {
+			return extra
+		}
+		size := 4 + int(binary.LittleEndian.Uint16(rest[2:]))
+		if size > len(rest) {
+			return extra
+		}
+		kind := extraFieldKind(binary.LittleEndian.Uint16(rest))
+		rank := len(order)
+		for i, k := range order {
+			if k == kind {
+				rank = i
+				break
+			}
+		}
+		fields = append(fields, field{data: rest[:size], rank: rank})
+		rest = rest[size:]
+	}
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].rank < fields[j].rank })
+	result := make([]byte, 0, len(extra))
+	for _, f := range fields {
+		result = append(result, f.data...)
+	}
+	return result
+}
+
 func makeDataDescriptor(fh *FileHeader) []byte {
 	var compressedSize, uncompressedSize uint32
 
 	if fh.isZip64() {
 		compressedSize = uint32max
 		uncompressedSize = uint32max
-		fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		if fh.ReaderVersion < zipVersion45 {
+			fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		}
 	} else {
 		compressedSize = uint32(fh.CompressedSize64)
 		uncompressedSize = uint32(fh.UncompressedSize64)
@@ -273,7 +494,20 @@ func makeDataDescriptor(fh *FileHeader) []byte {
 	return buf
 }
 
-func prepareEntry(fh *FileHeader) {
+// extendedTimestamp reports whether the extended timestamp extra field is written for the entry.
+// With GoCompat, it is omitted for zero Modified time, as archive/zip does. With LegacyCompat, it is never written.
+func extendedTimestamp(t *Template, fh *FileHeader) bool {
+	if t.LegacyCompat {
+		return false
+	}
+	return !t.GoCompat || !fh.Modified.IsZero()
+}
+
+// prepareEntry fills in fields of fh before it is written.
+// If dataDescriptor is false, CRC32 and sizes will be stored in the local header instead of a data descriptor.
+//
+// If extTime is false, the extended timestamp is omitted, see extendedTimestamp.
+func prepareEntry(fh *FileHeader, dataDescriptor, extTime bool) {
 	// The ZIP format has a sad state of affairs regarding character encoding.
 	// Officially, the name and comment fields are supposed to be encoded
 	// in CP-437 (which is mostly compatible with ASCII), unless the UTF-8
@@ -293,6 +527,7 @@ func prepareEntry(fh *FileHeader) {
 	utf8Valid1, utf8Require1 := detectUTF8(fh.Name)
 	utf8Valid2, utf8Require2 := detectUTF8(fh.Comment)
 	switch {
+	case fh.PreserveUTF8Flag:
 	case fh.NonUTF8:
 		fh.Flags &^= 0x800
 	case (utf8Require1 || utf8Require2) && (utf8Valid1 && utf8Valid2):
@@ -308,14 +543,16 @@ func prepareEntry(fh *FileHeader) {
 	//
 	// This format happens to be identical for both local and central header
 	// if modification time is the only timestamp being encoded.
-	var mbuf [extTimeExtraLen]byte
-	mt := uint32(fh.Modified.Unix())
-	eb := writeBuf(mbuf[:])
-	eb.uint16(extTimeExtraID)
-	eb.uint16(5)  // Size: SizeOf(uint8) + SizeOf(uint32)
-	eb.uint8(1)   // Flags: ModTime
-	eb.uint32(mt) // ModTime
-	fh.Extra = append(fh.Extra, mbuf[:]...)
+	if extTime {
+		var mbuf [extTimeExtraLen]byte
+		mt := uint32(fh.Modified.Unix())
+		eb := writeBuf(mbuf[:])
+		eb.uint16(extTimeExtraID)
+		eb.uint16(5)  // Size: SizeOf(uint8) + SizeOf(uint32)
+		eb.uint8(1)   // Flags: ModTime
+		eb.uint32(mt) // ModTime
+		fh.Extra = append(fh.Extra, mbuf[:]...)
+	}
 
 	if strings.HasSuffix(fh.Name, "/") {
 		// Set the compression method to Store to ensure data length is truly zero,
@@ -328,7 +565,45 @@ func prepareEntry(fh *FileHeader) {
 		// Explicitly clear sizes as they have no meaning for directories.
 		fh.CompressedSize64 = 0
 		fh.UncompressedSize64 = 0
-	} else {
+	} else if dataDescriptor {
 		fh.Flags |= 0x8 // we will write a data descriptor
+	} else {
+		fh.Flags &^= 0x8 // sizes are stored in the local header
+		if fh.isZip64() {
+			fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		}
+	}
+
+	if fh.Encrypted && !strings.HasSuffix(fh.Name, "/") {
+		prepareEncryption(fh)
+	}
+}
+
+// prepareEncryption sets the flags, method and extra fields of an entry with encrypted content.
+func prepareEncryption(fh *FileHeader) {
+	fh.Flags |= 0x1
+	strength := fh.EncryptionMethod.aesStrength()
+	if strength == 0 {
+		return
+	}
+	// WinZip AES encryption, see https://www.winzip.com/en/support/aes-encryption/
+	// AE-2 does not store CRC32 as it can leak information about small files, AE-1 does.
+	vendorVersion := uint16(1)
+	if fh.CRC32 == 0 {
+		vendorVersion = 2
+	}
+	var buf [aesExtraLen]byte
+	eb := writeBuf(buf[:])
+	eb.uint16(aesExtraID)
+	eb.uint16(aesExtraLen - 4)
+	eb.uint16(vendorVersion)
+	eb.uint8('A')
+	eb.uint8('E')
+	eb.uint8(strength)
+	eb.uint16(fh.Method) // actual compression method
+	fh.Extra = append(fh.Extra, buf[:]...)
+	fh.Method = methodAES
+	if fh.ReaderVersion < zipVersion51 {
+		fh.ReaderVersion = zipVersion51
 	}
 }
@@ -9,12 +9,14 @@ import (
 	"bytes"
 	"compress/flate"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -116,6 +118,9 @@ func TestWriterComment(t *testing.T) {
 		{"hi, こんにちわ", true},
 		{strings.Repeat("a", uint16max), true},
 		{strings.Repeat("a", uint16max+1), false},
+		{"PK\x05\x06", false},
+		{"spurious PK\x05\x06 signature", false},
+		{"PK\x05\x05", true},
 	}
 
 	for _, test := range tests {
@@ -261,6 +266,50 @@ func TestWriterTime(t *testing.T) {
 	}
 }
 
+func TestWriterMSDOSTimeUTC(t *testing.T) {
+	modified := time.Date(2020, 5, 6, 1, 2, 4, 0, time.FixedZone("UTC+9", 9*60*60))
+	for _, utc := range []bool{false, true} {
+		t.Run(fmt.Sprint(utc), func(t *testing.T) {
+			ar, err := NewArchive(&Template{
+				MSDOSTimeUTC: utc,
+				Entries:      []*FileHeader{{Name: "file.txt", Modified: modified}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantDate, wantTime := timeToMsDosTime(modified)
+			if utc {
+				wantDate, wantTime = timeToMsDosTime(modified.UTC())
+			}
+
+			local := make([]byte, fileHeaderLen)
+			if _, err := ar.ReadAt(local, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.LittleEndian.Uint16(local[10:]); got != wantTime {
+				t.Errorf("local header time %#x, want %#x", got, wantTime)
+			}
+			if got := binary.LittleEndian.Uint16(local[12:]); got != wantDate {
+				t.Errorf("local header date %#x, want %#x", got, wantDate)
+			}
+
+			r, err := zip.NewReader(ar, ar.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := r.File[0]
+			if f.ModifiedTime != wantTime || f.ModifiedDate != wantDate {
+				t.Errorf("central directory date and time %#x %#x, want %#x %#x", f.ModifiedDate, f.ModifiedTime,
+					wantDate, wantTime)
+			}
+			// the extended timestamp is the same in both cases
+			if !f.Modified.Equal(modified) {
+				t.Errorf("extended timestamp %v, want %v", f.Modified, modified)
+			}
+		})
+	}
+}
+
 func TestWriterMissingData(t *testing.T) {
 	tmpl := &Template{
 		Entries: []*FileHeader{{
@@ -274,6 +323,84 @@ func TestWriterMissingData(t *testing.T) {
 	}
 }
 
+func TestWriterContentZeroSize(t *testing.T) {
+	tmpl := &Template{
+		Entries: []*FileHeader{{
+			Name:    "file.txt",
+			Content: bytes.NewReader([]byte("hello")),
+		}},
+	}
+	if _, err := NewArchive(tmpl); err != errContentZeroSize {
+		t.Errorf("NewArchive: got error %v, want %v", err, errContentZeroSize)
+	}
+	if _, err := CalculateSize(tmpl); err != errContentZeroSize {
+		t.Errorf("CalculateSize: got error %v, want %v", err, errContentZeroSize)
+	}
+
+	tmpl = &Template{Entries: []*FileHeader{{Name: "empty.txt"}}}
+	if _, err := NewArchive(tmpl); err != nil {
+		t.Errorf("empty file with nil content: %v", err)
+	}
+
+	// readers of unknown size may contain data too
+	unknown := failingReaderAt{err: errors.New("unexpected read")}
+	tmpl = &Template{Entries: []*FileHeader{{Name: "file.txt", Content: unknown}}}
+	if _, err := NewArchive(tmpl); err != errContentZeroSize {
+		t.Errorf("content of unknown size: got error %v, want %v", err, errContentZeroSize)
+	}
+
+	// an empty reader is the same as nil content
+	tmpl = &Template{Entries: []*FileHeader{{Name: "empty.txt", Content: bytes.NewReader(nil)}}}
+	if _, err := CalculateSize(tmpl); err != nil {
+		t.Errorf("CalculateSize with empty content: %v", err)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatalf("NewArchive with empty content: %v", err)
+	}
+	zr, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := zr.File[0]; f.UncompressedSize64 != 0 {
+		t.Errorf("empty content: size %d, want 0", f.UncompressedSize64)
+	}
+}
+
+func TestWriterDotDot(t *testing.T) {
+	tests := []struct {
+		name    string
+		invalid bool
+	}{
+		{name: "a/../b", invalid: true},
+		{name: "../x", invalid: true},
+		{name: "..", invalid: true},
+		{name: "dir/../", invalid: true},
+		{name: "a\\..\\b", invalid: true},
+		{name: "a/b..c/d"},
+		{name: "..hidden"},
+		{name: "clean/name.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewArchive(&Template{Entries: []*FileHeader{{Name: test.name}}})
+			if test.invalid && err != errDotDot {
+				t.Errorf("got error %v, want %v", err, errDotDot)
+			}
+			if !test.invalid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, err := CalculateSize(&Template{Entries: []*FileHeader{{Name: test.name}}}); (err != nil) != test.invalid {
+				t.Errorf("CalculateSize: unexpected error %v", err)
+			}
+			_, err = NewArchive(&Template{AllowDotDot: true, Entries: []*FileHeader{{Name: test.name}}})
+			if err != nil {
+				t.Errorf("AllowDotDot: unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 func TestWriterOffset(t *testing.T) {
 	largeData := make([]byte, 1<<17)
 	if _, err := rand.Read(largeData); err != nil {
@@ -448,3 +575,940 @@ func testReadFile(t *testing.T, f *zip.File, wt *WriteTest) {
 		t.Errorf("File contents %q, want %q", b, wt.Data)
 	}
 }
+
+func TestWriterDirectoryEndRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		records int
+		zip64   bool
+	}{
+		{name: "empty", records: 0},
+		{name: "few", records: 3},
+		{name: "uint16max-1", records: uint16max - 1},
+		{name: "uint16max", records: uint16max, zip64: true},
+		{name: "uint16max+1", records: uint16max + 1, zip64: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := make([]*header, test.records)
+			for i := range dir {
+				dir[i] = &header{FileHeader: &FileHeader{Name: "a"}}
+			}
+			var buf bytes.Buffer
+			if err := writeCentralDirectory(0, dir, &buf, "", directoryOptions{}, nil); err != nil {
+				t.Fatalf("writeCentralDirectory: %v", err)
+			}
+			b := buf.Bytes()
+
+			end := b[len(b)-directoryEndLen:]
+			if sig := binary.LittleEndian.Uint32(end); sig != directoryEndSignature {
+				t.Fatalf("end record signature %#x, want %#x", sig, directoryEndSignature)
+			}
+			wantRecords := uint16(test.records)
+			if test.zip64 {
+				wantRecords = uint16max
+			}
+			if got := binary.LittleEndian.Uint16(end[8:]); got != wantRecords {
+				t.Errorf("end record entries on this disk = %d, want %d", got, wantRecords)
+			}
+			if got := binary.LittleEndian.Uint16(end[10:]); got != wantRecords {
+				t.Errorf("end record entries total = %d, want %d", got, wantRecords)
+			}
+
+			if !test.zip64 {
+				return
+			}
+			end64 := b[len(b)-directoryEndLen-directory64LocLen-directory64EndLen:]
+			if sig := binary.LittleEndian.Uint32(end64); sig != directory64EndSignature {
+				t.Fatalf("zip64 end record signature %#x, want %#x", sig, directory64EndSignature)
+			}
+			if got := binary.LittleEndian.Uint64(end64[24:]); got != uint64(test.records) {
+				t.Errorf("zip64 end record entries on this disk = %d, want %d", got, test.records)
+			}
+			if got := binary.LittleEndian.Uint64(end64[32:]); got != uint64(test.records) {
+				t.Errorf("zip64 end record entries total = %d, want %d", got, test.records)
+			}
+		})
+	}
+}
+
+func TestWriterOnZip64Required(t *testing.T) {
+	var reasons []string
+	tmpl := &Template{OnZip64Required: func(reason string) { reasons = append(reasons, reason) }}
+	for i := 0; i < uint16max-1; i++ {
+		tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: fmt.Sprintf("%05d/", i)})
+	}
+	if _, err := NewArchive(tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if len(reasons) != 0 {
+		t.Errorf("unexpected reasons for %d entries: %q", len(tmpl.Entries), reasons)
+	}
+
+	tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: "last/"})
+	for _, entry := range tmpl.Entries {
+		entry.Extra = nil
+	}
+	if _, err := NewArchive(tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if len(reasons) != 1 || !strings.HasPrefix(reasons[0], "number of entries 65535") {
+		t.Errorf("reasons %q, want one reason about the number of entries", reasons)
+	}
+}
+
+func TestWriterDirectoryEndVersion(t *testing.T) {
+	dir := make([]*header, uint16max)
+	for i := range dir {
+		dir[i] = &header{FileHeader: &FileHeader{Name: "a", ReaderVersion: zipVersion20}}
+	}
+	dir[1].ReaderVersion = zipVersion45
+	dir[2].ReaderVersion = 63
+	var buf bytes.Buffer
+	if err := writeCentralDirectory(0, dir, &buf, "", directoryOptions{}, nil); err != nil {
+		t.Fatalf("writeCentralDirectory: %v", err)
+	}
+	b := buf.Bytes()
+	end64 := b[len(b)-directoryEndLen-directory64LocLen-directory64EndLen:]
+	if sig := binary.LittleEndian.Uint32(end64); sig != directory64EndSignature {
+		t.Fatalf("zip64 end record signature %#x, want %#x", sig, directory64EndSignature)
+	}
+	if got := binary.LittleEndian.Uint16(end64[14:]); got != 63 {
+		t.Errorf("zip64 end record version needed to extract %d, want 63", got)
+	}
+
+	dir[2].ReaderVersion = zipVersion20
+	buf.Reset()
+	if err := writeCentralDirectory(0, dir, &buf, "", directoryOptions{}, nil); err != nil {
+		t.Fatalf("writeCentralDirectory: %v", err)
+	}
+	b = buf.Bytes()
+	end64 = b[len(b)-directoryEndLen-directory64LocLen-directory64EndLen:]
+	if got := binary.LittleEndian.Uint16(end64[14:]); got != zipVersion45 {
+		t.Errorf("zip64 end record version needed to extract %d, want %d", got, zipVersion45)
+	}
+}
+
+func TestWriterDirectoryChecksum(t *testing.T) {
+	tmpl := &Template{DirectoryChecksum: true}
+	for i := 0; i < uint16max; i++ {
+		tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: fmt.Sprintf("%05d/", i)})
+	}
+	breakdown, err := CalculateSize(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(b), int64(len(b))); err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	loc := b[len(b)-directoryEndLen-directory64LocLen:]
+	if sig := binary.LittleEndian.Uint32(loc); sig != directory64LocSignature {
+		t.Fatalf("zip64 locator signature %#x, want %#x", sig, directory64LocSignature)
+	}
+	end64 := b[binary.LittleEndian.Uint64(loc[8:]):]
+	if sig := binary.LittleEndian.Uint32(end64); sig != directory64EndSignature {
+		t.Fatalf("zip64 end record signature %#x, want %#x", sig, directory64EndSignature)
+	}
+	if got, want := binary.LittleEndian.Uint64(end64[4:]), uint64(directory64EndLen-12+directoryChecksumLen); got != want {
+		t.Errorf("zip64 end record length %d, want %d", got, want)
+	}
+	size := binary.LittleEndian.Uint64(end64[40:])
+	offset := binary.LittleEndian.Uint64(end64[48:])
+
+	block := end64[directory64EndLen : directory64EndLen+directoryChecksumLen]
+	if id := binary.LittleEndian.Uint16(block); id != directoryChecksumID {
+		t.Fatalf("extensible data block ID %#x, want %#x", id, directoryChecksumID)
+	}
+	if n := binary.LittleEndian.Uint32(block[2:]); n != 4 {
+		t.Fatalf("extensible data block size %d, want 4", n)
+	}
+	if got, want := binary.LittleEndian.Uint32(block[6:]), crc(b[offset:offset+size]); got != want {
+		t.Errorf("directory checksum %#x, want %#x", got, want)
+	}
+
+	if breakdown.Total() != ar.Size() {
+		t.Errorf("CalculateSize %d, archive size %d", breakdown.Total(), ar.Size())
+	}
+}
+
+func TestWriterDataDescriptorFlag(t *testing.T) {
+	tests := []struct {
+		name           string
+		header         *FileHeader
+		wantFlags      uint16
+		wantDescriptor bool
+	}{
+		{
+			name:           "directory with flag preset",
+			header:         &FileHeader{Name: "dir/", Flags: 0x8},
+			wantFlags:      0,
+			wantDescriptor: false,
+		},
+		{
+			name: "file with flag cleared",
+			header: &FileHeader{
+				Name:               "file.txt",
+				Flags:              0,
+				CRC32:              crc([]byte("hello")),
+				CompressedSize64:   5,
+				UncompressedSize64: 5,
+				Content:            bytes.NewReader([]byte("hello")),
+			},
+			wantFlags:      0x8,
+			wantDescriptor: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ar, err := NewArchive(&Template{Entries: []*FileHeader{test.header}})
+			if err != nil {
+				t.Fatalf("NewArchive: %v", err)
+			}
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, io.NewSectionReader(ar, 0, ar.Size())); err != nil {
+				t.Fatalf("Copy: %v", err)
+			}
+			b := buf.Bytes()
+
+			if sig := binary.LittleEndian.Uint32(b); sig != fileHeaderSignature {
+				t.Fatalf("local header signature %#x, want %#x", sig, fileHeaderSignature)
+			}
+			localFlags := binary.LittleEndian.Uint16(b[6:])
+			if localFlags != test.wantFlags {
+				t.Errorf("local header flags %#x, want %#x", localFlags, test.wantFlags)
+			}
+
+			var sig [4]byte
+			binary.LittleEndian.PutUint32(sig[:], uint32(dataDescriptorSignature))
+			if hasDescriptor := bytes.Contains(b, sig[:]); hasDescriptor != test.wantDescriptor {
+				t.Errorf("data descriptor present: %v, want %v", hasDescriptor, test.wantDescriptor)
+			}
+
+			r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			if centralFlags := r.File[0].Flags; centralFlags != localFlags {
+				t.Errorf("central directory flags %#x, local header flags %#x", centralFlags, localFlags)
+			}
+		})
+	}
+}
+
+func TestWriterOmitDataDescriptors(t *testing.T) {
+	largeData := make([]byte, 1<<17)
+	if _, err := rand.Read(largeData); err != nil {
+		t.Fatal("rand.Read failed:", err)
+	}
+	writeTests[1].Data = largeData
+	defer func() {
+		writeTests[1].Data = nil
+	}()
+
+	tmpl := &Template{OmitDataDescriptors: true}
+	for _, wt := range writeTests {
+		tmpl.Entries = append(tmpl.Entries, testCreate(t, &wt))
+	}
+	tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: "dir/"})
+
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, wt := range writeTests {
+		testReadFile(t, r.File[i], &wt)
+	}
+	for i, f := range r.File {
+		if f.Flags&0x8 != 0 {
+			t.Errorf("%s: flags %#x, data descriptor flag must not be set", f.Name, f.Flags)
+		}
+		start, _ := ar.EntryRange(i)
+		var b [fileHeaderLen]byte
+		if _, err := ar.ReadAt(b[:], start); err != nil {
+			t.Fatal(err)
+		}
+		local := readBuf(b[14:26])
+		if got := local.uint32(); got != f.CRC32 {
+			t.Errorf("%s: local header crc32 %#x, want %#x", f.Name, got, f.CRC32)
+		}
+		if got := local.uint32(); uint64(got) != f.CompressedSize64 {
+			t.Errorf("%s: local header compressed size %d, want %d", f.Name, got, f.CompressedSize64)
+		}
+		if got := local.uint32(); uint64(got) != f.UncompressedSize64 {
+			t.Errorf("%s: local header uncompressed size %d, want %d", f.Name, got, f.UncompressedSize64)
+		}
+	}
+}
+
+func TestWriterOmitDataDescriptorsUnknownSize(t *testing.T) {
+	// Content without declared sizes would leave the sizes nowhere in the local data.
+	tmpl := &Template{
+		OmitDataDescriptors: true,
+		Entries: []*FileHeader{{
+			Name:    "unknown-size.txt",
+			CRC32:   crc([]byte("hello")),
+			Content: bytes.NewReader([]byte("hello")),
+		}},
+	}
+	if _, err := NewArchive(tmpl); err != errContentZeroSize {
+		t.Errorf("NewArchive: got error %v, want %v", err, errContentZeroSize)
+	}
+	if _, err := CalculateSize(tmpl); err != errContentZeroSize {
+		t.Errorf("CalculateSize: got error %v, want %v", err, errContentZeroSize)
+	}
+}
+
+func TestWriterOmitDataDescriptorsZip64(t *testing.T) {
+	const size = 1 << 32
+	const name = "huge.txt"
+	tmpl := &Template{
+		OmitDataDescriptors: true,
+		Entries: []*FileHeader{{
+			Name:               name,
+			Method:             Store,
+			UncompressedSize64: size,
+			CompressedSize64:   size,
+			Content:            io.NewSectionReader(&sameBytes{b: 0}, 0, size),
+		}},
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, fileHeaderLen+len(name)+extTimeExtraLen+20)
+	if _, err := ar.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	local := readBuf(b[4:])
+	if got := local.uint16(); got != zipVersion45 {
+		t.Errorf("reader version %d, want %d", got, zipVersion45)
+	}
+	local = readBuf(b[18:])
+	if got := local.uint32(); got != uint32max {
+		t.Errorf("compressed size %#x, want %#x", got, uint32(uint32max))
+	}
+	if got := local.uint32(); got != uint32max {
+		t.Errorf("uncompressed size %#x, want %#x", got, uint32(uint32max))
+	}
+	local = readBuf(b[fileHeaderLen+len(name)+extTimeExtraLen:])
+	if got := local.uint16(); got != zip64ExtraID {
+		t.Fatalf("extra id %#x, want %#x", got, zip64ExtraID)
+	}
+	if got := local.uint16(); got != 16 {
+		t.Errorf("extra size %d, want 16", got)
+	}
+	if got := local.uint64(); got != size {
+		t.Errorf("zip64 uncompressed size %d, want %d", got, uint64(size))
+	}
+	if got := local.uint64(); got != size {
+		t.Errorf("zip64 compressed size %d, want %d", got, uint64(size))
+	}
+
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.File[0].UncompressedSize64; got != size {
+		t.Errorf("central directory uncompressed size %d, want %d", got, uint64(size))
+	}
+	if got, want := ar.CentralDirectoryOffset(), int64(len(b))+size; got != want {
+		t.Errorf("central directory offset %d, want %d (no data descriptor)", got, want)
+	}
+}
+
+func TestWriterDirVersions(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      func() *FileHeader
+		wantCreator uint16
+	}{
+		{
+			name:        "plain",
+			header:      func() *FileHeader { return &FileHeader{Name: "dir/"} },
+			wantCreator: zipVersion20,
+		},
+		{
+			name: "SetMode",
+			header: func() *FileHeader {
+				h := &FileHeader{Name: "dir/"}
+				h.SetMode(os.ModeDir | 0755)
+				return h
+			},
+			wantCreator: creatorUnix<<8 | zipVersion20,
+		},
+		{
+			name: "preset versions",
+			header: func() *FileHeader {
+				return &FileHeader{Name: "dir/", CreatorVersion: creatorNTFS<<8 | 63, ReaderVersion: 63}
+			},
+			wantCreator: creatorNTFS<<8 | zipVersion20,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ar, err := NewArchive(&Template{Entries: []*FileHeader{test.header()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var local [fileHeaderLen]byte
+			if _, err := ar.ReadAt(local[:], 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.LittleEndian.Uint16(local[4:]); got != zipVersion20 {
+				t.Errorf("local header reader version %d, want %d", got, zipVersion20)
+			}
+			r, err := zip.NewReader(ar, ar.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := r.File[0]
+			if f.CreatorVersion != test.wantCreator {
+				t.Errorf("creator version %#x, want %#x", f.CreatorVersion, test.wantCreator)
+			}
+			if f.ReaderVersion != zipVersion20 {
+				t.Errorf("reader version %d, want %d", f.ReaderVersion, zipVersion20)
+			}
+		})
+	}
+}
+
+func TestWriterDirectoryEndZip64SmallSizes(t *testing.T) {
+	const start = 1234
+	dir := make([]*header, uint16max)
+	for i := range dir {
+		dir[i] = &header{FileHeader: &FileHeader{Name: "a"}}
+	}
+	var gotSize, gotOffset uint64
+	var buf bytes.Buffer
+	err := writeCentralDirectory(start, dir, &buf, "", directoryOptions{}, func(size, offset uint64) {
+		gotSize, gotOffset = size, offset
+	})
+	if err != nil {
+		t.Fatalf("writeCentralDirectory: %v", err)
+	}
+	if gotSize >= uint32max || gotOffset >= uint32max {
+		t.Fatalf("size %d and offset %d should fit in 32 bits", gotSize, gotOffset)
+	}
+	b := buf.Bytes()
+
+	end64 := readBuf(b[len(b)-directoryEndLen-directory64LocLen-directory64EndLen:])
+	if sig := end64.uint32(); sig != directory64EndSignature {
+		t.Fatalf("zip64 end record signature %#x, want %#x", sig, directory64EndSignature)
+	}
+	end64 = end64[36:] // skip length, versions, disk numbers and entry counts
+	if size := end64.uint64(); size != gotSize {
+		t.Errorf("zip64 end record directory size %d, want %d", size, gotSize)
+	}
+	if offset := end64.uint64(); offset != start {
+		t.Errorf("zip64 end record directory offset %d, want %d", offset, start)
+	}
+
+	end := readBuf(b[len(b)-directoryEndLen:])
+	if sig := end.uint32(); sig != directoryEndSignature {
+		t.Fatalf("end record signature %#x, want %#x", sig, directoryEndSignature)
+	}
+	end = end[4:] // skip disk numbers
+	if records := end.uint16(); records != uint16max {
+		t.Errorf("end record entries on this disk %d, want %d", records, uint16max)
+	}
+	if records := end.uint16(); records != uint16max {
+		t.Errorf("end record entries total %d, want %d", records, uint16max)
+	}
+	if size := end.uint32(); size != uint32max {
+		t.Errorf("end record directory size %#x, want %#x", size, uint32(uint32max))
+	}
+	if offset := end.uint32(); offset != uint32max {
+		t.Errorf("end record directory offset %#x, want %#x", offset, uint32(uint32max))
+	}
+}
+
+func TestWriterPresetDictionary(t *testing.T) {
+	template := func() *Template {
+		h := testCreate(t, &writeTests[2])
+		h.PresetDictionary = true
+		return &Template{Entries: []*FileHeader{h}}
+	}
+	if _, err := NewArchive(template()); err != errPresetDictionary {
+		t.Errorf("NewArchive: got error %v, want %v", err, errPresetDictionary)
+	}
+	if _, err := CalculateSize(template()); err != errPresetDictionary {
+		t.Errorf("CalculateSize: got error %v, want %v", err, errPresetDictionary)
+	}
+}
+
+func TestWriterEncrypted(t *testing.T) {
+	encrypted := []byte("0123456789abcdefghijklmnopqrstuvwxyz") // opaque to zipserve
+	entry := func(name string, method EncryptionMethod, checksum uint32) *FileHeader {
+		return &FileHeader{
+			Name:               name,
+			Method:             Deflate,
+			CRC32:              checksum,
+			CompressedSize64:   uint64(len(encrypted)),
+			UncompressedSize64: 100,
+			Content:            bytes.NewReader(encrypted),
+			Encrypted:          true,
+			EncryptionMethod:   method,
+		}
+	}
+	tmpl := func() *Template {
+		return &Template{Entries: []*FileHeader{
+			entry("zipcrypto.txt", ZipCrypto, 0x12345678),
+			entry("aes1.txt", AES128, 0x12345678),
+			entry("aes2.txt", AES256, 0),
+			{Name: "plain.txt"},
+		}}
+	}
+	ar, err := NewArchive(tmpl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := CalculateSize(tmpl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size.Total() != ar.Size() {
+		t.Errorf("CalculateSize %d, archive size %d", size.Total(), ar.Size())
+	}
+	r, err := zip.NewReader(ar, ar.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method        uint16
+		encrypted     bool
+		aesExtra      []byte
+		readerVersion uint16
+	}{
+		{method: Deflate, encrypted: true, readerVersion: zipVersion20},
+		{method: methodAES, encrypted: true, aesExtra: []byte{1, 0, 'A', 'E', 1, 8, 0}, readerVersion: zipVersion51},
+		{method: methodAES, encrypted: true, aesExtra: []byte{2, 0, 'A', 'E', 3, 8, 0}, readerVersion: zipVersion51},
+		{method: Store, encrypted: false, readerVersion: zipVersion20},
+	}
+	for i, test := range tests {
+		f := r.File[i]
+		if f.Method != test.method {
+			t.Errorf("%s: method %d, want %d", f.Name, f.Method, test.method)
+		}
+		if got := f.Flags&0x1 != 0; got != test.encrypted {
+			t.Errorf("%s: encrypted flag %v, want %v", f.Name, got, test.encrypted)
+		}
+		if f.ReaderVersion != test.readerVersion {
+			t.Errorf("%s: reader version %d, want %d", f.Name, f.ReaderVersion, test.readerVersion)
+		}
+		var aesExtra []byte
+		for extra := f.Extra; len(extra) >= 4; {
+			id := binary.LittleEndian.Uint16(extra)
+			n := int(binary.LittleEndian.Uint16(extra[2:]))
+			if id == aesExtraID {
+				aesExtra = extra[4 : 4+n]
+			}
+			extra = extra[4+n:]
+		}
+		if !bytes.Equal(aesExtra, test.aesExtra) {
+			t.Errorf("%s: AES extra %v, want %v", f.Name, aesExtra, test.aesExtra)
+		}
+		raw, err := f.OpenRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.encrypted && !bytes.Equal(data, encrypted) {
+			t.Errorf("%s: raw content %q, want %q", f.Name, data, encrypted)
+		}
+	}
+}
+
+func TestWriterExtraOrder(t *testing.T) {
+	const size = 1 << 32
+	userExtra := []byte{0xfe, 0xca, 2, 0, 'h', 'i'}
+	extraIDs := func(extra []byte) []uint16 {
+		var ids []uint16
+		for len(extra) >= 4 {
+			ids = append(ids, binary.LittleEndian.Uint16(extra))
+			extra = extra[4+int(binary.LittleEndian.Uint16(extra[2:])):]
+		}
+		return ids
+	}
+	tests := []struct {
+		name      string
+		order     []ExtraField
+		wantLocal []uint16
+		wantDir   []uint16
+	}{
+		{
+			name:      "default",
+			wantLocal: []uint16{0xcafe, extTimeExtraID, zip64ExtraID},
+			wantDir:   []uint16{0xcafe, extTimeExtraID, zip64ExtraID},
+		},
+		{
+			name:      "zip64 first",
+			order:     []ExtraField{ExtraZip64, ExtraTimestamp},
+			wantLocal: []uint16{zip64ExtraID, extTimeExtraID, 0xcafe},
+			wantDir:   []uint16{zip64ExtraID, extTimeExtraID, 0xcafe},
+		},
+		{
+			name:      "user last",
+			order:     []ExtraField{ExtraTimestamp, ExtraZip64, ExtraUser},
+			wantLocal: []uint16{extTimeExtraID, zip64ExtraID, 0xcafe},
+			wantDir:   []uint16{extTimeExtraID, zip64ExtraID, 0xcafe},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ar, err := NewArchive(&Template{
+				OmitDataDescriptors: true,
+				ExtraOrder:          test.order,
+				Entries: []*FileHeader{{
+					Name:               "huge.txt",
+					Extra:              append([]byte(nil), userExtra...),
+					UncompressedSize64: size,
+					CompressedSize64:   size,
+					Content:            io.NewSectionReader(&sameBytes{b: 0}, 0, size),
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			local := make([]byte, 100)
+			if _, err := ar.ReadAt(local, 0); err != nil {
+				t.Fatal(err)
+			}
+			nameLen := int(binary.LittleEndian.Uint16(local[26:]))
+			extraLen := int(binary.LittleEndian.Uint16(local[28:]))
+			localExtra := local[fileHeaderLen+nameLen : fileHeaderLen+nameLen+extraLen]
+			if got := extraIDs(localExtra); !reflect.DeepEqual(got, test.wantLocal) {
+				t.Errorf("local header extra IDs %#x, want %#x", got, test.wantLocal)
+			}
+
+			dir := make([]byte, ar.Size()-ar.CentralDirectoryOffset())
+			if _, err := ar.ReadAt(dir, ar.CentralDirectoryOffset()); err != nil {
+				t.Fatal(err)
+			}
+			nameLen = int(binary.LittleEndian.Uint16(dir[28:]))
+			extraLen = int(binary.LittleEndian.Uint16(dir[30:]))
+			dirExtra := dir[directoryHeaderLen+nameLen : directoryHeaderLen+nameLen+extraLen]
+			if got := extraIDs(dirExtra); !reflect.DeepEqual(got, test.wantDir) {
+				t.Errorf("central directory extra IDs %#x, want %#x", got, test.wantDir)
+			}
+
+			r, err := zip.NewReader(ar, ar.Size())
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			if got := r.File[0].UncompressedSize64; got != size {
+				t.Errorf("uncompressed size %d, want %d", got, size)
+			}
+		})
+	}
+}
+
+func TestWriterZip64LocalHeaders(t *testing.T) {
+	tmpl := &Template{Zip64LocalHeaders: true}
+	for i := range writeTests {
+		tmpl.Entries = append(tmpl.Entries, testCreate(t, &writeTests[i]))
+	}
+	tmpl.Entries = append(tmpl.Entries, &FileHeader{Name: "dir/"})
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	for i, wt := range writeTests {
+		testReadFile(t, r.File[i], &wt)
+	}
+
+	for i, entry := range tmpl.Entries {
+		start, _ := ar.EntryRange(i)
+		local := b[start:]
+		if flags := binary.LittleEndian.Uint16(local[6:]); flags&0x8 != 0 {
+			t.Errorf("%s: data descriptor flag set", entry.Name)
+		}
+		nameLen := int(binary.LittleEndian.Uint16(local[26:]))
+		extraLen := int(binary.LittleEndian.Uint16(local[28:]))
+		extra := local[fileHeaderLen+nameLen : fileHeaderLen+nameLen+extraLen]
+		var zip64 []byte
+		for len(extra) >= 4 {
+			size := int(binary.LittleEndian.Uint16(extra[2:]))
+			if binary.LittleEndian.Uint16(extra) == zip64ExtraID {
+				zip64 = extra[4 : 4+size]
+			}
+			extra = extra[4+size:]
+		}
+		if entry.Name == "dir/" {
+			if zip64 != nil {
+				t.Errorf("%s: directory has zip64 extra", entry.Name)
+			}
+			continue
+		}
+		if len(zip64) != 16 {
+			t.Fatalf("%s: zip64 extra %v, want 16 bytes", entry.Name, zip64)
+		}
+		if got := binary.LittleEndian.Uint32(local[18:]); got != uint32max {
+			t.Errorf("%s: local compressed size %#x, want %#x", entry.Name, got, uint32max)
+		}
+		if got := binary.LittleEndian.Uint64(zip64); got != entry.UncompressedSize64 {
+			t.Errorf("%s: zip64 uncompressed size %d, want %d", entry.Name, got, entry.UncompressedSize64)
+		}
+		if got := binary.LittleEndian.Uint64(zip64[8:]); got != entry.CompressedSize64 {
+			t.Errorf("%s: zip64 compressed size %d, want %d", entry.Name, got, entry.CompressedSize64)
+		}
+		if got := binary.LittleEndian.Uint16(local[4:]); got != zipVersion45 {
+			t.Errorf("%s: reader version %d, want %d", entry.Name, got, zipVersion45)
+		}
+	}
+}
+
+func TestWriterGoCompat(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)
+	stored := []byte("hello")
+	deflated := bytes.Repeat([]byte("hello "), 10)
+	for _, m := range []time.Time{modified, {}} {
+		t.Run(m.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			zw := zip.NewWriter(&buf)
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: "stored.txt", Method: zip.Store, Modified: m})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(stored)
+			if _, err := zw.CreateHeader(&zip.FileHeader{Name: "dir/", Modified: m}); err != nil {
+				t.Fatal(err)
+			}
+			w, err = zw.CreateHeader(&zip.FileHeader{Name: "deflated.txt", Method: zip.Deflate, Modified: m})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(deflated)
+			if err := zw.SetComment("comment"); err != nil {
+				t.Fatal(err)
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			want := buf.Bytes()
+
+			// reuse the compressed data from archive/zip
+			zr, err := zip.NewReader(bytes.NewReader(want), int64(len(want)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := zr.File[2].OpenRaw()
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := ioutil.ReadAll(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tmpl := &Template{
+				GoCompat: true,
+				Comment:  "comment",
+				Entries: []*FileHeader{
+					{
+						Name:               "stored.txt",
+						Modified:           m,
+						CRC32:              crc(stored),
+						CompressedSize64:   uint64(len(stored)),
+						UncompressedSize64: uint64(len(stored)),
+						Content:            bytes.NewReader(stored),
+					},
+					{Name: "dir/", Modified: m},
+					{
+						Name:               "deflated.txt",
+						Method:             Deflate,
+						Modified:           m,
+						CRC32:              crc(deflated),
+						CompressedSize64:   uint64(len(compressed)),
+						UncompressedSize64: uint64(len(deflated)),
+						Content:            bytes.NewReader(compressed),
+					},
+				},
+			}
+			size, err := CalculateSize(tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ar, err := NewArchive(tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from archive/zip:\n got %x\nwant %x", got, want)
+			}
+			if size.Total() != ar.Size() {
+				t.Errorf("CalculateSize %d, archive size %d", size.Total(), ar.Size())
+			}
+		})
+	}
+}
+
+func TestWriterLegacyCompat(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)
+	data := []byte("hello")
+	tmpl := &Template{
+		LegacyCompat: true,
+		Entries: []*FileHeader{
+			{
+				Name:               "file.txt",
+				Modified:           modified,
+				CRC32:              crc(data),
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(data)),
+				Content:            bytes.NewReader(data),
+			},
+			{Name: "dir/", Modified: modified},
+		},
+	}
+	size, err := CalculateSize(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.Size() != size.Total() {
+		t.Errorf("CalculateSize %d, archive size %d", size.Total(), ar.Size())
+	}
+	b, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if f.Flags&0x800 != 0 {
+			t.Errorf("%s: UTF-8 flag set", f.Name)
+		}
+		if f.ReaderVersion != zipVersion20 {
+			t.Errorf("%s: reader version %d, want %d", f.Name, f.ReaderVersion, zipVersion20)
+		}
+		for extra := f.Extra; len(extra) >= 4; {
+			id := binary.LittleEndian.Uint16(extra)
+			n := binary.LittleEndian.Uint16(extra[2:])
+			if id == extTimeExtraID {
+				t.Errorf("%s: central directory contains extended timestamp", f.Name)
+			}
+			extra = extra[4+int(n):]
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		localExtraLen := binary.LittleEndian.Uint16(b[offset-int64(len(f.Name))-2:])
+		if localExtraLen != 0 {
+			t.Errorf("%s: local header extra length %d, want 0", f.Name, localExtraLen)
+		}
+		if got, want := f.Modified, modified.Truncate(2*time.Second); !got.Equal(want) {
+			t.Errorf("%s: modified %v, want %v", f.Name, got, want)
+		}
+	}
+	if !bytes.Contains(b, []byte{'P', 'K', 7, 8}) {
+		t.Error("data descriptor with signature not found")
+	}
+
+	tmpl.Zip64LocalHeaders = true
+	if _, err := NewArchive(tmpl); err == nil {
+		t.Error("expected an error for LegacyCompat with Zip64LocalHeaders, got nil")
+	}
+}
+
+func TestWriterDirDataDescriptors(t *testing.T) {
+	data := []byte("hello")
+	tmpl := &Template{
+		DirDataDescriptors: true,
+		Entries: []*FileHeader{
+			{Name: "dir/"},
+			{
+				Name:               "dir/file.txt",
+				CRC32:              crc(data),
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(data)),
+				Content:            bytes.NewReader(data),
+			},
+		},
+	}
+	size, err := CalculateSize(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := NewArchive(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.Size() != size.Total() {
+		t.Errorf("CalculateSize %d, archive size %d", size.Total(), ar.Size())
+	}
+	if size.DataDescriptors != 2*dataDescriptorLen {
+		t.Errorf("data descriptors size %d, want %d", size.DataDescriptors, 2*dataDescriptorLen)
+	}
+	b, err := ioutil.ReadAll(io.NewSectionReader(ar, 0, ar.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, end := ar.EntryRange(0)
+	descriptor := b[end-dataDescriptorLen : end]
+	want := make([]byte, dataDescriptorLen)
+	binary.LittleEndian.PutUint32(want, dataDescriptorSignature)
+	if !bytes.Equal(descriptor, want) {
+		t.Errorf("directory data descriptor %x, want %x", descriptor, want)
+	}
+	if flags := binary.LittleEndian.Uint16(b[start+6:]); flags&0x8 == 0 {
+		t.Errorf("local header flags %#x, want data descriptor flag", flags)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := r.File[0]
+	if dir.Flags&0x8 == 0 {
+		t.Errorf("central directory flags %#x, want data descriptor flag", dir.Flags)
+	}
+	if !dir.Mode().IsDir() {
+		t.Errorf("mode %v, want directory", dir.Mode())
+	}
+	rc, err := dir.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rc); err != nil {
+		t.Errorf("reading directory: %v", err)
+	}
+	rc.Close()
+	testReadFile(t, r.File[1], &WriteTest{Name: "dir/file.txt", Data: data, Method: Store, Mode: 0666})
+}
@@ -389,7 +389,7 @@ func suffixIsZip64(t *testing.T, zip sizedReaderAt) bool {
 	return true
 }
 
-func rleView(content func(w io.Writer) error) (sizeReaderAt, error) {
+func rleView(content func(w io.Writer) error) (SizedReaderAt, error) {
 	buf := new(rleBuffer)
 	err := content(buf)
 	if err != nil {